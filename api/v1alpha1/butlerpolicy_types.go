@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+)
+
+// ButlerPolicySpec defines how served vpas of the matching workloads are configured.
+// Unset fields fall back to the defaults given on the command line.
+type ButlerPolicySpec struct {
+	// Priority decides which policy applies, if multiple policies match a workload.
+	// The policy with the highest priority wins.
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+	// NamespaceSelector selects the namespaces of the matching workloads.
+	// An empty or missing selector matches all namespaces.
+	// +kubebuilder:validation:XValidation:rule="!has(self.matchExpressions) || self.matchExpressions.all(e, e.operator in ['In', 'NotIn'] ? has(e.values) && size(e.values) > 0 : e.operator in ['Exists', 'DoesNotExist'] && (!has(e.values) || size(e.values) == 0))",message="the operators In and NotIn require values, Exists and DoesNotExist do not allow values"
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// WorkloadSelector selects the matching workloads by their labels.
+	// An empty or missing selector matches all workloads.
+	// +kubebuilder:validation:XValidation:rule="!has(self.matchExpressions) || self.matchExpressions.all(e, e.operator in ['In', 'NotIn'] ? has(e.values) && size(e.values) > 0 : e.operator in ['Exists', 'DoesNotExist'] && (!has(e.values) || size(e.values) == 0))",message="the operators In and NotIn require values, Exists and DoesNotExist do not allow values"
+	// +optional
+	WorkloadSelector *metav1.LabelSelector `json:"workloadSelector,omitempty"`
+	// Kinds restricts the policy to workloads of the given kinds, e.g. Deployment.
+	// An empty list matches all kinds.
+	// +optional
+	Kinds []string `json:"kinds,omitempty"`
+	// UpdateMode is set on the served vpas.
+	// +kubebuilder:validation:Enum=Off;Initial;Recreate;Auto
+	// +optional
+	UpdateMode *vpav1.UpdateMode `json:"updateMode,omitempty"`
+	// ControlledValues is set on the container policies of the served vpas.
+	// +kubebuilder:validation:Enum=RequestsOnly;RequestsAndLimits
+	// +optional
+	ControlledValues *vpav1.ContainerControlledValues `json:"controlledValues,omitempty"`
+	// MinAllowed is set on the container policies of the served vpas.
+	// Only cpu and memory are considered.
+	// +optional
+	MinAllowed corev1.ResourceList `json:"minAllowed,omitempty"`
+	// CapacityPercent is the percentage of the reference node capacity
+	// to be set as maximum allowed resources on the served vpas.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	CapacityPercent *int64 `json:"capacityPercent,omitempty"`
+}
+
+// ButlerPolicyStatus defines the observed state of ButlerPolicy.
+type ButlerPolicyStatus struct {
+	// ObservedGeneration is the generation of the policy last observed by the vpa_butler.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// AppliedCount is the amount of served vpas the policy applies to.
+	// +optional
+	AppliedCount int32 `json:"appliedCount,omitempty"`
+	// AppliedTo lists a sample of the served vpas the policy applies to formatted as namespace/name.
+	// It is truncated to the first vpas in lexical order, see AppliedCount for the total.
+	// +kubebuilder:validation:MaxItems=20
+	// +optional
+	AppliedTo []string `json:"appliedTo,omitempty"`
+	// Conditions report whether the selectors of the policy are valid.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// ConditionValid is the condition type reporting whether the selectors of a ButlerPolicy
+// are valid. Policies with invalid selectors are skipped.
+const ConditionValid = "Valid"
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Priority",type=integer,JSONPath=`.spec.priority`
+// +kubebuilder:printcolumn:name="Applied",type=integer,JSONPath=`.status.appliedCount`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ButlerPolicy configures the vpas served for a set of workloads.
+type ButlerPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ButlerPolicySpec   `json:"spec,omitempty"`
+	Status ButlerPolicyStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ButlerPolicyList contains a list of ButlerPolicy.
+type ButlerPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ButlerPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ButlerPolicy{}, &ButlerPolicyList{})
+}
@@ -4,36 +4,64 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	autoscaling "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/events"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	"github.com/sapcc/vpa_butler/api/v1alpha1"
 	"github.com/sapcc/vpa_butler/internal/common"
 	"github.com/sapcc/vpa_butler/internal/controllers"
+	"github.com/sapcc/vpa_butler/internal/dryrun"
+	"github.com/sapcc/vpa_butler/internal/filter"
 	"github.com/sapcc/vpa_butler/internal/metrics"
+	"github.com/sapcc/vpa_butler/internal/platform"
 )
 
 const (
-	webhookPort       = 9443
-	vpaRunnablePeriod = 30 * time.Second
+	webhookPort = 9443
+	// served vpas are reconciled on changes, the period is just a safety net
+	vpaRunnablePeriod = 10 * time.Minute
 	vpaRunnableJitter = 1.2
 	// 72 is not too high and can be divided without remainder
 	// by 1,2,3 and 4 containers within a pod.
 	defaultCapacityPercent = 72
+	// nodes flapping quicker than this do not change the maximum allowed resources
+	defaultNodeGracePeriod = 5 * time.Minute
+	// the defaults of client-go for leader election
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 2 * time.Second
+	// explainReadHeaderTimeout guards the explain server against slow clients
+	explainReadHeaderTimeout = 10 * time.Second
+	// a shadow deployment in dry-run must not compete with the live one for its lease
+	dryRunLeaseSuffix = "-dry-run"
 )
 
 var (
@@ -43,20 +71,47 @@ var (
 
 	Version                   string
 	defaultVpaUpdateMode      string
+	defaultBatchVpaUpdateMode string
 	defaultVpaSupportedValues string
 	defaultMinAllowedMemory   string
 	defaultMinAllowedCPU      string
 	capacityPercent           int64
+	hpaConflictPolicy         string
+	distributionMode          string
+	referenceNodeStrategy     string
+	referenceNodePercentile   int64
+	nodeTemplates             string
+	nodeGracePeriod           time.Duration
+	nodeFilters               string
+	nodePoolSelector          string
+	imageRegistries           string
+	explainBindAddress        string
+	customKinds               []controllers.CustomKind
+	includeNamespaces         string
+	excludeNamespaces         string
+	workloadSelector          string
+	dryRun                    bool
+	leaderElection            bool
+	leaderElectionNamespace   string
+	leaderElectionID          string
+	leaseDuration             time.Duration
+	renewDeadline             time.Duration
+	retryPeriod               time.Duration
 )
 
 func init() {
 	_ = autoscaling.AddToScheme(scheme)    //nolint:errcheck //application fails immediately if schemes are not found
 	_ = clientgoscheme.AddToScheme(scheme) //nolint:errcheck //application fails immediately if schemes are not found
+	_ = v1alpha1.AddToScheme(scheme)       //nolint:errcheck //application fails immediately if schemes are not found
 
 	flag.StringVar(&defaultVpaUpdateMode, "default-vpa-update-mode", "Off",
 		"The default update mode for the vpa instances. Must be one of: "+
 			strings.Join(common.SupportedUpdatedModes, ","))
 
+	flag.StringVar(&defaultBatchVpaUpdateMode, "default-batch-vpa-update-mode", "Initial",
+		"The default update mode for the vpa instances of cronjobs and jobs. Must be one of: "+
+			strings.Join(common.SupportedUpdatedModes, ","))
+
 	flag.StringVar(&defaultVpaSupportedValues, "default-vpa-supported-values", "RequestsOnly",
 		"Controls which resource value should be autoscaled. Must be one of: "+
 			strings.Join(common.SupportedControlledValues, ","))
@@ -67,71 +122,262 @@ func init() {
 		"The default min allowed CPU per container that the vpa can set")
 	flag.Int64Var(&capacityPercent, "capacity-percent", defaultCapacityPercent,
 		"percentage of the largest viable node capacity to be set as max resources on the VPA object")
+	flag.StringVar(&hpaConflictPolicy, "hpa-conflict-policy", string(controllers.HpaConflictRestrictResources),
+		"How to configure served vpas, whose target is scaled by a hpa on cpu or memory. Must be one of: "+
+			strings.Join(controllers.SupportedHpaConflictPolicies, ","))
+	flag.StringVar(&distributionMode, "distribution-mode", string(controllers.DistributionUniform),
+		"How to distribute the maximum allowed resources across the containers of a pod. Must be one of: "+
+			strings.Join(controllers.SupportedDistributionModes, ","))
+	flag.StringVar(&referenceNodeStrategy, "reference-node", string(controllers.ReferenceNodeMemory),
+		"How to rank the viable nodes to select the reference node for the maximum allowed resources. Must be one of: "+
+			strings.Join(controllers.SupportedReferenceNodeStrategies, ","))
+	flag.Int64Var(&referenceNodePercentile, "reference-node-percentile", controllers.MaxReferenceNodePercentile,
+		"Percentile of the ranked viable nodes to select as reference node, 100 selects the largest one")
+	flag.StringVar(&nodeTemplates, "node-templates", "",
+		"ConfigMap formatted as <namespace>/<name> describing node pools, which may be scaled to zero. "+
+			"Each key names a template with labels, taints and allocatable resources")
+	flag.DurationVar(&nodeGracePeriod, "node-grace-period", defaultNodeGracePeriod,
+		"How long a node needs to be unhealthy or a deletion candidate, before it is no longer "+
+			"considered for the maximum allowed resources")
+	flag.StringVar(&nodeFilters, "node-filters", strings.Join(filter.DefaultFilters, ","),
+		"Comma-separated list of filters deciding on the viable nodes, applied in order. Must be any of: "+
+			strings.Join(filter.Names(), ","))
+	flag.StringVar(&nodePoolSelector, "node-pool-selector", "",
+		"Label selector of the nodes kept by the NodePool filter")
+	flag.StringVar(&imageRegistries, "image-registries", "",
+		"Comma-separated list of registries, e.g. docker.io,ghcr.io, the Platform filter resolves the platforms "+
+			"of images from. Images are not resolved, if empty")
+	flag.StringVar(&explainBindAddress, "explain-bind-address", "",
+		"Loopback address, e.g. 127.0.0.1:8082, the leader serves the unauthenticated explain endpoint "+
+			controllers.ExplainPath+"<namespace>/<name> on. The endpoint is disabled, if empty")
+	flag.StringVar(&includeNamespaces, "include-namespaces", "",
+		"Comma-separated list of namespace glob patterns to serve vpas in. All namespaces are included, if empty")
+	flag.StringVar(&excludeNamespaces, "exclude-namespaces", "",
+		"Comma-separated list of namespace glob patterns to not serve vpas in")
+	flag.StringVar(&workloadSelector, "workload-selector", "",
+		"Label selector restricting the workloads to serve vpas for")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Send all mutations with server-side dry-run and log them instead of changing the cluster")
+	flag.BoolVar(&leaderElection, "leader-elect", false,
+		"Enable leader election, so only one of several replicas serves vpas and sets their maximum allowed resources")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", "",
+		"Namespace of the leader election lease, defaults to the namespace the vpa_butler is running in")
+	flag.StringVar(&leaderElectionID, "leader-election-id", "vpa-butler.cloud.sap",
+		"Name of the leader election lease, suffixed by "+dryRunLeaseSuffix+" in dry-run unless set explicitly")
+	flag.DurationVar(&leaseDuration, "leader-election-lease-duration", defaultLeaseDuration,
+		"Duration followers wait before trying to acquire a lease not renewed by the leader")
+	flag.DurationVar(&renewDeadline, "leader-election-renew-deadline", defaultRenewDeadline,
+		"Duration the leader retries renewing its lease before giving up leadership")
+	flag.DurationVar(&retryPeriod, "leader-election-retry-period", defaultRetryPeriod,
+		"Duration between attempts to acquire or renew the lease")
+	flag.Func("custom-kind",
+		"Additional workload kind exposing a /scale subresource to serve vpas for (can be repeated). "+
+			"Must be formatted as <group>/<version>/<kind>[;<pod template path>;<selector path>], "+
+			"the paths default to {.spec.template} and {.spec.selector}",
+		func(s string) error {
+			kind, err := controllers.ParseCustomKind(s)
+			if err != nil {
+				return err
+			}
+			customKinds = append(customKinds, kind)
+			return nil
+		})
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case simulateCommand:
+			simulate(os.Args[2:])
+			return
+		case snapshotCommand:
+			takeSnapshot(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
 	metrics.RegisterMetrics()
 	setGlobals()
 
-	minAllowedCPU := resource.MustParse(defaultMinAllowedCPU)
-	minAllowedMemory := resource.MustParse(defaultMinAllowedMemory)
-
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 	setupLog.Info("starting")
+	nodeTemplatesRef, err := controllers.ParseNodeTemplatesRef(nodeTemplates)
+	handleError(err, "invalid node templates")
+	filterNames, poolSelector, err := parseNodeFilters()
+	handleError(err, "invalid node filters")
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:         scheme,
-		LeaderElection: false,
-		WebhookServer:  webhook.NewServer(webhook.Options{Port: webhookPort}),
+		Scheme:                        scheme,
+		LeaderElection:                leaderElection,
+		LeaderElectionNamespace:       leaderElectionNamespace,
+		LeaderElectionID:              leaderElectionID,
+		LeaderElectionReleaseOnCancel: true,
+		LeaseDuration:                 &leaseDuration,
+		RenewDeadline:                 &renewDeadline,
+		RetryPeriod:                   &retryPeriod,
+		WebhookServer:                 webhook.NewServer(webhook.Options{Port: webhookPort}),
 		Metrics: server.Options{
 			BindAddress: ":8080",
 		},
 		Cache: cache.Options{
 			SyncPeriod:       &syncPeriod,
 			DefaultTransform: cache.TransformStripManagedFields(),
+			ByObject:         cacheByObject(nodeTemplatesRef),
 		},
 		HealthProbeBindAddress: ":8081",
+		NewClient:              newClient,
 	})
 
 	handleError(err, "unable to start manager")
-	handleError(controllers.SetupForAppsV1(mgr), "unable to setup apps/v1 controllers")
-	vpaController := controllers.VpaController{
-		Client:           mgr.GetClient(),
-		Version:          Version,
-		MinAllowedCPU:    minAllowedCPU,
-		MinAllowedMemory: minAllowedMemory,
-	}
+	ctx := ctrl.SetupSignalHandler()
+	handleError(controllers.RegisterIndexes(ctx, mgr.GetFieldIndexer()), "unable to register indexes")
+	scope, err := controllers.NewScope(includeNamespaces, excludeNamespaces, workloadSelector)
+	handleError(err, "invalid scope")
+	genericRecorder := newEventRecorder(mgr, "generic-controller")
+	handleError(controllers.SetupForAppsV1(mgr, scope, genericRecorder), "unable to setup apps/v1 controllers")
+	handleError(controllers.SetupForBatchV1(mgr, scope, genericRecorder), "unable to setup batch/v1 controllers")
+	handleError(controllers.SetupForCustomKinds(mgr, customKinds, scope, genericRecorder),
+		"unable to setup custom kind controllers")
+	vpaController := newVpaController()
+	vpaController.Recorder = newEventRecorder(mgr, "vpa-controller")
 	handleError(vpaController.SetupWithManager(mgr), "unable to setup vpa controller")
-	vpaRunnable := controllers.VpaRunnable{
-		Client:          mgr.GetClient(),
-		Period:          vpaRunnablePeriod,
-		JitterFactor:    vpaRunnableJitter,
-		CapacityPercent: capacityPercent,
-		Log:             mgr.GetLogger().WithName("vpa-runnable"),
-	}
-	handleError(mgr.Add(&vpaRunnable), "unable to add vpa runnable")
+	policyController := controllers.PolicyController{
+		Client: mgr.GetClient(),
+	}
+	handleError(policyController.SetupWithManager(mgr), "unable to setup policy controller")
+	vpaRunnable := newVpaRunnable(nodeTemplatesRef, filterNames, poolSelector)
+	vpaRunnable.Client = mgr.GetClient()
+	vpaRunnable.Cache = mgr.GetCache()
+	vpaRunnable.Log = mgr.GetLogger().WithName("vpa-runnable")
+	vpaRunnable.Recorder = newEventRecorder(mgr, "vpa-runnable")
+	if registries := splitList(imageRegistries); len(registries) > 0 {
+		vpaRunnable.Platforms = platform.NewResolver(&http.Client{Timeout: 10 * time.Second}, time.Hour, registries)
+	}
+	handleError(mgr.Add(vpaRunnable), "unable to add vpa runnable")
+	if explainBindAddress != "" {
+		handleError(mgr.Add(serveExplain(explainBindAddress, vpaRunnable.ExplainHandler())),
+			"unable to add explain server")
+	}
 	handleError(mgr.AddHealthzCheck("healthz", healthz.Ping), "unable to set up health check")
 	handleError(mgr.AddReadyzCheck("readyz", healthz.Ping), "unable to set up ready check")
 	setupLog.Info("starting manager")
-	handleError(mgr.Start(ctrl.SetupSignalHandler()), "problem running manager")
+	handleError(mgr.Start(ctx), "problem running manager")
 }
 
-func setGlobals() {
-	// Helm requires the 'Off' value to be quoted to avoid it being interpreted as a boolean.
-	defaultVpaUpdateMode = strings.Trim(defaultVpaUpdateMode, "\"")
-	switch defaultVpaUpdateMode {
-	case "Initial":
-		common.VpaUpdateMode = autoscaling.UpdateModeInitial
-	case "Recreate":
-		common.VpaUpdateMode = autoscaling.UpdateModeRecreate
-	case "Off":
-		common.VpaUpdateMode = autoscaling.UpdateModeOff
-	default:
-		fmt.Printf("unsupported update mode %s. Must be one of: %s",
-			defaultVpaUpdateMode,
-			strings.Join(common.SupportedUpdatedModes, ","))
-		os.Exit(1)
+// serveExplain serves the explain handler on a listener of its own until the manager stops.
+func serveExplain(address string, handler http.Handler) manager.RunnableFunc {
+	return func(ctx context.Context) error {
+		mux := http.NewServeMux()
+		mux.Handle(controllers.ExplainPath, handler)
+		explainServer := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: explainReadHeaderTimeout}
+		go func() {
+			<-ctx.Done()
+			if err := explainServer.Shutdown(context.Background()); err != nil {
+				setupLog.Error(err, "failed to shut down explain server")
+			}
+		}()
+		if err := explainServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
 	}
+}
+
+// newClient creates the client of the manager, which sends all mutations with server-side dry-run in dry-run mode.
+func newClient(config *rest.Config, options client.Options) (client.Client, error) {
+	c, err := client.New(config, options)
+	if err != nil || !dryRun {
+		return c, err
+	}
+	return dryrun.NewClient(c, ctrl.Log.WithName("dry-run")), nil
+}
+
+// newEventRecorder returns the event recorder of the manager, which is replaced by logging in dry-run mode.
+func newEventRecorder(mgr ctrl.Manager, name string) events.EventRecorder {
+	if !dryRun {
+		return mgr.GetEventRecorder(name)
+	}
+	return &dryrun.Recorder{Log: ctrl.Log.WithName("dry-run").WithName(name), Scheme: mgr.GetScheme()}
+}
+
+// newVpaController returns a VpaController configured by the flags.
+func newVpaController() *controllers.VpaController {
+	return &controllers.VpaController{
+		Version:           Version,
+		MinAllowedCPU:     resource.MustParse(defaultMinAllowedCPU),
+		MinAllowedMemory:  resource.MustParse(defaultMinAllowedMemory),
+		CustomKinds:       customKinds,
+		HpaConflictPolicy: controllers.HpaConflictPolicy(hpaConflictPolicy),
+	}
+}
+
+// newVpaRunnable returns a VpaRunnable configured by the flags.
+func newVpaRunnable(nodeTemplatesRef types.NamespacedName, filterNames []string,
+	poolSelector labels.Selector) *controllers.VpaRunnable {
+
+	return &controllers.VpaRunnable{
+		Period:                  vpaRunnablePeriod,
+		JitterFactor:            vpaRunnableJitter,
+		CapacityPercent:         capacityPercent,
+		DistributionMode:        controllers.DistributionMode(distributionMode),
+		ReferenceNodeStrategy:   controllers.ReferenceNodeStrategy(referenceNodeStrategy),
+		ReferenceNodePercentile: referenceNodePercentile,
+		NodeTemplates:           nodeTemplatesRef,
+		NodeGracePeriod:         nodeGracePeriod,
+		NodeFilters:             filterNames,
+		NodePoolSelector:        poolSelector,
+		CustomKinds:             customKinds,
+	}
+}
+
+// parseNodeFilters validates the configured node filters by building a chain of them.
+func parseNodeFilters() ([]string, labels.Selector, error) {
+	var selector labels.Selector
+	if nodePoolSelector != "" {
+		parsed, err := labels.Parse(nodePoolSelector)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid node pool selector: %w", err)
+		}
+		selector = parsed
+	}
+	names := splitList(nodeFilters)
+	if _, err := filter.NewChain(names, filter.Config{NodePoolSelector: selector}); err != nil {
+		return nil, nil, err
+	}
+	return names, selector, nil
+}
+
+// splitList returns the non-empty items of a comma-separated list.
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for item := range strings.SplitSeq(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// cacheByObject keeps the managed fields of vpas, which are upgraded to server-side apply,
+// and restricts the cached ConfigMaps to the node templates.
+func cacheByObject(ref types.NamespacedName) map[client.Object]cache.ByObject {
+	byObject := map[client.Object]cache.ByObject{
+		&autoscaling.VerticalPodAutoscaler{}: {
+			Transform: func(obj any) (any, error) { return obj, nil },
+		},
+	}
+	if ref.Name == "" {
+		return byObject
+	}
+	byObject[&corev1.ConfigMap{}] = cache.ByObject{
+		Namespaces: map[string]cache.Config{ref.Namespace: {}},
+		Field:      fields.OneTermEqualSelector("metadata.name", ref.Name),
+	}
+	return byObject
+}
+
+func setGlobals() {
+	common.VpaUpdateMode = parseUpdateMode(defaultVpaUpdateMode)
+	common.VpaBatchUpdateMode = parseUpdateMode(defaultBatchVpaUpdateMode)
 
 	switch defaultVpaSupportedValues {
 	case "RequestsAndLimits":
@@ -142,6 +388,74 @@ func setGlobals() {
 		fmt.Printf("supported values must be one of: %s", strings.Join(common.SupportedControlledValues, ","))
 		os.Exit(1)
 	}
+
+	if !slices.Contains(controllers.SupportedHpaConflictPolicies, hpaConflictPolicy) {
+		fmt.Printf("hpa conflict policy must be one of: %s", strings.Join(controllers.SupportedHpaConflictPolicies, ","))
+		os.Exit(1)
+	}
+
+	if !slices.Contains(controllers.SupportedDistributionModes, distributionMode) {
+		fmt.Printf("distribution mode must be one of: %s", strings.Join(controllers.SupportedDistributionModes, ","))
+		os.Exit(1)
+	}
+
+	if !slices.Contains(controllers.SupportedReferenceNodeStrategies, referenceNodeStrategy) {
+		fmt.Printf("reference node strategy must be one of: %s",
+			strings.Join(controllers.SupportedReferenceNodeStrategies, ","))
+		os.Exit(1)
+	}
+
+	if referenceNodePercentile < 1 || referenceNodePercentile > controllers.MaxReferenceNodePercentile {
+		fmt.Printf("reference node percentile must be between 1 and %d", controllers.MaxReferenceNodePercentile)
+		os.Exit(1)
+	}
+
+	if explainBindAddress != "" && !isLoopback(explainBindAddress) {
+		fmt.Printf("explain bind address must be a loopback address, as the endpoint is not authenticated")
+		os.Exit(1)
+	}
+
+	if dryRun && !isFlagSet("leader-election-id") {
+		leaderElectionID += dryRunLeaseSuffix
+	}
+}
+
+// isLoopback returns true, if the host of the address is localhost or a loopback ip.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// isFlagSet returns true, if the flag was passed on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+func parseUpdateMode(mode string) autoscaling.UpdateMode {
+	// Helm requires the 'Off' value to be quoted to avoid it being interpreted as a boolean.
+	mode = strings.Trim(mode, "\"")
+	switch mode {
+	case "Initial":
+		return autoscaling.UpdateModeInitial
+	case "Recreate":
+		return autoscaling.UpdateModeRecreate
+	case "Off":
+		return autoscaling.UpdateModeOff
+	default:
+		fmt.Printf("unsupported update mode %s. Must be one of: %s",
+			mode,
+			strings.Join(common.SupportedUpdatedModes, ","))
+		os.Exit(1)
+	}
+	return ""
 }
 
 func handleError(err error, message string) {
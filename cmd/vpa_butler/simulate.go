@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
+
+	"github.com/sapcc/vpa_butler/internal/controllers"
+	"github.com/sapcc/vpa_butler/internal/snapshot"
+)
+
+const simulateCommand = "simulate"
+
+// simulate prints the vpas the vpa_butler would create, patch or delete, when serving the
+// objects of a snapshot file. It accepts the same flags as the controller.
+func simulate(args []string) {
+	var snapshotPath string
+	flag.StringVar(&snapshotPath, "snapshot", "",
+		"Multi-document YAML file of nodes, workloads, vpas and further objects to simulate the vpa_butler on")
+	handleError(flag.CommandLine.Parse(args), "invalid flags")
+	setGlobals()
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true), zap.WriteTo(os.Stderr)))
+	if snapshotPath == "" {
+		handleError(errors.New("--snapshot is required"), "invalid flags")
+	}
+	nodeTemplatesRef, err := controllers.ParseNodeTemplatesRef(nodeTemplates)
+	handleError(err, "invalid node templates")
+	filterNames, poolSelector, err := parseNodeFilters()
+	handleError(err, "invalid node filters")
+	scope, err := controllers.NewScope(includeNamespaces, excludeNamespaces, workloadSelector)
+	handleError(err, "invalid scope")
+
+	file, err := os.Open(snapshotPath)
+	handleError(err, "unable to open snapshot")
+	defer file.Close()
+	objects, err := snapshot.Read(file, scheme)
+	handleError(err, "unable to read snapshot")
+
+	vpaController := newVpaController()
+	vpaController.Log = ctrl.Log.WithName("vpa-controller")
+	vpaRunnable := newVpaRunnable(nodeTemplatesRef, filterNames, poolSelector)
+	vpaRunnable.Log = ctrl.Log.WithName("vpa-runnable")
+	simulation := controllers.Simulation{
+		Scheme:     scheme,
+		Scope:      scope,
+		Log:        ctrl.Log,
+		Controller: vpaController,
+		Runnable:   vpaRunnable,
+	}
+	changes, err := simulation.Run(ctrl.SetupSignalHandler(), objects)
+	handleError(err, "simulation failed")
+	handleError(printChanges(os.Stdout, changes), "unable to print changes")
+}
+
+// printChanges writes the changed vpas as multi-document YAML, each preceded by a comment naming the change.
+func printChanges(w io.Writer, changes []controllers.VpaChange) error {
+	for i, change := range changes {
+		vpa := change.Vpa.DeepCopy()
+		vpa.APIVersion = vpav1.SchemeGroupVersion.String()
+		vpa.Kind = "VerticalPodAutoscaler"
+		vpa.ResourceVersion = ""
+		vpa.ManagedFields = nil
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vpa)
+		if err != nil {
+			return err
+		}
+		// the status is not written by the vpa_butler
+		delete(obj, "status")
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if _, err := fmt.Fprintln(w, "---"); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "# %s %s/%s\n%s", change.Action, vpa.Namespace, vpa.Name, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
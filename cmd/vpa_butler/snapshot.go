@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/sapcc/vpa_butler/api/v1alpha1"
+	"github.com/sapcc/vpa_butler/internal/controllers"
+	"github.com/sapcc/vpa_butler/internal/snapshot"
+)
+
+const snapshotCommand = "snapshot"
+
+// snapshotKinds are the kinds of objects read by the vpa_butler besides custom kinds and node templates.
+var snapshotKinds = []schema.GroupVersionKind{
+	corev1.SchemeGroupVersion.WithKind("Node"),
+	corev1.SchemeGroupVersion.WithKind("Namespace"),
+	appsv1.SchemeGroupVersion.WithKind("Deployment"),
+	appsv1.SchemeGroupVersion.WithKind("StatefulSet"),
+	appsv1.SchemeGroupVersion.WithKind("DaemonSet"),
+	batchv1.SchemeGroupVersion.WithKind("CronJob"),
+	batchv1.SchemeGroupVersion.WithKind("Job"),
+	autoscalingv2.SchemeGroupVersion.WithKind("HorizontalPodAutoscaler"),
+	vpav1.SchemeGroupVersion.WithKind("VerticalPodAutoscaler"),
+	v1alpha1.GroupVersion.WithKind("ButlerPolicy"),
+}
+
+// takeSnapshot writes the objects read by the vpa_butler as sanitized snapshot,
+// which can be passed to the simulate subcommand.
+func takeSnapshot(args []string) {
+	var output string
+	var anonymize bool
+	flag.StringVar(&output, "output", "", "File to write the snapshot to, defaults to stdout")
+	flag.BoolVar(&anonymize, "anonymize", false,
+		"Replace the names of namespaces, nodes and namespaced objects by pseudonyms and remove images")
+	handleError(flag.CommandLine.Parse(args), "invalid flags")
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true), zap.WriteTo(os.Stderr)))
+	nodeTemplatesRef, err := controllers.ParseNodeTemplatesRef(nodeTemplates)
+	handleError(err, "invalid node templates")
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	handleError(err, "unable to create client")
+
+	objects, err := collectSnapshot(ctrl.SetupSignalHandler(), c, nodeTemplatesRef)
+	handleError(err, "unable to collect snapshot")
+	var anonymizer *snapshot.Anonymizer
+	if anonymize {
+		anonymizer = snapshot.NewAnonymizer()
+	}
+	for _, obj := range objects {
+		snapshot.Sanitize(obj)
+		if anonymizer != nil {
+			anonymizer.Anonymize(obj)
+		}
+	}
+
+	if output == "" {
+		handleError(snapshot.Write(os.Stdout, objects), "unable to write snapshot")
+		return
+	}
+	file, err := os.Create(output)
+	handleError(err, "unable to create snapshot file")
+	handleError(snapshot.Write(file, objects), "unable to write snapshot")
+	handleError(file.Close(), "unable to close snapshot file")
+}
+
+func collectSnapshot(ctx context.Context, c client.Client,
+	nodeTemplatesRef types.NamespacedName) ([]*unstructured.Unstructured, error) {
+
+	kinds := slices.Clone(snapshotKinds)
+	for _, kind := range customKinds {
+		kinds = append(kinds, kind.GroupVersionKind)
+	}
+	objects := make([]*unstructured.Unstructured, 0)
+	for _, gvk := range kinds {
+		var list unstructured.UnstructuredList
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		err := c.List(ctx, &list)
+		if meta.IsNoMatchError(err) {
+			setupLog.Info("skipping kind not served by the api server", "kind", gvk.String())
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", gvk.Kind, err)
+		}
+		for i := range list.Items {
+			objects = append(objects, &list.Items[i])
+		}
+	}
+	if nodeTemplatesRef.Name == "" {
+		return objects, nil
+	}
+	var templates unstructured.Unstructured
+	templates.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ConfigMap"))
+	err := c.Get(ctx, nodeTemplatesRef, &templates)
+	if apierrors.IsNotFound(err) {
+		return objects, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch node templates: %w", err)
+	}
+	return append(objects, &templates), nil
+}
@@ -17,6 +17,7 @@ const (
 
 var (
 	VpaUpdateMode         = vpav1.UpdateModeOff
+	VpaBatchUpdateMode    = vpav1.UpdateModeInitial
 	VpaControlledValues   = vpav1.ContainerControlledValuesRequestsOnly
 	SupportedUpdatedModes = []string{
 		string(vpav1.UpdateModeOff),
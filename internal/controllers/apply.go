@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/util/csaupgrade"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// FieldManagerController owns the fields of served vpas configured by the VpaController.
+	FieldManagerController = "vpa-butler-controller"
+	// FieldManagerCapacity owns the container policies of served vpas once
+	// the VpaRunnable set their maximum allowed resources.
+	FieldManagerCapacity = "vpa-butler-capacity"
+	// legacyFieldManager is derived by the api server from the user agent of
+	// former versions, which created and patched served vpas without field manager.
+	legacyFieldManager = "vpa_butler"
+	// unknownFieldManager owns the fields of objects without managed fields on their first apply.
+	unknownFieldManager = "before-first-apply"
+
+	reasonFieldManagerConflict = "FieldManagerConflict"
+)
+
+var conflictManagerPattern = regexp.MustCompile(`conflict with "([^"]*)"`)
+
+// isButlerFieldManager returns true, if the field manager belongs to the vpa_butler.
+func isButlerFieldManager(manager string) bool {
+	switch manager {
+	case FieldManagerController, FieldManagerCapacity, legacyFieldManager, unknownFieldManager:
+		return true
+	}
+	return false
+}
+
+// FieldManagerConflictError is returned, when fields of a served vpa
+// to be applied are owned by field managers other than the vpa_butler.
+type FieldManagerConflictError struct {
+	Managers []string
+	err      error
+}
+
+func (e *FieldManagerConflictError) Error() string {
+	return fmt.Sprintf("fields are owned by %s: %s", strings.Join(e.Managers, ","), e.err)
+}
+
+func (e *FieldManagerConflictError) Unwrap() error {
+	return e.err
+}
+
+// applyVpa applies the fields set on the vpa with server-side apply as the field manager.
+// Fields not set are released by the field manager and removed, if no other manager owns them.
+// Conflicts with the other field manager of the vpa_butler are resolved by forcing the ownership,
+// while conflicts with other managers, e.g. kubectl edit, are returned as FieldManagerConflictError.
+// Both managers of the vpa_butler apply the atomic container policies as a whole, composed from the
+// vpa they read. Its resource version guards the apply, so forcing never discards the fields the other
+// manager changed meanwhile. Instead, the conflict is returned and retried on the live vpa.
+func applyVpa(ctx context.Context, c client.Client, vpa *vpav1.VerticalPodAutoscaler, fieldManager string) error {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vpa)
+	if err != nil {
+		return fmt.Errorf("failed to convert vpa %s/%s: %w", vpa.Namespace, vpa.Name, err)
+	}
+	obj := &unstructured.Unstructured{Object: content}
+	obj.SetGroupVersionKind(vpav1.SchemeGroupVersion.WithKind("VerticalPodAutoscaler"))
+	unstructured.RemoveNestedField(obj.Object, "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(obj.Object, "status")
+	pruneNulls(obj.Object)
+
+	err = c.Apply(ctx, client.ApplyConfigurationFromUnstructured(obj), client.FieldOwner(fieldManager))
+	if !apierrors.IsConflict(err) {
+		return err
+	}
+	managers := conflictingManagers(err)
+	if len(managers) == 0 {
+		// the vpa changed since it was read
+		return err
+	}
+	if foreign := slices.DeleteFunc(slices.Clone(managers), isButlerFieldManager); len(foreign) > 0 {
+		return &FieldManagerConflictError{Managers: foreign, err: err}
+	}
+	return c.Apply(ctx, client.ApplyConfigurationFromUnstructured(obj), client.FieldOwner(fieldManager),
+		client.ForceOwnership)
+}
+
+// conflictingManagers returns the field managers named by the causes of an apply conflict.
+func conflictingManagers(err error) []string {
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) || status.Status().Details == nil {
+		return nil
+	}
+	managers := make([]string, 0)
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type != metav1.CauseTypeFieldManagerConflict {
+			continue
+		}
+		if match := conflictManagerPattern.FindStringSubmatch(cause.Message); match != nil {
+			managers = append(managers, match[1])
+		}
+	}
+	slices.Sort(managers)
+	return slices.Compact(managers)
+}
+
+// pruneNulls removes fields without value, which would otherwise be applied as null.
+func pruneNulls(content map[string]any) {
+	for key, value := range content {
+		switch typed := value.(type) {
+		case nil:
+			delete(content, key)
+		case map[string]any:
+			pruneNulls(typed)
+		case []any:
+			for _, item := range typed {
+				if fields, ok := item.(map[string]any); ok {
+					pruneNulls(fields)
+				}
+			}
+		}
+	}
+}
+
+// upgradeManagedFields transfers the fields owned by the creation of the GenericController,
+// the patches of former versions or nobody to the field manager of the VpaController,
+// so fields no longer applied are removed instead of being kept by the previous owner.
+func upgradeManagedFields(ctx context.Context, c client.Client, vpa *vpav1.VerticalPodAutoscaler) error {
+	patch, err := csaupgrade.UpgradeManagedFieldsPatch(vpa,
+		sets.New(legacyFieldManager, unknownFieldManager, FieldManagerController), FieldManagerController)
+	if err != nil {
+		return fmt.Errorf("failed to upgrade managed fields of vpa %s/%s: %w", vpa.Namespace, vpa.Name, err)
+	}
+	if patch == nil {
+		return nil
+	}
+	return c.Patch(ctx, vpa, client.RawPatch(types.JSONPatchType, patch))
+}
@@ -7,8 +7,29 @@ const (
 	DaemonSetStr   string = "DaemonSet"
 	StatefulSetStr string = "StatefulSet"
 	DeploymentStr  string = "Deployment"
+	CronJobStr     string = "CronJob"
+	JobStr         string = "Job"
 
 	MainContainerAnnotationKey    string = "vpa-butler.cloud.sap/main-container"
 	UpdateModeAnnotationKey       string = "vpa-butler.cloud.sap/update-mode"
 	ControlledValuesAnnotationKey string = "vpa-butler.cloud.sap/controlled-values"
+	// ContainerWeightsAnnotationKey weights the containers when distributing the maximum allowed resources.
+	ContainerWeightsAnnotationKey string = "vpa-butler.cloud.sap/container-weights"
+	// DistributionModeAnnotationKey overrides the default distribution mode of the maximum allowed resources.
+	DistributionModeAnnotationKey string = "vpa-butler.cloud.sap/distribution-mode"
+	// ReferenceNodeAnnotationKey overrides the default strategy selecting the reference node.
+	ReferenceNodeAnnotationKey string = "vpa-butler.cloud.sap/reference-node"
+	// ReferenceNodePercentileAnnotationKey overrides the default percentile of the reference node.
+	ReferenceNodePercentileAnnotationKey string = "vpa-butler.cloud.sap/reference-node-percentile"
+	// ArchitecturesAnnotationKey lists the architectures the images of a workload are built for
+	// separated by commas, which overrides the platforms of the images for the Platform filter.
+	ArchitecturesAnnotationKey string = "vpa-butler.cloud.sap/architectures"
+	// EnabledAnnotationKey opts a workload or namespace out of the vpa_butler, when set to "false".
+	EnabledAnnotationKey string = "vpa-butler.cloud.sap/enabled"
+
+	// PolicyAnnotationKey is set on served vpas to the name of the applied ButlerPolicy.
+	PolicyAnnotationKey string = "vpa-butler.cloud.sap/policy"
+	// NodeTemplateAnnotationKey is set on served vpas to the names of the node
+	// templates, which bound the maximum allowed resources.
+	NodeTemplateAnnotationKey string = "vpa-butler.cloud.sap/node-template"
 )
@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/sapcc/vpa_butler/internal/common"
+)
+
+const (
+	reasonInvalidContainerWeights = "InvalidContainerWeights"
+	// maxContainerWeight keeps the weights within a readable range.
+	maxContainerWeight int64 = 1000
+)
+
+// containerWeight is the relative share of a container on the cpu and memory of the node.
+type containerWeight struct {
+	cpu    int64
+	memory int64
+}
+
+// parseContainerWeights parses weights formatted as <container>=<weight> or
+// <container>=<cpu weight>:<memory weight> separated by commas, e.g. app=6,envoy=1:2.
+// Containers and native sidecars of the pod without a weight default to 1.
+func parseContainerWeights(value string, spec corev1.PodSpec) (map[string]containerWeight, error) {
+	weights := make(map[string]containerWeight)
+	for _, name := range podContainerNames(spec) {
+		weights[name] = containerWeight{cpu: 1, memory: 1}
+	}
+	seen := make(map[string]bool)
+	for entry := range strings.SplitSeq(value, ",") {
+		name, raw, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q is not formatted as <container>=<weight>", entry)
+		}
+		if _, ok := weights[name]; !ok {
+			return nil, fmt.Errorf("container %q is not part of the pod", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("container %q is weighted more than once", name)
+		}
+		seen[name] = true
+		cpuRaw, memRaw, split := strings.Cut(raw, ":")
+		if !split {
+			memRaw = cpuRaw
+		}
+		cpu, err := parseWeight(cpuRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu weight of container %q: %w", name, err)
+		}
+		mem, err := parseWeight(memRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory weight of container %q: %w", name, err)
+		}
+		weights[name] = containerWeight{cpu: cpu, memory: mem}
+	}
+	return weights, nil
+}
+
+func parseWeight(raw string) (int64, error) {
+	weight, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if weight < 1 || weight > maxContainerWeight {
+		return 0, errors.New("weight must be between 1 and " + strconv.FormatInt(maxContainerWeight, 10))
+	}
+	return weight, nil
+}
+
+// podContainerNames returns the names of the regular containers and native sidecars of the pod.
+func podContainerNames(spec corev1.PodSpec) []string {
+	names := make([]string, 0, podUnits(spec))
+	for _, container := range spec.Containers {
+		names = append(names, container.Name)
+	}
+	for _, container := range spec.InitContainers {
+		if isSidecar(container) {
+			names = append(names, container.Name)
+		}
+	}
+	return names
+}
+
+// weightedDistribution distributes the capacity across all containers proportional to their weights.
+func weightedDistribution(weights map[string]containerWeight) maxResourceDistributionFunc {
+	return func(params resourceDistributionParams) []common.NamedResourceList {
+		return proportionalDistribution(params, weights)
+	}
+}
+
+// proportionalDistribution distributes the capacity across the containers and native
+// sidecars of the pod proportional to the given weights, which must cover all of them.
+func proportionalDistribution(params resourceDistributionParams,
+	weights map[string]containerWeight) []common.NamedResourceList {
+
+	names := podContainerNames(params.target.PodSpec)
+	var cpuTotal, memTotal int64
+	for _, name := range names {
+		cpuTotal += weights[name].cpu
+		memTotal += weights[name].memory
+	}
+	budget := scaleResources(params.allocatable, params.capacityPercent)
+	cpu, mem := budget.Cpu(), budget.Memory()
+	namedResources := make([]common.NamedResourceList, len(names))
+	for i, name := range names {
+		cpuShare := proportion(cpu.MilliValue(), weights[name].cpu, cpuTotal)
+		memShare := proportion(mem.Value(), weights[name].memory, memTotal)
+		namedResources[i] = common.NamedResourceList{
+			ContainerName: name,
+			Resources: corev1.ResourceList{
+				corev1.ResourceCPU:    *resource.NewMilliQuantity(cpuShare, cpu.Format),
+				corev1.ResourceMemory: *resource.NewQuantity(memShare, mem.Format),
+			},
+		}
+	}
+	return limitSidecars(params, namedResources)
+}
+
+// proportion returns value*part/whole without overflowing the intermediate product.
+func proportion(value, part, whole int64) int64 {
+	var result big.Int
+	result.Mul(big.NewInt(value), big.NewInt(part))
+	result.Quo(&result, big.NewInt(whole))
+	return result.Int64()
+}
@@ -0,0 +1,159 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultPodTemplatePath = "{.spec.template}"
+	defaultSelectorPath    = "{.spec.selector}"
+)
+
+// CustomKind describes a workload kind outside of apps/v1, which exposes
+// a /scale subresource and embeds a pod template. Such workloads are
+// watched as unstructured objects.
+type CustomKind struct {
+	schema.GroupVersionKind
+	// PodTemplatePath is a JSONPath pointing to the pod template of the workload.
+	PodTemplatePath string
+	// SelectorPath is a JSONPath pointing to the label selector of the workload.
+	SelectorPath string
+}
+
+// ParseCustomKind parses a custom kind from the format
+// <group>/<version>/<kind>[;<pod template path>;<selector path>].
+// The paths default to {.spec.template} and {.spec.selector}.
+func ParseCustomKind(s string) (CustomKind, error) {
+	parts := strings.Split(s, ";")
+	if len(parts) != 1 && len(parts) != 3 {
+		return CustomKind{}, fmt.Errorf("custom kind %q must either specify no or both paths", s)
+	}
+	gvk := strings.Split(parts[0], "/")
+	if len(gvk) != 3 || gvk[0] == "" || gvk[1] == "" || gvk[2] == "" {
+		return CustomKind{}, fmt.Errorf("custom kind %q must be formatted as <group>/<version>/<kind>", s)
+	}
+	kind := CustomKind{
+		GroupVersionKind: schema.GroupVersionKind{Group: gvk[0], Version: gvk[1], Kind: gvk[2]},
+		PodTemplatePath:  defaultPodTemplatePath,
+		SelectorPath:     defaultSelectorPath,
+	}
+	if len(parts) == 3 {
+		kind.PodTemplatePath = relaxedPath(parts[1])
+		kind.SelectorPath = relaxedPath(parts[2])
+	}
+	for _, path := range []string{kind.PodTemplatePath, kind.SelectorPath} {
+		if err := jsonpath.New(kind.Kind).Parse(path); err != nil {
+			return CustomKind{}, fmt.Errorf("invalid path %q for custom kind %q: %w", path, s, err)
+		}
+	}
+	return kind, nil
+}
+
+// relaxedPath allows omitting the curly braces of a JSONPath.
+func relaxedPath(path string) string {
+	if strings.HasPrefix(path, "{") {
+		return path
+	}
+	return "{" + path + "}"
+}
+
+// newObject returns an empty unstructured object of the custom kind.
+func (k CustomKind) newObject() *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(k.GroupVersionKind)
+	return obj
+}
+
+func (k CustomKind) get(ctx context.Context, c client.Reader, key types.NamespacedName) (*unstructured.Unstructured, error) {
+	obj := k.newObject()
+	if err := c.Get(ctx, key, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (k CustomKind) matches(ref *autoscalingv1.CrossVersionObjectReference) bool {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return false
+	}
+	return ref.Kind == k.Kind && gv.Group == k.Group
+}
+
+func (k CustomKind) podTemplate(obj *unstructured.Unstructured) (corev1.PodTemplateSpec, error) {
+	var template corev1.PodTemplateSpec
+	err := extractPath(obj, k.PodTemplatePath, &template)
+	return template, err
+}
+
+func (k CustomKind) selector(obj *unstructured.Unstructured) (metav1.LabelSelector, error) {
+	var selector metav1.LabelSelector
+	err := extractPath(obj, k.SelectorPath, &selector)
+	return selector, err
+}
+
+// replicas returns the replicas of the scale subresource, which
+// is expected to be located at .spec.replicas.
+func (k CustomKind) replicas(obj *unstructured.Unstructured) *int32 {
+	replicas, found, err := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !found || err != nil {
+		return nil
+	}
+	result := int32(replicas) //nolint:gosec // replicas fit into an int32
+	return &result
+}
+
+func extractPath(obj *unstructured.Unstructured, path string, into any) error {
+	parser := jsonpath.New(obj.GetKind())
+	if err := parser.Parse(path); err != nil {
+		return err
+	}
+	results, err := parser.FindResults(obj.Object)
+	if err != nil {
+		return fmt.Errorf("failed to find %s in %s %s/%s: %w", path, obj.GetKind(), obj.GetNamespace(), obj.GetName(), err)
+	}
+	if len(results) == 0 || len(results[0]) == 0 {
+		return fmt.Errorf("path %s not found in %s %s/%s", path, obj.GetKind(), obj.GetNamespace(), obj.GetName())
+	}
+	value, ok := results[0][0].Interface().(map[string]any)
+	if !ok {
+		return fmt.Errorf("path %s in %s %s/%s is not an object", path, obj.GetKind(), obj.GetNamespace(), obj.GetName())
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(value, into)
+}
+
+func findCustomKind(kinds []CustomKind, ref *autoscalingv1.CrossVersionObjectReference) (CustomKind, bool) {
+	for _, kind := range kinds {
+		if kind.matches(ref) {
+			return kind, true
+		}
+	}
+	return CustomKind{}, false
+}
+
+// objectMeta copies the metadata relevant to the vpa_butler from an unstructured object.
+func objectMeta(obj *unstructured.Unstructured) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:            obj.GetName(),
+		Namespace:       obj.GetNamespace(),
+		UID:             obj.GetUID(),
+		Labels:          obj.GetLabels(),
+		Annotations:     obj.GetAnnotations(),
+		OwnerReferences: obj.GetOwnerReferences(),
+	}
+}
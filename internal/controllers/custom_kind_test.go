@@ -0,0 +1,42 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/sapcc/vpa_butler/internal/controllers"
+)
+
+var _ = Describe("ParseCustomKind", func() {
+
+	It("defaults the pod template and selector paths", func() {
+		kind, err := controllers.ParseCustomKind("argoproj.io/v1alpha1/Rollout")
+		Expect(err).To(Succeed())
+		Expect(kind.Group).To(Equal("argoproj.io"))
+		Expect(kind.Version).To(Equal("v1alpha1"))
+		Expect(kind.Kind).To(Equal("Rollout"))
+		Expect(kind.PodTemplatePath).To(Equal("{.spec.template}"))
+		Expect(kind.SelectorPath).To(Equal("{.spec.selector}"))
+	})
+
+	It("parses custom paths with and without braces", func() {
+		kind, err := controllers.ParseCustomKind("apps.kruise.io/v1alpha1/CloneSet;.spec.podTemplate;{.spec.labelSelector}")
+		Expect(err).To(Succeed())
+		Expect(kind.PodTemplatePath).To(Equal("{.spec.podTemplate}"))
+		Expect(kind.SelectorPath).To(Equal("{.spec.labelSelector}"))
+	})
+
+	It("fails if only one path is given", func() {
+		_, err := controllers.ParseCustomKind("apps.kruise.io/v1alpha1/CloneSet;.spec.template")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails if the group is missing", func() {
+		_, err := controllers.ParseCustomKind("v1alpha1/CloneSet")
+		Expect(err).To(HaveOccurred())
+	})
+
+})
@@ -0,0 +1,163 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	resourcehelper "k8s.io/component-helpers/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/sapcc/vpa_butler/internal/filter"
+)
+
+// overheadCache holds the overhead of DaemonSets on the schedulable nodes. It is computed once per
+// change to DaemonSets, nodes or node templates, which invalidates it, instead of once per served vpa.
+type overheadCache struct {
+	mu sync.Mutex
+	// generation is increased by each invalidation, so an overhead computed meanwhile is not kept
+	generation uint64
+	overhead   *daemonSetOverhead
+}
+
+type daemonSetOverhead struct {
+	// perNode sums the requests of all DaemonSet pods landing on a node
+	perNode map[string]corev1.ResourceList
+	// daemonSets holds the requests of each DaemonSet pod and the nodes they land on
+	daemonSets map[types.NamespacedName]daemonSetPlacement
+}
+
+type daemonSetPlacement struct {
+	requests corev1.ResourceList
+	nodes    []string
+}
+
+func (c *overheadCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.overhead = nil
+}
+
+// daemonSetOverhead returns the cached overhead of DaemonSets or computes it on the schedulable nodes.
+func (v *VpaRunnable) daemonSetOverhead(ctx context.Context) (*daemonSetOverhead, error) {
+	v.overhead.mu.Lock()
+	overhead, generation := v.overhead.overhead, v.overhead.generation
+	v.overhead.mu.Unlock()
+	if overhead != nil {
+		return overhead, nil
+	}
+	nodes, err := v.schedulableNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var daemonSets appsv1.DaemonSetList
+	// the daemonsets are only read, so copying them from the cache is not required
+	if err := v.List(ctx, &daemonSets, client.UnsafeDisableDeepCopy); err != nil {
+		return nil, fmt.Errorf("failed to list daemonsets to determine their overhead: %w", err)
+	}
+	overhead = &daemonSetOverhead{
+		perNode:    make(map[string]corev1.ResourceList, len(nodes)),
+		daemonSets: make(map[types.NamespacedName]daemonSetPlacement, len(daemonSets.Items)),
+	}
+	for i := range daemonSets.Items {
+		ds := &daemonSets.Items[i]
+		landing, err := daemonSetNodes(ds, nodes)
+		if err != nil {
+			return nil, err
+		}
+		placement := daemonSetPlacement{requests: podRequests(ds.Spec.Template.Spec)}
+		for _, node := range landing {
+			overhead.perNode[node.Name] = addResources(overhead.perNode[node.Name], placement.requests)
+			placement.nodes = append(placement.nodes, node.Name)
+		}
+		overhead.daemonSets[client.ObjectKeyFromObject(ds)] = placement
+	}
+	v.overhead.mu.Lock()
+	defer v.overhead.mu.Unlock()
+	if v.overhead.generation == generation {
+		v.overhead.overhead = overhead
+	}
+	return overhead, nil
+}
+
+// subtractDaemonSetOverhead returns copies of the nodes, whose allocatable resources are reduced
+// by the requests of all DaemonSet pods landing on them. The DaemonSet targeted by the vpa itself
+// is not considered. Nodes without remaining cpu or memory are dropped.
+func (v *VpaRunnable) subtractDaemonSetOverhead(ctx context.Context, target filter.TargetedVpa,
+	nodes []corev1.Node) ([]corev1.Node, error) {
+
+	overhead, err := v.daemonSetOverhead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var own daemonSetPlacement
+	if target.Type == filter.TargetDaemonSet {
+		own = overhead.daemonSets[types.NamespacedName{Namespace: target.ObjectMeta.Namespace, Name: target.ObjectMeta.Name}]
+	}
+	result := make([]corev1.Node, 0, len(nodes))
+	for _, node := range nodes {
+		nodeOverhead := overhead.perNode[node.Name]
+		if slices.Contains(own.nodes, node.Name) {
+			nodeOverhead = subtractResources(nodeOverhead, own.requests)
+		}
+		allocatable := subtractResources(node.Status.Allocatable, nodeOverhead)
+		if allocatable.Cpu().Sign() <= 0 || allocatable.Memory().Sign() <= 0 {
+			v.Log.Info("node has no capacity left after subtracting daemonset overhead", "node", node.Name)
+			continue
+		}
+		// node is a shallow copy, so replacing the allocatable resources does not modify the cache
+		node.Status.Allocatable = allocatable
+		result = append(result, node)
+	}
+	return result, nil
+}
+
+// daemonSetNodes returns the nodes pods of the DaemonSet can be placed on.
+func daemonSetNodes(ds *appsv1.DaemonSet, nodes []corev1.Node) ([]corev1.Node, error) {
+	landing, err := filter.Evaluate(filter.TargetedVpa{
+		Type:       filter.TargetDaemonSet,
+		PodSpec:    ds.Spec.Template.Spec,
+		ObjectMeta: ds.ObjectMeta,
+	}, nodes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine nodes of daemonset %s/%s: %w", ds.Namespace, ds.Name, err)
+	}
+	return landing, nil
+}
+
+// podRequests returns the effective requests of a pod created from the given spec.
+func podRequests(spec corev1.PodSpec) corev1.ResourceList {
+	return resourcehelper.PodRequests(&corev1.Pod{Spec: spec}, resourcehelper.PodResourcesOptions{})
+}
+
+func addResources(sum, add corev1.ResourceList) corev1.ResourceList {
+	if sum == nil {
+		sum = make(corev1.ResourceList, len(add))
+	}
+	for name, quantity := range add {
+		current := sum[name]
+		current.Add(quantity)
+		sum[name] = current
+	}
+	return sum
+}
+
+// subtractResources returns a copy of from reduced by the resources it shares with sub.
+func subtractResources(from, sub corev1.ResourceList) corev1.ResourceList {
+	result := from.DeepCopy()
+	for name, quantity := range sub {
+		if remaining, ok := result[name]; ok {
+			remaining.Sub(quantity)
+			result[name] = remaining
+		}
+	}
+	return result
+}
@@ -0,0 +1,143 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sapcc/vpa_butler/internal/common"
+	"github.com/sapcc/vpa_butler/internal/filter"
+	"github.com/sapcc/vpa_butler/internal/policy"
+)
+
+// maxAllowedDecision describes how the maximum allowed resources of a served vpa are derived.
+type maxAllowedDecision struct {
+	// steps are the nodes removed by each node filter
+	steps []filter.Step
+	// viable are the nodes kept by all node filters
+	viable []corev1.Node
+	// exhausted are the viable nodes without capacity left after subtracting the daemonset overhead
+	exhausted       []string
+	reference       reference
+	budget          corev1.ResourceList
+	capacityPercent int64
+	distribution    string
+	namedResources  []common.NamedResourceList
+	// skipped explains why no maximum allowed resources are derived
+	skipped *warning
+	// warnings are invalid annotations, which got ignored
+	warnings []warning
+}
+
+// warning is reported as an event on the served vpa and its workload.
+type warning struct {
+	reason string
+	action string
+	note   string
+}
+
+func (d *maxAllowedDecision) warn(reason, action, format string, args ...any) {
+	d.warnings = append(d.warnings, warning{reason: reason, action: action, note: fmt.Sprintf(format, args...)})
+}
+
+func (d *maxAllowedDecision) skip(reason, note string) {
+	d.skipped = &warning{reason: reason, action: "UpdateMaxAllowed", note: note}
+}
+
+// decide derives the maximum allowed resources of the target from the schedulable nodes
+// without modifying anything, so it also serves explaining the decision.
+func (v *VpaRunnable) decide(ctx context.Context, target filter.TargetedVpa,
+	schedulable []corev1.Node) (*maxAllowedDecision, error) {
+
+	var decision maxAllowedDecision
+	v.resolvePlatforms(&target)
+	viable, steps, err := v.chain.Load().Evaluate(target, schedulable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine valid nodes: %w", err)
+	}
+	decision.steps = steps
+	decision.viable = viable
+	withCapacity, err := v.subtractDaemonSetOverhead(ctx, target, viable)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range viable {
+		if !slices.ContainsFunc(withCapacity, func(n corev1.Node) bool { return n.Name == node.Name }) {
+			decision.exhausted = append(decision.exhausted, node.Name)
+		}
+	}
+	if len(withCapacity) == 0 {
+		decision.skip(reasonNoValidNodes, "no valid nodes for vpa target found")
+		return &decision, nil
+	}
+	decision.capacityPercent = v.CapacityPercent
+	butlerPolicy, err := policy.Find(ctx, v, target.Vpa.Spec.TargetRef.Kind, &target.ObjectMeta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find butler policy: %w", err)
+	}
+	if butlerPolicy != nil && butlerPolicy.Spec.CapacityPercent != nil {
+		decision.capacityPercent = *butlerPolicy.Spec.CapacityPercent
+	}
+	annotations, err := effectiveAnnotations(ctx, v, &target.ObjectMeta)
+	if err != nil {
+		return nil, err
+	}
+	distributionFunc := v.selectDistribution(target, annotations, &decision)
+	decision.reference = selectReference(withCapacity, v.referenceNodeParams(target, annotations, &decision))
+	decision.budget = podBudget(decision.reference.allocatable, target.PodSpec)
+	if decision.budget.Cpu().Sign() <= 0 || decision.budget.Memory().Sign() <= 0 {
+		decision.skip(reasonPodOverheadExceeded, "pod overhead exceeds the capacity of the reference node")
+		return &decision, nil
+	}
+	decision.namedResources = distributionFunc(resourceDistributionParams{
+		target:          target,
+		allocatable:     decision.budget,
+		capacityPercent: decision.capacityPercent,
+	})
+	return &decision, nil
+}
+
+// selectDistribution returns how the capacity is distributed across the containers of the target.
+// Container weights take precedence over the main container annotation,
+// which takes precedence over the distribution mode.
+func (v *VpaRunnable) selectDistribution(target filter.TargetedVpa, annotations map[string]string,
+	decision *maxAllowedDecision) maxResourceDistributionFunc {
+
+	if value, ok := annotations[ContainerWeightsAnnotationKey]; ok {
+		weights, err := parseContainerWeights(value, target.PodSpec)
+		if err == nil {
+			decision.distribution = "ContainerWeights(" + value + ")"
+			return weightedDistribution(weights)
+		}
+		decision.warn(reasonInvalidContainerWeights, "DistributeMaxAllowed",
+			"Ignoring invalid container weights %q: %s", value, err.Error())
+	}
+	if podUnits(target.PodSpec) > 1 {
+		if mainContainer, ok := annotations[MainContainerAnnotationKey]; ok {
+			decision.distribution = "MainContainer(" + mainContainer + ")"
+			return asymmetricDistribution(mainContainer)
+		}
+	}
+	mode := v.DistributionMode
+	if value, ok := annotations[DistributionModeAnnotationKey]; ok {
+		if slices.Contains(SupportedDistributionModes, value) {
+			mode = DistributionMode(value)
+		} else {
+			decision.warn(reasonInvalidDistributionMode, "DistributeMaxAllowed",
+				"Ignoring invalid distribution mode %q, must be one of: %s",
+				value, strings.Join(SupportedDistributionModes, ","))
+		}
+	}
+	if mode == DistributionRecommendation {
+		decision.distribution = string(DistributionRecommendation)
+		return recommendationDistribution
+	}
+	decision.distribution = string(DistributionUniform)
+	return uniformDistribution
+}
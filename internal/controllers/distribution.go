@@ -0,0 +1,201 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/sapcc/vpa_butler/internal/common"
+	"github.com/sapcc/vpa_butler/internal/filter"
+)
+
+func scaleQuantityMilli(q *resource.Quantity, percent int64) *resource.Quantity {
+	return resource.NewMilliQuantity(q.MilliValue()*percent/scaleDivisor, q.Format)
+}
+
+func scaleQuantity(q *resource.Quantity, percent int64) *resource.Quantity {
+	return resource.NewQuantity(q.Value()*percent/scaleDivisor, q.Format)
+}
+
+// scaleResources returns the given percentage of the cpu and memory of resources.
+func scaleResources(resources corev1.ResourceList, percent int64) corev1.ResourceList {
+	return corev1.ResourceList{
+		corev1.ResourceCPU:    *scaleQuantityMilli(resources.Cpu(), percent),
+		corev1.ResourceMemory: *scaleQuantity(resources.Memory(), percent),
+	}
+}
+
+// divideResources splits the cpu and memory of resources into count equal parts, which are never negative.
+func divideResources(resources corev1.ResourceList, count int64) corev1.ResourceList {
+	cpu, mem := resources.Cpu(), resources.Memory()
+	return corev1.ResourceList{
+		corev1.ResourceCPU:    *resource.NewMilliQuantity(max(cpu.MilliValue()/count, 0), cpu.Format),
+		corev1.ResourceMemory: *resource.NewQuantity(max(mem.Value()/count, 0), mem.Format),
+	}
+}
+
+// minResources returns the smaller cpu and memory of a and b.
+func minResources(a, b corev1.ResourceList) corev1.ResourceList {
+	result := a.DeepCopy()
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		if quantity, ok := b[name]; ok && quantity.Cmp(result[name]) < 0 {
+			result[name] = quantity
+		}
+	}
+	return result
+}
+
+// isSidecar returns whether the init container is a native sidecar,
+// which keeps running alongside the regular containers of the pod.
+func isSidecar(container corev1.Container) bool {
+	return container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways
+}
+
+// podUnits returns the amount of containers sharing the node at the same time,
+// which are the regular containers and the native sidecars.
+func podUnits(spec corev1.PodSpec) int64 {
+	units := int64(len(spec.Containers))
+	for _, container := range spec.InitContainers {
+		if isSidecar(container) {
+			units++
+		}
+	}
+	return units
+}
+
+// podBudget returns the allocatable resources of a node available to the containers
+// of a pod, which is reduced by the pod overhead of its RuntimeClass.
+func podBudget(allocatable corev1.ResourceList, spec corev1.PodSpec) corev1.ResourceList {
+	return subtractResources(allocatable, spec.Overhead)
+}
+
+// DistributionMode decides how the capacity is distributed across the containers of a
+// pod, unless the workload is annotated with container weights or a main container.
+type DistributionMode string
+
+const (
+	// DistributionUniform distributes the capacity evenly across the containers.
+	DistributionUniform DistributionMode = "Uniform"
+	// DistributionRecommendation distributes the capacity proportional to the
+	// uncapped target recommendations of the containers.
+	DistributionRecommendation DistributionMode = "Recommendation"
+
+	reasonInvalidDistributionMode = "InvalidDistributionMode"
+)
+
+var SupportedDistributionModes = []string{
+	string(DistributionUniform),
+	string(DistributionRecommendation),
+}
+
+type resourceDistributionParams struct {
+	target filter.TargetedVpa
+	// resources of the reference node available to the containers of a pod
+	allocatable     corev1.ResourceList
+	capacityPercent int64
+}
+
+type maxResourceDistributionFunc func(params resourceDistributionParams) []common.NamedResourceList
+
+func uniformDistribution(params resourceDistributionParams) []common.NamedResourceList {
+	units := podUnits(params.target.PodSpec)
+	// distribute a fraction of maximum capacity evenly across containers
+	share := scaleResources(params.allocatable, params.capacityPercent/units)
+	namedResources := sidecarResources(params.target.PodSpec, share, "")
+	namedResources = append(namedResources, common.NamedResourceList{
+		ContainerName: "*",
+		Resources:     share,
+	})
+	return limitSidecars(params, namedResources)
+}
+
+func asymmetricDistribution(mainContainer string) maxResourceDistributionFunc {
+	return func(params resourceDistributionParams) []common.NamedResourceList {
+		totalFraction, mainFraction := int64(4), int64(3)
+		units := podUnits(params.target.PodSpec)
+		totalWeight := totalFraction * (units - 1)
+		mainWeight := mainFraction * (units - 1)
+		other := scaleResources(params.allocatable, params.capacityPercent/totalWeight)
+		namedResources := []common.NamedResourceList{{
+			ContainerName: mainContainer,
+			Resources:     scaleResources(params.allocatable, params.capacityPercent*mainWeight/totalWeight),
+		}}
+		namedResources = append(namedResources, sidecarResources(params.target.PodSpec, other, mainContainer)...)
+		namedResources = append(namedResources, common.NamedResourceList{
+			ContainerName: "*",
+			Resources:     other,
+		})
+		return limitSidecars(params, namedResources)
+	}
+}
+
+// sidecarResources bounds each native sidecar, except for the skipped one, to the given share.
+func sidecarResources(spec corev1.PodSpec, share corev1.ResourceList, skip string) []common.NamedResourceList {
+	var sidecars []common.NamedResourceList
+	for _, container := range spec.InitContainers {
+		if isSidecar(container) && container.Name != skip {
+			sidecars = append(sidecars, common.NamedResourceList{
+				ContainerName: container.Name,
+				Resources:     share,
+			})
+		}
+	}
+	return sidecars
+}
+
+// limitSidecars limits the shares of the native sidecars within the named resources. Sidecars
+// started before a regular init container run alongside it, so their shares may not exceed
+// what is left over by the requests of that init container.
+func limitSidecars(params resourceDistributionParams,
+	namedResources []common.NamedResourceList) []common.NamedResourceList {
+
+	budget := scaleResources(params.allocatable, params.capacityPercent)
+	var started []string
+	for _, container := range params.target.PodSpec.InitContainers {
+		if isSidecar(container) {
+			started = append(started, container.Name)
+			continue
+		}
+		if len(started) == 0 {
+			continue
+		}
+		available := subtractResources(budget, container.Resources.Requests)
+		limit := divideResources(available, int64(len(started)))
+		for i := range namedResources {
+			if slices.Contains(started, namedResources[i].ContainerName) {
+				namedResources[i].Resources = minResources(namedResources[i].Resources, limit)
+			}
+		}
+	}
+	return namedResources
+}
+
+// recommendationDistribution distributes the capacity proportional to the uncapped target
+// recommendations of the containers. As long as any container lacks a recommendation, the
+// capacity is distributed uniformly.
+func recommendationDistribution(params resourceDistributionParams) []common.NamedResourceList {
+	if params.target.Vpa.Status.Recommendation == nil {
+		return uniformDistribution(params)
+	}
+	recommended := make(map[string]corev1.ResourceList)
+	for _, recommendation := range params.target.Vpa.Status.Recommendation.ContainerRecommendations {
+		recommended[recommendation.ContainerName] = recommendation.UncappedTarget
+	}
+	weights := make(map[string]containerWeight)
+	for _, name := range podContainerNames(params.target.PodSpec) {
+		target, ok := recommended[name]
+		if !ok {
+			return uniformDistribution(params)
+		}
+		// tiny containers still need a share to grow into
+		weights[name] = containerWeight{
+			cpu:    max(target.Cpu().MilliValue(), 1),
+			memory: max(target.Memory().Value(), 1),
+		}
+	}
+	return proportionalDistribution(params, weights)
+}
@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/events"
+
+	"github.com/sapcc/vpa_butler/internal/filter"
+)
+
+// Reasons of events emitted on served vpas and their workloads.
+// They are stable, so they can be relied on, e.g. for alerting.
+const (
+	reasonVpaCreated       = "VpaCreated"
+	reasonCustomVpaFound   = "CustomVpaFound"
+	reasonWorkloadExcluded = "WorkloadExcluded"
+	reasonCoveredByCronJob = "CoveredByCronJob"
+	reasonOrphanedVpa      = "OrphanedVpa"
+	reasonOutdatedVpaName  = "OutdatedVpaName"
+)
+
+// recordVpaEvent emits the event on the vpa and on its workload, so it shows
+// up when describing either of them. The workload may be nil, e.g. when it is deleted.
+func recordVpaEvent(recorder events.EventRecorder, vpa *vpav1.VerticalPodAutoscaler, workload runtime.Object,
+	eventtype, reason, action, note string, args ...any) {
+
+	if recorder == nil {
+		return
+	}
+	recorder.Eventf(vpa, workload, eventtype, reason, action, note, args...)
+	if workload != nil {
+		recorder.Eventf(workload, vpa, eventtype, reason, action, note, args...)
+	}
+}
+
+// workloadReference references the workload targeted by the vpa, which is only known by its metadata.
+func workloadReference(target filter.TargetedVpa) runtime.Object {
+	if target.Vpa.Spec.TargetRef == nil {
+		return nil
+	}
+	return &corev1.ObjectReference{
+		APIVersion: target.Vpa.Spec.TargetRef.APIVersion,
+		Kind:       target.Vpa.Spec.TargetRef.Kind,
+		Namespace:  target.Vpa.Namespace,
+		Name:       target.Vpa.Spec.TargetRef.Name,
+		UID:        target.ObjectMeta.UID,
+	}
+}
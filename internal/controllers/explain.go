@@ -0,0 +1,169 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	"github.com/sapcc/vpa_butler/internal/common"
+)
+
+// ExplainPath is the prefix of the endpoint explaining the maximum allowed
+// resources of a served vpa, which is followed by <namespace>/<name>.
+const ExplainPath = "/debug/vpa/"
+
+var errNotServed = errors.New("vpa is not served by the vpa_butler")
+
+// explanation is the JSON representation of a maxAllowedDecision.
+type explanation struct {
+	Vpa    string `json:"vpa"`
+	Target string `json:"target"`
+	// Candidates are the schedulable nodes and node templates
+	Candidates []string          `json:"candidates"`
+	Filters    []explainedFilter `json:"filters"`
+	Viable     []string          `json:"viable"`
+	// Exhausted are viable nodes without capacity left after subtracting the daemonset overhead
+	Exhausted          []string            `json:"exhausted,omitempty"`
+	ReferenceNodes     []string            `json:"referenceNodes,omitempty"`
+	ReferenceTemplates []string            `json:"referenceTemplates,omitempty"`
+	Budget             corev1.ResourceList `json:"budget,omitempty"`
+	CapacityPercent    int64               `json:"capacityPercent,omitempty"`
+	Distribution       string              `json:"distribution,omitempty"`
+	ContainerPolicies  []explainedPolicy   `json:"containerPolicies,omitempty"`
+	CurrentPolicies    []explainedPolicy   `json:"currentContainerPolicies"`
+	Skipped            string              `json:"skipped,omitempty"`
+	Warnings           []string            `json:"warnings,omitempty"`
+}
+
+type explainedFilter struct {
+	Filter  string   `json:"filter"`
+	Removed []string `json:"removed"`
+	Kept    []string `json:"kept"`
+}
+
+type explainedPolicy struct {
+	ContainerName string              `json:"containerName"`
+	MaxAllowed    corev1.ResourceList `json:"maxAllowed,omitempty"`
+}
+
+// ExplainHandler serves how the maximum allowed resources of a served vpa are derived as JSON.
+// Everything is computed on demand from the cache and nothing is modified.
+func (v *VpaRunnable) ExplainHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		namespace, name, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, ExplainPath), "/")
+		if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+			http.Error(w, "expected "+ExplainPath+"<namespace>/<name>", http.StatusBadRequest)
+			return
+		}
+		if v.chain.Load() == nil {
+			http.Error(w, "vpa runnable is not started", http.StatusServiceUnavailable)
+			return
+		}
+		result, err := v.explain(r.Context(), types.NamespacedName{Namespace: namespace, Name: name})
+		switch {
+		case apierrors.IsNotFound(err), errors.Is(err, errNotServed):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			v.Log.Error(err, "failed to write explanation", "namespace", namespace, "name", name)
+		}
+	})
+}
+
+func (v *VpaRunnable) explain(ctx context.Context, key types.NamespacedName) (*explanation, error) {
+	var vpa vpav1.VerticalPodAutoscaler
+	if err := v.Get(ctx, key, &vpa); err != nil {
+		return nil, err
+	}
+	if !common.ManagedByButler(&vpa) {
+		return nil, errNotServed
+	}
+	result := explanation{Vpa: key.String()}
+	if vpa.Spec.ResourcePolicy != nil {
+		for _, policy := range vpa.Spec.ResourcePolicy.ContainerPolicies {
+			result.CurrentPolicies = append(result.CurrentPolicies, explainedPolicy{
+				ContainerName: policy.ContainerName,
+				MaxAllowed:    policy.MaxAllowed,
+			})
+		}
+	}
+	target, err := v.extractTarget(ctx, &vpa)
+	if err != nil {
+		return nil, err
+	}
+	result.Target = fmt.Sprintf("%s/%s", vpa.Spec.TargetRef.Kind, vpa.Spec.TargetRef.Name)
+	schedulable, err := v.schedulableNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	decision, err := v.decide(ctx, target, schedulable)
+	if err != nil {
+		return nil, err
+	}
+	result.Candidates = nodeNames(schedulable)
+	kept := result.Candidates
+	for _, step := range decision.steps {
+		removed := make(map[string]bool, len(step.Removed))
+		for _, name := range step.Removed {
+			removed[name] = true
+		}
+		next := make([]string, 0, len(kept))
+		for _, name := range kept {
+			if !removed[name] {
+				next = append(next, name)
+			}
+		}
+		result.Filters = append(result.Filters, explainedFilter{Filter: step.Filter, Removed: step.Removed, Kept: next})
+		kept = next
+	}
+	result.Viable = nodeNames(decision.viable)
+	result.Exhausted = decision.exhausted
+	result.ReferenceNodes = decision.reference.nodes
+	result.ReferenceTemplates = decision.reference.templates
+	result.Budget = decision.budget
+	result.CapacityPercent = decision.capacityPercent
+	result.Distribution = decision.distribution
+	for _, namedResources := range decision.namedResources {
+		result.ContainerPolicies = append(result.ContainerPolicies, explainedPolicy{
+			ContainerName: namedResources.ContainerName,
+			MaxAllowed:    namedResources.Resources,
+		})
+	}
+	if decision.skipped != nil {
+		result.Skipped = decision.skipped.note
+	}
+	for _, w := range decision.warnings {
+		result.Warnings = append(result.Warnings, w.note)
+	}
+	return &result, nil
+}
+
+func nodeNames(nodes []corev1.Node) []string {
+	names := make([]string, len(nodes))
+	for i, node := range nodes {
+		names[i] = node.Name
+	}
+	return names
+}
@@ -0,0 +1,7 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+// WorkloadChanged exposes whether the VpaRunnable enqueues the served vpa of an updated workload.
+var WorkloadChanged = (*VpaRunnable).workloadChanged
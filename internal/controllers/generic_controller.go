@@ -7,19 +7,32 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"reflect"
 	"strings"
 
 	"github.com/go-logr/logr"
 	appsv1 "k8s.io/api/apps/v1"
 	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/events"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/sapcc/vpa_butler/internal/common"
 )
@@ -36,22 +49,46 @@ type GenericController struct {
 	Log      logr.Logger
 	Scheme   *runtime.Scheme
 	instance client.Object
+	gvk      schema.GroupVersionKind
+	Scope    Scope
+	Recorder events.EventRecorder
 }
 
 func (v *GenericController) SetupWithManager(mgr ctrl.Manager, instance client.Object) error {
-	v.typeName = strings.ToLower(reflect.TypeOf(instance).Elem().Name())
+	if err := v.setInstance(instance, mgr.GetScheme()); err != nil {
+		return err
+	}
 	name := v.typeName + "-controller"
 	v.Client = mgr.GetClient()
 	v.Log = mgr.GetLogger().WithName(name)
-	v.Scheme = mgr.GetScheme()
-	v.instance = instance
+	if v.Recorder == nil {
+		v.Recorder = mgr.GetEventRecorder(name)
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		Named(name).
 		For(instance).
+		Watches(&vpav1.VerticalPodAutoscaler{}, handler.EnqueueRequestsFromMapFunc(v.mapVpaToWorkloads),
+			builder.WithPredicates(vpaTargetChanged())).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(v.mapNamespaceToWorkloads),
+			builder.WithPredicates(namespaceAnnotationsChanged())).
 		WithOptions(controller.Options{MaxConcurrentReconciles: controllerConcurrency}).
 		Complete(v)
 }
 
+// setInstance sets the kind of workloads the controller serves vpas for.
+func (v *GenericController) setInstance(instance client.Object, scheme *runtime.Scheme) error {
+	// unstructured instances carry their kind, typed ones are looked up in the scheme
+	gvk, err := apiutil.GVKForObject(instance, scheme)
+	if err != nil {
+		return fmt.Errorf("failed to determine kind of instance: %w", err)
+	}
+	v.typeName = strings.ToLower(gvk.Kind)
+	v.Scheme = scheme
+	v.instance = instance
+	v.gvk = gvk
+	return nil
+}
+
 func (v *GenericController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	instance, ok := v.instance.DeepCopyObject().(client.Object)
 	if !ok {
@@ -61,12 +98,25 @@ func (v *GenericController) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	excluded, err := v.isExcluded(ctx, instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if excluded {
+		err = v.ensureVpaDeleted(ctx, instance, reasonWorkloadExcluded, "the workload is excluded")
+		return ctrl.Result{}, err
+	}
+	// jobs spawned by a cronjob are covered by the vpa served for the cronjob
+	if controller := metav1.GetControllerOf(instance); controller != nil && controller.Kind == CronJobStr {
+		err = v.ensureVpaDeleted(ctx, instance, reasonCoveredByCronJob, "it is covered by the vpa of its cronjob")
+		return ctrl.Result{}, err
+	}
 	serve, err := v.shouldServeVpa(ctx, instance)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 	if !serve {
-		err = v.ensureVpaDeleted(ctx, instance)
+		err = v.ensureVpaDeleted(ctx, instance, reasonCustomVpaFound, "a hand-crafted vpa is already in place")
 		return ctrl.Result{}, err
 	}
 	v.Log.Info("Serving VPA for", "name", req.Name, "namespace", req.Namespace)
@@ -80,11 +130,24 @@ func (v *GenericController) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		// vpa does not exist so create it
 		// set off here, as the vpa is to be fully configured by the VpaController
 		common.ConfigureVpaBaseline(vpa, instance, vpav1.UpdateModeOff)
-		return ctrl.Result{}, v.Create(ctx, vpa)
+		if err := v.Create(ctx, vpa, client.FieldOwner(FieldManagerController)); err != nil {
+			return ctrl.Result{}, err
+		}
+		recordVpaEvent(v.Recorder, vpa, instance, corev1.EventTypeNormal, reasonVpaCreated, "CreateVpa",
+			"Created served vpa %s", vpa.Name)
 	}
 	return ctrl.Result{}, nil
 }
 
+// isExcluded returns true, if the workload is outside the configured
+// scope or it or its namespace opted out via annotation.
+func (v *GenericController) isExcluded(ctx context.Context, vpaOwner client.Object) (bool, error) {
+	if !v.Scope.Includes(vpaOwner) {
+		return true, nil
+	}
+	return isDisabled(ctx, v, vpaOwner)
+}
+
 func (v *GenericController) shouldServeVpa(ctx context.Context, vpaOwner client.Object) (bool, error) {
 	ownerRefs := []autoscalingv1.CrossVersionObjectReference{{
 		Name:       vpaOwner.GetName(),
@@ -100,23 +163,19 @@ func (v *GenericController) shouldServeVpa(ctx context.Context, vpaOwner client.
 		})
 	}
 
-	var vpas vpav1.VerticalPodAutoscalerList
-	err := v.List(ctx, &vpas, client.InNamespace(vpaOwner.GetNamespace()))
+	vpas, err := listVpasTargeting(ctx, v, vpaOwner.GetNamespace(), ownerRefs)
 	if err != nil {
-		return false, fmt.Errorf("failed to list vpas: %w", err)
+		return false, err
 	}
-	for i := range vpas.Items {
-		vpa := vpas.Items[i]
-		if vpa.Spec.TargetRef == nil || common.ManagedByButler(&vpa) {
+	for i := range vpas {
+		vpa := &vpas[i]
+		if common.ManagedByButler(vpa) {
 			continue
 		}
-		for _, owner := range ownerRefs {
-			// vpa matches the vpa owner
-			if vpa.Spec.TargetRef.Name == owner.Name &&
-				vpa.Spec.TargetRef.Kind == owner.Kind &&
-				vpa.Spec.TargetRef.APIVersion == owner.APIVersion {
-				// there is a hand-crafted vpa targeting a resource the butler cares about
-				// so the served vpa needs to be deleted
+		for j := range ownerRefs {
+			// there is a hand-crafted vpa targeting a resource the butler cares about
+			// so the served vpa needs to be deleted
+			if equalTarget(vpa.Spec.TargetRef, &ownerRefs[j]) {
 				return false, nil
 			}
 		}
@@ -125,7 +184,9 @@ func (v *GenericController) shouldServeVpa(ctx context.Context, vpaOwner client.
 	return true, nil
 }
 
-func (v *GenericController) ensureVpaDeleted(ctx context.Context, vpaOwner client.Object) error {
+func (v *GenericController) ensureVpaDeleted(ctx context.Context, vpaOwner client.Object,
+	eventReason, reason string) error {
+
 	var vpa vpav1.VerticalPodAutoscaler
 	ref := types.NamespacedName{Namespace: vpaOwner.GetNamespace(), Name: getVpaName(vpaOwner)}
 	err := v.Get(ctx, ref, &vpa)
@@ -134,36 +195,175 @@ func (v *GenericController) ensureVpaDeleted(ctx context.Context, vpaOwner clien
 	} else if err != nil {
 		return err
 	}
-	v.Log.Info("Deleting vpa as a hand-crafted vpa is already in place", "namespace", vpa.Namespace, "name", vpa.Name)
-	return v.Delete(ctx, &vpa)
+	// never delete a hand-crafted vpa, which happens to use the name of a served one
+	if !common.ManagedByButler(&vpa) {
+		return nil
+	}
+	v.Log.Info("Deleting served vpa as "+reason, "namespace", vpa.Namespace, "name", vpa.Name)
+	if err := v.Delete(ctx, &vpa); err != nil {
+		return err
+	}
+	recordVpaEvent(v.Recorder, &vpa, vpaOwner, corev1.EventTypeNormal, eventReason, "DeleteVpa",
+		"Deleted served vpa %s as %s", vpa.Name, reason)
+	return nil
+}
+
+// mapVpaToWorkloads enqueues the workloads of the controlled kind targeted or owning a vpa,
+// so deleting a served or hand-crafted vpa immediately re-evaluates serving a vpa.
+func (v *GenericController) mapVpaToWorkloads(ctx context.Context, obj client.Object) []reconcile.Request {
+	vpa, ok := obj.(*vpav1.VerticalPodAutoscaler)
+	if !ok || vpa.Spec.TargetRef == nil {
+		return nil
+	}
+	refs := []autoscalingv1.CrossVersionObjectReference{*vpa.Spec.TargetRef}
+	for _, owner := range vpa.GetOwnerReferences() {
+		refs = append(refs, autoscalingv1.CrossVersionObjectReference{
+			Kind:       owner.Kind,
+			Name:       owner.Name,
+			APIVersion: owner.APIVersion,
+		})
+	}
+	requests := make([]reconcile.Request, 0)
+	for _, ref := range refs {
+		if v.controlsKind(ref) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+				Namespace: vpa.Namespace,
+				Name:      ref.Name,
+			}})
+		}
+	}
+	if common.ManagedByButler(vpa) || v.controlsKind(*vpa.Spec.TargetRef) {
+		return requests
+	}
+	// a hand-crafted vpa can target the owner of a workload
+	ownedRequests, err := v.mapOwnerToWorkloads(ctx, vpa.Namespace, vpa.Spec.TargetRef)
+	if err != nil {
+		v.Log.Error(err, "failed to map vpa to owned workloads", "namespace", vpa.Namespace, "name", vpa.Name)
+		return requests
+	}
+	return append(requests, ownedRequests...)
+}
+
+// mapOwnerToWorkloads returns requests for the workloads of the controlled kind owned by the referenced object.
+func (v *GenericController) mapOwnerToWorkloads(ctx context.Context, namespace string,
+	ref *autoscalingv1.CrossVersionObjectReference) ([]reconcile.Request, error) {
+
+	list, err := v.newList()
+	if err != nil {
+		return nil, err
+	}
+	if err := v.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	requests := make([]reconcile.Request, 0)
+	err = meta.EachListItem(list, func(item runtime.Object) error {
+		accessor, err := meta.Accessor(item)
+		if err != nil {
+			return err
+		}
+		for _, owner := range accessor.GetOwnerReferences() {
+			if owner.Kind == ref.Kind && owner.Name == ref.Name {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+					Namespace: accessor.GetNamespace(),
+					Name:      accessor.GetName(),
+				}})
+				break
+			}
+		}
+		return nil
+	})
+	return requests, err
+}
+
+// controlsKind returns whether the reference points to the kind handled by the controller.
+// Like the vpa, it tolerates references omitting the api group.
+func (v *GenericController) controlsKind(ref autoscalingv1.CrossVersionObjectReference) bool {
+	if ref.Kind != v.gvk.Kind {
+		return false
+	}
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return false
+	}
+	return gv.Group == "" || gv.Group == v.gvk.Group
+}
+
+// newList returns an empty list matching the kind of the controlled instance.
+func (v *GenericController) newList() (client.ObjectList, error) {
+	listGVK := v.gvk.GroupVersion().WithKind(v.gvk.Kind + "List")
+	if _, ok := v.instance.(*unstructured.Unstructured); ok {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(listGVK)
+		return list, nil
+	}
+	obj, err := v.Scheme.New(listGVK)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.(client.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a list", listGVK)
+	}
+	return list, nil
+}
+
+// vpaTargetChanged passes creations and deletions of vpas as well
+// as updates changing their target or owner references.
+func vpaTargetChanged() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			before, ok := e.ObjectOld.(*vpav1.VerticalPodAutoscaler)
+			if !ok {
+				return false
+			}
+			after, ok := e.ObjectNew.(*vpav1.VerticalPodAutoscaler)
+			if !ok {
+				return false
+			}
+			return !equality.Semantic.DeepEqual(before.Spec.TargetRef, after.Spec.TargetRef) ||
+				!equality.Semantic.DeepEqual(before.OwnerReferences, after.OwnerReferences) ||
+				common.ManagedByButler(before) != common.ManagedByButler(after)
+		},
+	}
 }
 
 func getVpaName(vpaOwner client.Object) string {
-	name := vpaOwner.GetName()
-	kind := strings.ToLower(vpaOwner.GetObjectKind().GroupVersionKind().Kind)
+	return vpaName(vpaOwner.GetName(), vpaOwner.GetObjectKind().GroupVersionKind().Kind)
+}
+
+func vpaName(name, kind string) string {
+	kind = strings.ToLower(kind)
 	if len(name)+len(kind) > maxNameLength {
 		name = name[0 : len(name)-len(kind)-1]
 	}
 	return fmt.Sprintf("%s-%s", name, kind)
 }
 
-func SetupForAppsV1(mgr ctrl.Manager) error {
+// SetupForAppsV1 sets up GenericControllers for deployments, daemonsets and statefulsets.
+// Events are emitted by the recorder, if given, or by the recorder of the manager.
+func SetupForAppsV1(mgr ctrl.Manager, scope Scope, recorder events.EventRecorder) error {
 	deploymentController := GenericController{
-		Client: mgr.GetClient(),
+		Client:   mgr.GetClient(),
+		Scope:    scope,
+		Recorder: recorder,
 	}
 	err := deploymentController.SetupWithManager(mgr, &appsv1.Deployment{})
 	if err != nil {
 		return fmt.Errorf("unable to setup deployment controller: %w", err)
 	}
 	daemonsetController := GenericController{
-		Client: mgr.GetClient(),
+		Client:   mgr.GetClient(),
+		Scope:    scope,
+		Recorder: recorder,
 	}
 	err = daemonsetController.SetupWithManager(mgr, &appsv1.DaemonSet{})
 	if err != nil {
 		return fmt.Errorf("unable to setup daemonset controller: %w", err)
 	}
 	statefulSetController := GenericController{
-		Client: mgr.GetClient(),
+		Client:   mgr.GetClient(),
+		Scope:    scope,
+		Recorder: recorder,
 	}
 	err = statefulSetController.SetupWithManager(mgr, &appsv1.StatefulSet{})
 	if err != nil {
@@ -171,3 +371,43 @@ func SetupForAppsV1(mgr ctrl.Manager) error {
 	}
 	return nil
 }
+
+// SetupForBatchV1 sets up GenericControllers for cronjobs and standalone jobs.
+func SetupForBatchV1(mgr ctrl.Manager, scope Scope, recorder events.EventRecorder) error {
+	cronJobController := GenericController{
+		Client:   mgr.GetClient(),
+		Scope:    scope,
+		Recorder: recorder,
+	}
+	err := cronJobController.SetupWithManager(mgr, &batchv1.CronJob{})
+	if err != nil {
+		return fmt.Errorf("unable to setup cronjob controller: %w", err)
+	}
+	jobController := GenericController{
+		Client:   mgr.GetClient(),
+		Scope:    scope,
+		Recorder: recorder,
+	}
+	err = jobController.SetupWithManager(mgr, &batchv1.Job{})
+	if err != nil {
+		return fmt.Errorf("unable to setup job controller: %w", err)
+	}
+	return nil
+}
+
+// SetupForCustomKinds sets up a GenericController for every given custom kind.
+// The workloads are watched as unstructured objects.
+func SetupForCustomKinds(mgr ctrl.Manager, kinds []CustomKind, scope Scope, recorder events.EventRecorder) error {
+	for _, kind := range kinds {
+		customController := GenericController{
+			Client:   mgr.GetClient(),
+			Scope:    scope,
+			Recorder: recorder,
+		}
+		err := customController.SetupWithManager(mgr, kind.newObject())
+		if err != nil {
+			return fmt.Errorf("unable to setup %s controller: %w", kind.GroupVersionKind, err)
+		}
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ package controllers_test
 import (
 	"context"
 	"errors"
+	"strings"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -15,18 +16,25 @@ import (
 
 	appsv1 "k8s.io/api/apps/v1"
 	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
 	kerorrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
 	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
 	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
 	deploymentName          string = "test-deployment"
 	statefulSetName         string = "test-statefulset"
 	daemonSetName           string = "test-daemonset"
+	customWorkloadName      string = "test-custom"
+	cronJobName             string = "test-cronjob"
+	jobName                 string = "test-job"
 	deploymentCustomVpaName string = "test-deployment-custom-vpa"
 )
 
@@ -90,6 +98,32 @@ func deleteVpa(name string) {
 	Expect(err).To(Succeed())
 }
 
+// annotateNamespace replaces the annotations of the given namespace.
+func annotateNamespace(name string, annotations map[string]string) {
+	var namespace corev1.Namespace
+	Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: name}, &namespace)).To(Succeed())
+	unmodified := namespace.DeepCopy()
+	namespace.Annotations = annotations
+	Expect(k8sClient.Patch(context.Background(), &namespace, client.MergeFrom(unmodified))).To(Succeed())
+}
+
+// workloadEventReasons returns the reasons of the events emitted on the workload
+// and of those emitted on its vpa, which are related to the workload.
+func workloadEventReasons(uid types.UID) (onWorkload, onVpa []string) {
+	GinkgoHelper()
+	var events eventsv1.EventList
+	Expect(k8sClient.List(context.Background(), &events, client.InNamespace(metav1.NamespaceDefault))).To(Succeed())
+	for _, event := range events.Items {
+		switch {
+		case event.Regarding.UID == uid:
+			onWorkload = append(onWorkload, event.Reason)
+		case event.Related != nil && event.Related.UID == uid && event.Regarding.Kind == "VerticalPodAutoscaler":
+			onVpa = append(onVpa, event.Reason)
+		}
+	}
+	return onWorkload, onVpa
+}
+
 func makeDeployment(replicas int32) *appsv1.Deployment {
 	deployment := &appsv1.Deployment{}
 	deployment.Name = deploymentName
@@ -137,6 +171,63 @@ func makeDaemonSet() *appsv1.DaemonSet {
 	return daemonset
 }
 
+func makeCronJob() *batchv1.CronJob {
+	cronJob := &batchv1.CronJob{}
+	cronJob.Name = cronJobName
+	cronJob.Namespace = metav1.NamespaceDefault
+	cronJob.Spec.Schedule = "0 0 * * *"
+	cronJob.Spec.JobTemplate.Spec.Template.Labels = labels
+	cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers = containers
+	cronJob.Spec.JobTemplate.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	cronJob.Spec.JobTemplate.Spec.Template.Spec.Tolerations = []corev1.Toleration{{
+		Key:      corev1.TaintNodeNotReady,
+		Operator: corev1.TolerationOpExists,
+		Effect:   corev1.TaintEffectNoSchedule,
+	}}
+	return cronJob
+}
+
+func makeJob() *batchv1.Job {
+	job := &batchv1.Job{}
+	job.Name = jobName
+	job.Namespace = metav1.NamespaceDefault
+	job.Spec.Template.Labels = labels
+	job.Spec.Template.Spec.Containers = containers
+	job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	return job
+}
+
+func makeCustomWorkload() *unstructured.Unstructured {
+	workload := &unstructured.Unstructured{}
+	workload.SetGroupVersionKind(customKind.GroupVersionKind)
+	workload.SetName(customWorkloadName)
+	workload.SetNamespace(metav1.NamespaceDefault)
+	workload.Object["spec"] = map[string]any{
+		"replicas": int64(2),
+		"selector": map[string]any{
+			"matchLabels": map[string]any{"app": "test"},
+		},
+		"template": map[string]any{
+			"metadata": map[string]any{
+				"labels": map[string]any{"app": "test"},
+			},
+			"spec": map[string]any{
+				"containers": []any{
+					map[string]any{"name": "test-container", "image": "nginx"},
+				},
+				"tolerations": []any{
+					map[string]any{
+						"key":      corev1.TaintNodeNotReady,
+						"operator": string(corev1.TolerationOpExists),
+						"effect":   string(corev1.TaintEffectNoSchedule),
+					},
+				},
+			},
+		},
+	}
+	return workload
+}
+
 var _ = Describe("GenericController", func() {
 
 	Context("when creating a deployment with a single replica", func() {
@@ -173,6 +264,15 @@ var _ = Describe("GenericController", func() {
 			Expect(k8sClient.Get(context.Background(), ref, &vpa)).To(Succeed())
 			Expect(vpa.Spec.UpdatePolicy.MinReplicas).To(Equal(ptr.To(int32(1))))
 		})
+
+		It("should emit an event on the deployment and the vpa", func() {
+			expectVpa("test-deployment-deployment")
+			Eventually(func(g Gomega) {
+				onWorkload, onVpa := workloadEventReasons(deployment.UID)
+				g.Expect(onWorkload).To(ContainElement("VpaCreated"))
+				g.Expect(onVpa).To(ContainElement("VpaCreated"))
+			}).Should(Succeed())
+		})
 	})
 
 	Context("when creating a deployment with two replicas", func() {
@@ -238,6 +338,116 @@ var _ = Describe("GenericController", func() {
 		})
 	})
 
+	Context("when creating a cronjob", func() {
+		var cronJob *batchv1.CronJob
+
+		BeforeEach(func() {
+			cronJob = makeCronJob()
+			Expect(k8sClient.Create(context.Background(), cronJob)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			deleteVpa("test-cronjob-cronjob")
+			Expect(k8sClient.Delete(context.Background(), cronJob)).To(Succeed())
+		})
+
+		It("should create a vpa with the batch update mode", func() {
+			expectVpa("test-cronjob-cronjob")
+			ref := types.NamespacedName{Name: "test-cronjob-cronjob", Namespace: metav1.NamespaceDefault}
+			var vpa vpav1.VerticalPodAutoscaler
+			Eventually(func(g Gomega) vpav1.UpdateMode {
+				g.Expect(k8sClient.Get(context.Background(), ref, &vpa)).To(Succeed())
+				return *vpa.Spec.UpdatePolicy.UpdateMode
+			}).Should(Equal(common.VpaBatchUpdateMode))
+		})
+	})
+
+	Context("when creating a job", func() {
+		var job *batchv1.Job
+
+		AfterEach(func() {
+			deleteVpa("test-job-job")
+			Expect(k8sClient.Delete(context.Background(), job,
+				client.PropagationPolicy(metav1.DeletePropagationBackground))).To(Succeed())
+		})
+
+		It("should create a vpa for a standalone job", func() {
+			job = makeJob()
+			Expect(k8sClient.Create(context.Background(), job)).To(Succeed())
+			expectVpa("test-job-job")
+		})
+
+		It("should not create a vpa for a job spawned by a cronjob", func() {
+			job = makeJob()
+			job.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: "batch/v1",
+				Kind:       controllers.CronJobStr,
+				Name:       cronJobName,
+				UID:        "cronjob-uid", // makes no sense, but passes validation
+				Controller: ptr.To(true),
+			}}
+			Expect(k8sClient.Create(context.Background(), job)).To(Succeed())
+			Consistently(func() error {
+				var vpa vpav1.VerticalPodAutoscaler
+				return k8sClient.Get(context.Background(), types.NamespacedName{
+					Name:      "test-job-job",
+					Namespace: metav1.NamespaceDefault,
+				}, &vpa)
+			}).Should(Satisfy(kerorrs.IsNotFound))
+		})
+
+		It("deletes the served vpa of a job adopted by a cronjob", func() {
+			job = makeJob()
+			Expect(k8sClient.Create(context.Background(), job)).To(Succeed())
+			expectVpa("test-job-job")
+			unmodified := job.DeepCopy()
+			job.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: "batch/v1",
+				Kind:       controllers.CronJobStr,
+				Name:       cronJobName,
+				UID:        "cronjob-uid",
+				Controller: ptr.To(true),
+			}}
+			Expect(k8sClient.Patch(context.Background(), job, client.MergeFrom(unmodified))).To(Succeed())
+			Eventually(func() error {
+				var vpa vpav1.VerticalPodAutoscaler
+				return k8sClient.Get(context.Background(), types.NamespacedName{
+					Name:      "test-job-job",
+					Namespace: metav1.NamespaceDefault,
+				}, &vpa)
+			}).Should(Satisfy(kerorrs.IsNotFound))
+			Eventually(func(g Gomega) {
+				onWorkload, onVpa := workloadEventReasons(job.UID)
+				g.Expect(onWorkload).To(ContainElement("CoveredByCronJob"))
+				g.Expect(onVpa).To(ContainElement("CoveredByCronJob"))
+				g.Expect(onWorkload).ToNot(ContainElement("CustomVpaFound"))
+			}).Should(Succeed())
+		})
+	})
+
+	Context("when creating a workload of a custom kind", func() {
+		var workload *unstructured.Unstructured
+
+		BeforeEach(func() {
+			workload = makeCustomWorkload()
+			Expect(k8sClient.Create(context.Background(), workload)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			deleteVpa("test-custom-customworkload")
+			Expect(k8sClient.Delete(context.Background(), workload)).To(Succeed())
+		})
+
+		It("should create a vpa", func() {
+			expectVpa("test-custom-customworkload")
+			var vpa vpav1.VerticalPodAutoscaler
+			ref := types.NamespacedName{Name: "test-custom-customworkload", Namespace: metav1.NamespaceDefault}
+			Expect(k8sClient.Get(context.Background(), ref, &vpa)).To(Succeed())
+			Expect(vpa.Spec.TargetRef.Kind).To(Equal("CustomWorkload"))
+			Expect(vpa.Spec.TargetRef.APIVersion).To(Equal("test.vpa-butler.cloud.sap/v1"))
+		})
+	})
+
 	Context("when creating a hand-crafted vpa and a deployment afterwards", func() {
 		var vpa *vpav1.VerticalPodAutoscaler
 		var deployment *appsv1.Deployment
@@ -323,4 +533,135 @@ var _ = Describe("GenericController", func() {
 		})
 	})
 
+	Context("when deleting vpas", func() {
+		var deployment *appsv1.Deployment
+
+		BeforeEach(func() {
+			deployment = makeDeployment(1)
+			Expect(k8sClient.Create(context.Background(), deployment)).To(Succeed())
+			expectVpa("test-deployment-deployment")
+		})
+
+		AfterEach(func() {
+			Expect(k8sClient.Delete(context.Background(), deployment)).To(Succeed())
+			deleteVpa(deploymentCustomVpaName)
+			deleteVpa("test-deployment-deployment")
+		})
+
+		It("re-serves a deleted served vpa", func() {
+			var vpa vpav1.VerticalPodAutoscaler
+			ref := types.NamespacedName{Name: "test-deployment-deployment", Namespace: metav1.NamespaceDefault}
+			Expect(k8sClient.Get(context.Background(), ref, &vpa)).To(Succeed())
+			uid := vpa.UID
+			deleteVpa("test-deployment-deployment")
+			Eventually(func(g Gomega) {
+				g.Expect(k8sClient.Get(context.Background(), ref, &vpa)).To(Succeed())
+				g.Expect(vpa.UID).ToNot(Equal(uid))
+			}).Should(Succeed())
+		})
+
+		It("serves a vpa once the hand-crafted vpa is deleted", func() {
+			vpa := &vpav1.VerticalPodAutoscaler{}
+			vpa.Name = deploymentCustomVpaName
+			vpa.Namespace = metav1.NamespaceDefault
+			vpa.Spec.TargetRef = &autoscalingv1.CrossVersionObjectReference{
+				Name:       deploymentName,
+				Kind:       controllers.DeploymentStr,
+				APIVersion: "apps/v1",
+			}
+			Expect(k8sClient.Create(context.Background(), vpa)).To(Succeed())
+			Eventually(func() error {
+				var served vpav1.VerticalPodAutoscaler
+				return k8sClient.Get(context.Background(), types.NamespacedName{
+					Name:      "test-deployment-deployment",
+					Namespace: metav1.NamespaceDefault,
+				}, &served)
+			}).Should(Satisfy(kerorrs.IsNotFound))
+			deleteVpa(deploymentCustomVpaName)
+			expectVpa("test-deployment-deployment")
+		})
+	})
+
+	Context("when opting out a deployment", func() {
+		var deployment *appsv1.Deployment
+
+		BeforeEach(func() {
+			deployment = makeDeployment(1)
+			Expect(k8sClient.Create(context.Background(), deployment)).To(Succeed())
+			expectVpa("test-deployment-deployment")
+		})
+
+		AfterEach(func() {
+			annotateNamespace(metav1.NamespaceDefault, nil)
+			Expect(k8sClient.Delete(context.Background(), deployment)).To(Succeed())
+			deleteVpa("test-deployment-deployment")
+		})
+
+		expectNoVpa := func() {
+			GinkgoHelper()
+			Eventually(func() error {
+				var vpa vpav1.VerticalPodAutoscaler
+				return k8sClient.Get(context.Background(), types.NamespacedName{
+					Name:      "test-deployment-deployment",
+					Namespace: metav1.NamespaceDefault,
+				}, &vpa)
+			}).Should(Satisfy(kerorrs.IsNotFound))
+		}
+
+		It("deletes the served vpa when annotating the deployment", func() {
+			unmodified := deployment.DeepCopy()
+			deployment.Annotations = map[string]string{controllers.EnabledAnnotationKey: "false"}
+			Expect(k8sClient.Patch(context.Background(), deployment, client.MergeFrom(unmodified))).To(Succeed())
+			expectNoVpa()
+			Eventually(func(g Gomega) {
+				onWorkload, onVpa := workloadEventReasons(deployment.UID)
+				g.Expect(onWorkload).To(ContainElement("WorkloadExcluded"))
+				g.Expect(onVpa).To(ContainElement("WorkloadExcluded"))
+			}).Should(Succeed())
+		})
+
+		It("deletes the served vpa when annotating the namespace", func() {
+			annotateNamespace(metav1.NamespaceDefault, map[string]string{controllers.EnabledAnnotationKey: "false"})
+			expectNoVpa()
+		})
+
+		It("serves a vpa again when the deployment opts back in", func() {
+			annotateNamespace(metav1.NamespaceDefault, map[string]string{controllers.EnabledAnnotationKey: "false"})
+			expectNoVpa()
+			unmodified := deployment.DeepCopy()
+			deployment.Annotations = map[string]string{controllers.EnabledAnnotationKey: "true"}
+			Expect(k8sClient.Patch(context.Background(), deployment, client.MergeFrom(unmodified))).To(Succeed())
+			expectVpa("test-deployment-deployment")
+		})
+	})
+
+	Context("when creating a deployment in an excluded namespace", func() {
+		var namespace *corev1.Namespace
+		var deployment *appsv1.Deployment
+
+		BeforeEach(func() {
+			namespace = &corev1.Namespace{}
+			namespace.GenerateName = strings.TrimSuffix(excludedNamespacePattern, "*")
+			Expect(k8sClient.Create(context.Background(), namespace)).To(Succeed())
+			deployment = makeDeployment(1)
+			deployment.Namespace = namespace.Name
+			Expect(k8sClient.Create(context.Background(), deployment)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(k8sClient.Delete(context.Background(), deployment)).To(Succeed())
+			Expect(k8sClient.Delete(context.Background(), namespace)).To(Succeed())
+		})
+
+		It("does not serve a vpa", func() {
+			Consistently(func() error {
+				var vpa vpav1.VerticalPodAutoscaler
+				return k8sClient.Get(context.Background(), types.NamespacedName{
+					Name:      "test-deployment-deployment",
+					Namespace: namespace.Name,
+				}, &vpa)
+			}).Should(Satisfy(kerorrs.IsNotFound))
+		})
+	})
+
 })
@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// HpaConflictPolicy decides how a served vpa is configured, when a
+// HorizontalPodAutoscaler scales the same target on cpu or memory.
+type HpaConflictPolicy string
+
+const (
+	// HpaConflictRestrictResources drops the resources used by the hpa from the controlled resources.
+	HpaConflictRestrictResources HpaConflictPolicy = "RestrictResources"
+	// HpaConflictOff sets the update mode of the served vpa to Off.
+	HpaConflictOff HpaConflictPolicy = "Off"
+	// HpaConflictIgnore configures the served vpa regardless of any hpa.
+	HpaConflictIgnore HpaConflictPolicy = "Ignore"
+
+	reasonHpaConflict = "HpaConflict"
+)
+
+var SupportedHpaConflictPolicies = []string{
+	string(HpaConflictRestrictResources),
+	string(HpaConflictOff),
+	string(HpaConflictIgnore),
+}
+
+// hpaConflict describes a hpa scaling the target of a served vpa on resource metrics.
+type hpaConflict struct {
+	hpa       *autoscalingv2.HorizontalPodAutoscaler
+	resources []corev1.ResourceName
+}
+
+func (h hpaConflict) exists() bool {
+	return h.hpa != nil && len(h.resources) > 0
+}
+
+func (v *VpaController) findHpaConflict(ctx context.Context, vpaOwner client.Object) (hpaConflict, error) {
+	if v.HpaConflictPolicy == "" || v.HpaConflictPolicy == HpaConflictIgnore {
+		return hpaConflict{}, nil
+	}
+	var hpas autoscalingv2.HorizontalPodAutoscalerList
+	if err := v.List(ctx, &hpas, client.InNamespace(vpaOwner.GetNamespace())); err != nil {
+		return hpaConflict{}, fmt.Errorf("failed to list hpas: %w", err)
+	}
+	ownerRef := &autoscalingv1.CrossVersionObjectReference{
+		Kind:       vpaOwner.GetObjectKind().GroupVersionKind().Kind,
+		Name:       vpaOwner.GetName(),
+		APIVersion: vpaOwner.GetObjectKind().GroupVersionKind().GroupVersion().String(),
+	}
+	for i := range hpas.Items {
+		hpa := &hpas.Items[i]
+		scaleRef := &autoscalingv1.CrossVersionObjectReference{
+			Kind:       hpa.Spec.ScaleTargetRef.Kind,
+			Name:       hpa.Spec.ScaleTargetRef.Name,
+			APIVersion: hpa.Spec.ScaleTargetRef.APIVersion,
+		}
+		if !equalTarget(ownerRef, scaleRef) {
+			continue
+		}
+		resources := conflictingResources(hpa)
+		if len(resources) > 0 {
+			return hpaConflict{hpa: hpa, resources: resources}, nil
+		}
+	}
+	return hpaConflict{}, nil
+}
+
+// conflictingResources returns cpu and/or memory, if the hpa scales on them.
+func conflictingResources(hpa *autoscalingv2.HorizontalPodAutoscaler) []corev1.ResourceName {
+	// a hpa without metrics defaults to scaling on cpu utilization
+	if len(hpa.Spec.Metrics) == 0 {
+		return []corev1.ResourceName{corev1.ResourceCPU}
+	}
+	resources := make([]corev1.ResourceName, 0)
+	for _, metric := range hpa.Spec.Metrics {
+		var name corev1.ResourceName
+		switch {
+		case metric.Type == autoscalingv2.ResourceMetricSourceType && metric.Resource != nil:
+			name = metric.Resource.Name
+		case metric.Type == autoscalingv2.ContainerResourceMetricSourceType && metric.ContainerResource != nil:
+			name = metric.ContainerResource.Name
+		default:
+			continue
+		}
+		if (name == corev1.ResourceCPU || name == corev1.ResourceMemory) && !slices.Contains(resources, name) {
+			resources = append(resources, name)
+		}
+	}
+	slices.Sort(resources)
+	return resources
+}
+
+func (v *VpaController) recordHpaConflict(vpa *vpav1.VerticalPodAutoscaler, workload client.Object,
+	conflict hpaConflict, controlled []corev1.ResourceName) {
+
+	resources := make([]string, len(conflict.resources))
+	for i, name := range conflict.resources {
+		resources[i] = string(name)
+	}
+	if len(controlled) == 0 {
+		recordVpaEvent(v.Recorder, vpa, workload, corev1.EventTypeNormal, reasonHpaConflict, "DisableUpdates",
+			"Set update mode to Off as hpa %s scales the target on %s",
+			conflict.hpa.Name, strings.Join(resources, ","))
+		return
+	}
+	recordVpaEvent(v.Recorder, vpa, workload, corev1.EventTypeNormal, reasonHpaConflict, "RestrictControlledResources",
+		"Removed %s from controlled resources as hpa %s scales the target on them",
+		strings.Join(resources, ","), conflict.hpa.Name)
+}
+
+// mapHpaToVpa enqueues the served vpa of the workload scaled by a hpa.
+func (v *VpaController) mapHpaToVpa(_ context.Context, obj client.Object) []reconcile.Request {
+	hpa, ok := obj.(*autoscalingv2.HorizontalPodAutoscaler)
+	if !ok {
+		return nil
+	}
+	ref := hpa.Spec.ScaleTargetRef
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{
+		Namespace: hpa.Namespace,
+		Name:      vpaName(ref.Name, ref.Kind),
+	}}}
+}
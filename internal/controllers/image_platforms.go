@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	"github.com/sapcc/vpa_butler/internal/filter"
+	"github.com/sapcc/vpa_butler/internal/platform"
+)
+
+// resolvePlatforms sets the platforms all images of the target are available for, if the Platform
+// filter is enabled. The architectures annotation of the workload takes precedence over the images.
+// Targets, whose images cannot be resolved (yet), are kept on all platforms.
+func (v *VpaRunnable) resolvePlatforms(target *filter.TargetedVpa) {
+	if !slices.Contains(v.filterNames(), filter.PlatformFilter) {
+		return
+	}
+	if value := target.ObjectMeta.Annotations[ArchitecturesAnnotationKey]; value != "" {
+		for arch := range strings.SplitSeq(value, ",") {
+			target.Platforms = append(target.Platforms, platform.Platform{Architecture: strings.TrimSpace(arch)})
+		}
+		return
+	}
+	if v.Platforms == nil {
+		return
+	}
+	var common []platform.Platform
+	containers := slices.Concat(target.PodSpec.InitContainers, target.PodSpec.Containers)
+	for i, container := range containers {
+		platforms, err := v.Platforms.Platforms(container.Image)
+		if errors.Is(err, platform.ErrPending) {
+			// the target is enqueued again, once the platforms are resolved
+			return
+		}
+		if err != nil {
+			v.Log.V(1).Info("failed to resolve platforms of image", "namespace", target.Vpa.Namespace,
+				"name", target.Vpa.Name, "image", container.Image, "error", err.Error())
+			return
+		}
+		if i == 0 {
+			common = platforms
+			continue
+		}
+		common = slices.DeleteFunc(slices.Clone(common), func(p platform.Platform) bool {
+			return !slices.Contains(platforms, p)
+		})
+	}
+	target.Platforms = common
+}
+
+func imageItem(image string) queueItem {
+	return queueItem{kind: itemImage, key: types.NamespacedName{Name: image}}
+}
+
+// enqueueForImage enqueues the served vpas, whose targets run the image.
+func (v *VpaRunnable) enqueueForImage(ctx context.Context, reason, image string) {
+	v.enqueueServed(ctx, reason, func(vpa *vpav1.VerticalPodAutoscaler) bool {
+		target, err := v.extractTarget(ctx, vpa)
+		if err != nil {
+			// let the reconciliation report the error
+			return true
+		}
+		containers := slices.Concat(target.PodSpec.InitContainers, target.PodSpec.Containers)
+		return slices.ContainsFunc(containers, func(c corev1.Container) bool { return c.Image == image })
+	})
+}
@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/sapcc/vpa_butler/internal/common"
+)
+
+// vpaTargetIndex indexes vpas by the kind and name of their target.
+// The apiVersion is omitted as the vpa does not consider it, see equalTarget.
+const vpaTargetIndex = "spec.targetRef.kindName"
+
+// vpaPolicyIndex indexes served vpas by the name of the ButlerPolicy applied to them.
+const vpaPolicyIndex = "metadata.annotations.policy"
+
+// RegisterIndexes registers the field indexes required by the controllers.
+// It needs to be called before starting the manager.
+func RegisterIndexes(ctx context.Context, indexer client.FieldIndexer) error {
+	err := indexer.IndexField(ctx, &vpav1.VerticalPodAutoscaler{}, vpaTargetIndex, indexVpaTarget)
+	if err != nil {
+		return fmt.Errorf("failed to index vpas by target: %w", err)
+	}
+	err = indexer.IndexField(ctx, &vpav1.VerticalPodAutoscaler{}, vpaPolicyIndex, indexVpaPolicy)
+	if err != nil {
+		return fmt.Errorf("failed to index vpas by policy: %w", err)
+	}
+	return nil
+}
+
+func indexVpaTarget(obj client.Object) []string {
+	vpa, ok := obj.(*vpav1.VerticalPodAutoscaler)
+	if !ok || vpa.Spec.TargetRef == nil {
+		return nil
+	}
+	return []string{targetKey(vpa.Spec.TargetRef)}
+}
+
+func indexVpaPolicy(obj client.Object) []string {
+	name, ok := obj.GetAnnotations()[PolicyAnnotationKey]
+	vpa, isVpa := obj.(*vpav1.VerticalPodAutoscaler)
+	if !ok || !isVpa || !common.ManagedByButler(vpa) {
+		return nil
+	}
+	return []string{name}
+}
+
+func targetKey(ref *autoscalingv1.CrossVersionObjectReference) string {
+	return ref.Kind + "/" + ref.Name
+}
+
+// listVpasTargeting lists the vpas within the namespace targeting any of the given references.
+// Every vpa is returned at most once.
+func listVpasTargeting(ctx context.Context, c client.Reader, namespace string,
+	refs []autoscalingv1.CrossVersionObjectReference) ([]vpav1.VerticalPodAutoscaler, error) {
+
+	result := make([]vpav1.VerticalPodAutoscaler, 0)
+	seen := make(map[string]struct{})
+	for i := range refs {
+		key := targetKey(&refs[i])
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		var vpas vpav1.VerticalPodAutoscalerList
+		err := c.List(ctx, &vpas, client.InNamespace(namespace), client.MatchingFields{vpaTargetIndex: key})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list vpas targeting %s: %w", key, err)
+		}
+		result = append(result, vpas.Items...)
+	}
+	return result, nil
+}
@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// BenchmarkVpaTargetLookup compares finding the vpas targeting a workload via
+// the vpaTargetIndex with scanning all vpas of the namespace. Both are backed
+// by a client-go indexer just like the informer cache of the manager.
+func BenchmarkVpaTargetLookup(b *testing.B) {
+	const vpaCount = 5000
+	indexer := toolscache.NewIndexer(toolscache.MetaNamespaceKeyFunc, toolscache.Indexers{
+		toolscache.NamespaceIndex: toolscache.MetaNamespaceIndexFunc,
+		vpaTargetIndex: func(obj any) ([]string, error) {
+			vpa, ok := obj.(client.Object)
+			if !ok {
+				return nil, fmt.Errorf("unexpected object %T", obj)
+			}
+			return indexVpaTarget(vpa), nil
+		},
+	})
+	for i := range vpaCount {
+		vpa := &vpav1.VerticalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("vpa-%d", i), Namespace: metav1.NamespaceDefault},
+			Spec: vpav1.VerticalPodAutoscalerSpec{
+				TargetRef: &autoscalingv1.CrossVersionObjectReference{
+					Kind:       DeploymentStr,
+					Name:       fmt.Sprintf("workload-%d", i),
+					APIVersion: "apps/v1",
+				},
+			},
+		}
+		if err := indexer.Add(vpa); err != nil {
+			b.Fatal(err)
+		}
+	}
+	ref := &autoscalingv1.CrossVersionObjectReference{
+		Kind:       DeploymentStr,
+		Name:       fmt.Sprintf("workload-%d", vpaCount/2),
+		APIVersion: "apps/v1",
+	}
+	lookup := func(index, value string) int {
+		items, err := indexer.ByIndex(index, value)
+		if err != nil {
+			b.Fatal(err)
+		}
+		matches := 0
+		for _, item := range items {
+			vpa, ok := item.(*vpav1.VerticalPodAutoscaler)
+			if !ok {
+				b.Fatalf("unexpected object %T", item)
+			}
+			if equalTarget(vpa.Spec.TargetRef, ref) {
+				matches++
+			}
+		}
+		return matches
+	}
+
+	b.Run("index", func(b *testing.B) {
+		for b.Loop() {
+			if lookup(vpaTargetIndex, targetKey(ref)) != 1 {
+				b.Fatal("expected a single vpa")
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for b.Loop() {
+			if lookup(toolscache.NamespaceIndex, metav1.NamespaceDefault) != 1 {
+				b.Fatal("expected a single vpa")
+			}
+		}
+	})
+}
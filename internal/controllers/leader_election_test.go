@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers_test
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
+
+	"github.com/sapcc/vpa_butler/internal/controllers"
+)
+
+const electionTimeout = 15 * time.Second
+
+// replica is a manager running a VpaRunnable with leader election enabled.
+type replica struct {
+	manager ctrl.Manager
+	// reconciled counts the served vpas fetched by the workers of the VpaRunnable
+	reconciled atomic.Int64
+	stop       context.CancelFunc
+	done       chan struct{}
+}
+
+// countingClient counts the vpas fetched through it.
+type countingClient struct {
+	client.Client
+	vpaGets *atomic.Int64
+}
+
+func (c countingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object,
+	opts ...client.GetOption) error {
+
+	if _, ok := obj.(*vpav1.VerticalPodAutoscaler); ok {
+		c.vpaGets.Add(1)
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func startReplica(name string) *replica {
+	GinkgoHelper()
+	leaseDuration := 2 * time.Second
+	renewDeadline := time.Second
+	retryPeriod := 200 * time.Millisecond
+	mgr, err := ctrl.NewManager(testEnv.Config, ctrl.Options{
+		Scheme:                        testEnv.Scheme,
+		Metrics:                       server.Options{BindAddress: "0"},
+		LeaderElection:                true,
+		LeaderElectionNamespace:       metav1.NamespaceDefault,
+		LeaderElectionID:              "vpa-butler-leader-election-test",
+		LeaderElectionReleaseOnCancel: true,
+		LeaseDuration:                 &leaseDuration,
+		RenewDeadline:                 &renewDeadline,
+		RetryPeriod:                   &retryPeriod,
+		Logger:                        GinkgoLogr.WithName(name),
+	})
+	Expect(err).ToNot(HaveOccurred())
+	Expect(controllers.RegisterIndexes(context.Background(), mgr.GetFieldIndexer())).To(Succeed())
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &replica{manager: mgr, stop: cancel, done: make(chan struct{})}
+	runnable := &controllers.VpaRunnable{
+		Client:          countingClient{Client: mgr.GetClient(), vpaGets: &r.reconciled},
+		Cache:           mgr.GetCache(),
+		Period:          time.Hour,
+		JitterFactor:    1,
+		CapacityPercent: 90,
+		Log:             GinkgoLogr.WithName(name).WithName("vpa-runnable"),
+	}
+	Expect(mgr.Add(runnable)).To(Succeed())
+	go func() {
+		defer GinkgoRecover()
+		defer close(r.done)
+		Expect(mgr.Start(ctx)).To(Succeed())
+	}()
+	return r
+}
+
+func (r *replica) elected() bool {
+	select {
+	case <-r.manager.Elected():
+		return true
+	default:
+		return false
+	}
+}
+
+var _ = Describe("Leader election", func() {
+
+	var first, second *replica
+	var deployment *appsv1.Deployment
+
+	BeforeEach(func() {
+		// the served vpa is reconciled by the VpaRunnable of the leader only
+		deployment = makeDeployment(1)
+		Expect(k8sClient.Create(context.Background(), deployment)).To(Succeed())
+		expectVpa(deployVpaName)
+		first = startReplica("first")
+		second = startReplica("second")
+	})
+
+	AfterEach(func() {
+		for _, r := range []*replica{first, second} {
+			r.stop()
+			Eventually(r.done).WithTimeout(electionTimeout).Should(BeClosed())
+		}
+		deleteVpa(deployVpaName)
+		Expect(k8sClient.Delete(context.Background(), deployment)).To(Succeed())
+	})
+
+	It("starts the VpaRunnable only on the leader", func() {
+		Eventually(func() bool {
+			return first.elected() || second.elected()
+		}).WithTimeout(electionTimeout).Should(BeTrue())
+		leader, follower := first, second
+		if second.elected() {
+			leader, follower = second, first
+		}
+		Expect(follower.elected()).To(BeFalse())
+		Eventually(leader.reconciled.Load).Should(BeNumerically(">", 0))
+		Consistently(follower.reconciled.Load).WithTimeout(time.Second).Should(BeZero())
+
+		By("handing over to the follower once the leader stops")
+		leader.stop()
+		Eventually(leader.done).WithTimeout(electionTimeout).Should(BeClosed())
+		Eventually(follower.elected).WithTimeout(electionTimeout).Should(BeTrue())
+		Eventually(follower.reconciled.Load).Should(BeNumerically(">", 0))
+	})
+})
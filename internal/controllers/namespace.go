@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// namespacedAnnotationKeys are the annotations, which are also honored on
+// namespaces as defaults for all workloads within.
+var namespacedAnnotationKeys = []string{
+	MainContainerAnnotationKey,
+	UpdateModeAnnotationKey,
+	ControlledValuesAnnotationKey,
+	EnabledAnnotationKey,
+	DistributionModeAnnotationKey,
+	ReferenceNodeAnnotationKey,
+	ReferenceNodePercentileAnnotationKey,
+}
+
+// effectiveAnnotations merges the butler annotations of the namespace of a workload
+// with the annotations of the workload. The annotations of the workload win.
+func effectiveAnnotations(ctx context.Context, c client.Reader, workload metav1.Object) (map[string]string, error) {
+	var namespace corev1.Namespace
+	if err := c.Get(ctx, types.NamespacedName{Name: workload.GetNamespace()}, &namespace); err != nil {
+		return nil, fmt.Errorf("failed to fetch namespace %s: %w", workload.GetNamespace(), err)
+	}
+	result := make(map[string]string)
+	for _, key := range namespacedAnnotationKeys {
+		if value, ok := namespace.Annotations[key]; ok {
+			result[key] = value
+		}
+	}
+	maps.Copy(result, workload.GetAnnotations())
+	return result, nil
+}
+
+// namespaceAnnotationsChanged passes updates of namespaces,
+// which modify annotations honored by the vpa_butler.
+func namespaceAnnotationsChanged() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.ObjectOld == nil || e.ObjectNew == nil {
+				return false
+			}
+			before, after := e.ObjectOld.GetAnnotations(), e.ObjectNew.GetAnnotations()
+			for _, key := range namespacedAnnotationKeys {
+				if before[key] != after[key] {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// mapNamespaceToWorkloads enqueues all workloads of the controlled kind within a namespace.
+func (v *GenericController) mapNamespaceToWorkloads(ctx context.Context, obj client.Object) []reconcile.Request {
+	list, err := v.newList()
+	if err != nil {
+		v.Log.Error(err, "failed to create list for namespace change", "namespace", obj.GetName())
+		return nil
+	}
+	if err := v.List(ctx, list, client.InNamespace(obj.GetName())); err != nil {
+		v.Log.Error(err, "failed to list workloads for namespace change", "namespace", obj.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0)
+	err = meta.EachListItem(list, func(item runtime.Object) error {
+		accessor, err := meta.Accessor(item)
+		if err != nil {
+			return err
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: accessor.GetNamespace(),
+			Name:      accessor.GetName(),
+		}})
+		return nil
+	})
+	if err != nil {
+		v.Log.Error(err, "failed to map workloads for namespace change", "namespace", obj.GetName())
+		return nil
+	}
+	return requests
+}
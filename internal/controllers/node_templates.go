@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+// nodeTemplate describes the nodes of a node pool, which may currently be scaled to zero.
+type nodeTemplate struct {
+	Labels      map[string]string   `json:"labels,omitempty"`
+	Taints      []corev1.Taint      `json:"taints,omitempty"`
+	Allocatable corev1.ResourceList `json:"allocatable"`
+}
+
+// ParseNodeTemplatesRef parses a reference to a ConfigMap formatted as <namespace>/<name>.
+func ParseNodeTemplatesRef(value string) (types.NamespacedName, error) {
+	if value == "" {
+		return types.NamespacedName{}, nil
+	}
+	namespace, name, ok := strings.Cut(value, "/")
+	if !ok || namespace == "" || name == "" {
+		return types.NamespacedName{}, fmt.Errorf("node templates %q are not formatted as <namespace>/<name>", value)
+	}
+	return types.NamespacedName{Namespace: namespace, Name: name}, nil
+}
+
+// nodeTemplates returns a virtual node for each template within the configured ConfigMap.
+// Invalid templates are skipped, so they do not prevent reconciling based on the real nodes.
+func (v *VpaRunnable) nodeTemplates(ctx context.Context) ([]corev1.Node, error) {
+	if v.NodeTemplates.Name == "" {
+		return nil, nil
+	}
+	var configMap corev1.ConfigMap
+	if err := v.Get(ctx, v.NodeTemplates, &configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to fetch node templates: %w", err)
+	}
+	names := make([]string, 0, len(configMap.Data))
+	for name := range configMap.Data {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	nodes := make([]corev1.Node, 0, len(names))
+	for _, name := range names {
+		node, err := parseNodeTemplate(name, configMap.Data[name])
+		if err != nil {
+			v.Log.Error(err, "skipping invalid node template", "configmap", v.NodeTemplates.String(), "template", name)
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// parseNodeTemplate returns a virtual node for the template, which is
+// annotated with the name of the template to tell it apart from real nodes.
+func parseNodeTemplate(name, data string) (corev1.Node, error) {
+	var template nodeTemplate
+	if err := yaml.UnmarshalStrict([]byte(data), &template); err != nil {
+		return corev1.Node{}, err
+	}
+	if template.Allocatable.Cpu().Sign() <= 0 || template.Allocatable.Memory().Sign() <= 0 {
+		return corev1.Node{}, fmt.Errorf("node template %s requires allocatable cpu and memory", name)
+	}
+	var node corev1.Node
+	node.Name = name
+	node.Labels = template.Labels
+	node.Annotations = map[string]string{NodeTemplateAnnotationKey: name}
+	node.Spec.Taints = template.Taints
+	node.Status.Allocatable = template.Allocatable
+	return node, nil
+}
+
+// templateName returns the name of the node template the node was created from, if any.
+func templateName(node *corev1.Node) string {
+	return node.Annotations[NodeTemplateAnnotationKey]
+}
@@ -0,0 +1,128 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"slices"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/sapcc/vpa_butler/api/v1alpha1"
+	"github.com/sapcc/vpa_butler/internal/common"
+	"github.com/sapcc/vpa_butler/internal/policy"
+)
+
+// maxAppliedToSample limits the served vpas listed in the status of a ButlerPolicy,
+// as listing all of them would exceed the size limit of objects on large clusters.
+const maxAppliedToSample = 20
+
+// PolicyController reports the served vpas a ButlerPolicy applies
+// to in its status. The policies themselves are resolved by the
+// VpaController and the VpaRunnable.
+type PolicyController struct {
+	client.Client
+	Log logr.Logger
+}
+
+func (p *PolicyController) SetupWithManager(mgr ctrl.Manager) error {
+	name := "policy-controller"
+	p.Client = mgr.GetClient()
+	p.Log = mgr.GetLogger().WithName(name)
+	return ctrl.NewControllerManagedBy(mgr).
+		Named(name).
+		For(&v1alpha1.ButlerPolicy{}).
+		Watches(&vpav1.VerticalPodAutoscaler{}, handler.EnqueueRequestsFromMapFunc(mapVpaToPolicy),
+			builder.WithPredicates(appliedPolicyChanged())).
+		WithOptions(controller.Options{MaxConcurrentReconciles: 1}).
+		Complete(p)
+}
+
+func (p *PolicyController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var butlerPolicy v1alpha1.ButlerPolicy
+	if err := p.Get(ctx, req.NamespacedName, &butlerPolicy); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	var vpas vpav1.VerticalPodAutoscalerList
+	if err := p.List(ctx, &vpas, client.MatchingFields{vpaPolicyIndex: butlerPolicy.Name}); err != nil {
+		return ctrl.Result{}, err
+	}
+	appliedTo := make([]string, 0, len(vpas.Items))
+	for i := range vpas.Items {
+		appliedTo = append(appliedTo, client.ObjectKeyFromObject(&vpas.Items[i]).String())
+	}
+	slices.Sort(appliedTo)
+
+	unmodified := butlerPolicy.DeepCopy()
+	butlerPolicy.Status.ObservedGeneration = butlerPolicy.Generation
+	butlerPolicy.Status.AppliedCount = int32(len(appliedTo)) //nolint:gosec // there are less than 2^31 vpas
+	butlerPolicy.Status.AppliedTo = appliedTo[:min(len(appliedTo), maxAppliedToSample)]
+	meta.SetStatusCondition(&butlerPolicy.Status.Conditions, validCondition(&butlerPolicy))
+	if equality.Semantic.DeepEqual(unmodified.Status, butlerPolicy.Status) {
+		return ctrl.Result{}, nil
+	}
+	p.Log.Info("Updating butler policy status", "name", butlerPolicy.Name, "applied", len(appliedTo))
+	return ctrl.Result{}, p.Status().Patch(ctx, &butlerPolicy, client.MergeFrom(unmodified))
+}
+
+// validCondition reports whether the selectors of the policy are valid,
+// as policies with invalid selectors are skipped when resolving the policy of a workload.
+func validCondition(butlerPolicy *v1alpha1.ButlerPolicy) metav1.Condition {
+	condition := metav1.Condition{
+		Type:               v1alpha1.ConditionValid,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: butlerPolicy.Generation,
+		Reason:             "SelectorsValid",
+		Message:            "The selectors of the policy are valid",
+	}
+	if err := policy.Validate(butlerPolicy); err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "InvalidSelector"
+		condition.Message = "The policy is skipped: " + err.Error()
+	}
+	return condition
+}
+
+// appliedPolicyChanged filters the events of vpas to the ones changing the served vpas a ButlerPolicy
+// applies to, as the VpaRunnable updates the served vpas far more often than their policy changes.
+func appliedPolicyChanged() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return appliedPolicy(e.ObjectOld) != appliedPolicy(e.ObjectNew)
+		},
+		GenericFunc: func(event.GenericEvent) bool {
+			return false
+		},
+	}
+}
+
+// appliedPolicy returns the name of the ButlerPolicy applied to the vpa, if it is served.
+func appliedPolicy(obj client.Object) string {
+	vpa, ok := obj.(*vpav1.VerticalPodAutoscaler)
+	if !ok || !common.ManagedByButler(vpa) {
+		return ""
+	}
+	return vpa.Annotations[PolicyAnnotationKey]
+}
+
+// mapVpaToPolicy enqueues the ButlerPolicy applied to a served vpa.
+func mapVpaToPolicy(_ context.Context, obj client.Object) []reconcile.Request {
+	name := appliedPolicy(obj)
+	if name == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: name}}}
+}
@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/sapcc/vpa_butler/api/v1alpha1"
+	"github.com/sapcc/vpa_butler/internal/controllers"
+)
+
+var _ = Describe("PolicyController", func() {
+
+	var node *corev1.Node
+	var deployment *appsv1.Deployment
+	var butlerPolicy *v1alpha1.ButlerPolicy
+
+	BeforeEach(func() {
+		node = &corev1.Node{}
+		node.Name = "the-node"
+		node.Status.Allocatable = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1"),
+			corev1.ResourceMemory: resource.MustParse("2000"),
+		}
+		Expect(k8sClient.Create(context.Background(), node)).To(Succeed())
+		butlerPolicy = &v1alpha1.ButlerPolicy{}
+		butlerPolicy.Name = "test-policy"
+		butlerPolicy.Spec.NamespaceSelector = &metav1.LabelSelector{
+			MatchLabels: map[string]string{corev1.LabelMetadataName: metav1.NamespaceDefault},
+		}
+		butlerPolicy.Spec.Kinds = []string{controllers.DeploymentStr}
+		butlerPolicy.Spec.UpdateMode = ptr.To(vpav1.UpdateModeInitial)
+		butlerPolicy.Spec.MinAllowed = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m")}
+		butlerPolicy.Spec.CapacityPercent = ptr.To[int64](50)
+		Expect(k8sClient.Create(context.Background(), butlerPolicy)).To(Succeed())
+		deployment = makeDeployment(1)
+		Expect(k8sClient.Create(context.Background(), deployment)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		deleteVpa(deployVpaName)
+		Expect(k8sClient.Delete(context.Background(), deployment)).To(Succeed())
+		Expect(k8sClient.Delete(context.Background(), butlerPolicy)).To(Succeed())
+		Expect(k8sClient.Delete(context.Background(), node)).To(Succeed())
+	})
+
+	It("configures the served vpa from the policy", func() {
+		var vpa vpav1.VerticalPodAutoscaler
+		Eventually(func(g Gomega) {
+			g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      deployVpaName,
+				Namespace: metav1.NamespaceDefault,
+			}, &vpa)).To(Succeed())
+			g.Expect(vpa.Annotations).To(HaveKeyWithValue(controllers.PolicyAnnotationKey, "test-policy"))
+			g.Expect(*vpa.Spec.UpdatePolicy.UpdateMode).To(Equal(vpav1.UpdateModeInitial))
+			g.Expect(vpa.Spec.ResourcePolicy).ToNot(BeNil())
+			g.Expect(vpa.Spec.ResourcePolicy.ContainerPolicies).To(HaveLen(1))
+			minAllowed := vpa.Spec.ResourcePolicy.ContainerPolicies[0].MinAllowed
+			g.Expect(minAllowed.Cpu().MilliValue()).To(BeEquivalentTo(200))
+			g.Expect(minAllowed.Memory().Equal(testMinAllowedMemory)).To(BeTrue())
+		}).Should(Succeed())
+	})
+
+	It("uses the capacity percent of the policy", func() {
+		Eventually(func(g Gomega) {
+			var vpa vpav1.VerticalPodAutoscaler
+			g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      deployVpaName,
+				Namespace: metav1.NamespaceDefault,
+			}, &vpa)).To(Succeed())
+			g.Expect(vpa.Spec.ResourcePolicy).ToNot(BeNil())
+			g.Expect(vpa.Spec.ResourcePolicy.ContainerPolicies).To(HaveLen(1))
+			maxAllowed := vpa.Spec.ResourcePolicy.ContainerPolicies[0].MaxAllowed
+			g.Expect(maxAllowed.Cpu().MilliValue()).To(BeEquivalentTo(500))
+			g.Expect(maxAllowed.Memory().Value()).To(BeEquivalentTo(1000))
+		}).Should(Succeed())
+	})
+
+	It("reports the served vpa in the policy status", func() {
+		Eventually(func(g Gomega) {
+			var current v1alpha1.ButlerPolicy
+			g.Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(butlerPolicy), &current)).To(Succeed())
+			g.Expect(current.Status.AppliedTo).To(Equal([]string{"default/" + deployVpaName}))
+			g.Expect(current.Status.AppliedCount).To(BeEquivalentTo(1))
+		}).Should(Succeed())
+	})
+
+	It("removes the policy annotation once the policy does not match anymore", func() {
+		Eventually(func(g Gomega) map[string]string {
+			var vpa vpav1.VerticalPodAutoscaler
+			g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      deployVpaName,
+				Namespace: metav1.NamespaceDefault,
+			}, &vpa)).To(Succeed())
+			return vpa.Annotations
+		}).Should(HaveKey(controllers.PolicyAnnotationKey))
+		unmodified := butlerPolicy.DeepCopy()
+		butlerPolicy.Spec.Kinds = []string{controllers.StatefulSetStr}
+		Expect(k8sClient.Patch(context.Background(), butlerPolicy, client.MergeFrom(unmodified))).To(Succeed())
+		Eventually(func(g Gomega) map[string]string {
+			var vpa vpav1.VerticalPodAutoscaler
+			g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      deployVpaName,
+				Namespace: metav1.NamespaceDefault,
+			}, &vpa)).To(Succeed())
+			return vpa.Annotations
+		}).ShouldNot(HaveKey(controllers.PolicyAnnotationKey))
+	})
+
+	It("rejects selectors requiring values without values", func() {
+		invalid := &v1alpha1.ButlerPolicy{}
+		invalid.Name = "rejected-policy"
+		invalid.Spec.WorkloadSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "tier", Operator: metav1.LabelSelectorOpIn},
+		}}
+		Expect(k8sClient.Create(context.Background(), invalid)).ToNot(Succeed())
+	})
+
+	It("skips a policy with an invalid selector and reports it", func() {
+		invalid := &v1alpha1.ButlerPolicy{}
+		invalid.Name = "invalid-policy"
+		invalid.Spec.Priority = 100
+		invalid.Spec.WorkloadSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"not a key": "value"}}
+		Expect(k8sClient.Create(context.Background(), invalid)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(k8sClient.Delete(context.Background(), invalid)).To(Succeed())
+		})
+		Eventually(func(g Gomega) {
+			var current v1alpha1.ButlerPolicy
+			g.Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(invalid), &current)).To(Succeed())
+			condition := meta.FindStatusCondition(current.Status.Conditions, v1alpha1.ConditionValid)
+			g.Expect(condition).ToNot(BeNil())
+			g.Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		}).Should(Succeed())
+		annotations := func(g Gomega) map[string]string {
+			var vpa vpav1.VerticalPodAutoscaler
+			g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      deployVpaName,
+				Namespace: metav1.NamespaceDefault,
+			}, &vpa)).To(Succeed())
+			return vpa.Annotations
+		}
+		Eventually(annotations).Should(HaveKeyWithValue(controllers.PolicyAnnotationKey, "test-policy"))
+		Consistently(annotations).Should(HaveKeyWithValue(controllers.PolicyAnnotationKey, "test-policy"))
+	})
+
+})
@@ -0,0 +1,175 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sapcc/vpa_butler/internal/filter"
+)
+
+// ReferenceNodeStrategy decides which of the viable nodes bound the maximum allowed resources.
+type ReferenceNodeStrategy string
+
+const (
+	// ReferenceNodeMemory ranks the nodes by allocatable memory and takes both bounds from the same node.
+	ReferenceNodeMemory ReferenceNodeStrategy = "Memory"
+	// ReferenceNodeCPU ranks the nodes by allocatable cpu and takes both bounds from the same node.
+	ReferenceNodeCPU ReferenceNodeStrategy = "CPU"
+	// ReferenceNodePerResource ranks the nodes separately for each resource, so the
+	// cpu bound and the memory bound may be taken from different nodes.
+	ReferenceNodePerResource ReferenceNodeStrategy = "PerResource"
+	// ReferenceNodeBalanced ranks the nodes by the smaller of their cpu and memory relative to
+	// the largest cpu and memory among the viable nodes and takes both bounds from the same node.
+	ReferenceNodeBalanced ReferenceNodeStrategy = "Balanced"
+
+	// MaxReferenceNodePercentile selects the largest node.
+	MaxReferenceNodePercentile int64 = 100
+
+	reasonInvalidReferenceNode = "InvalidReferenceNode"
+)
+
+var SupportedReferenceNodeStrategies = []string{
+	string(ReferenceNodeMemory),
+	string(ReferenceNodeCPU),
+	string(ReferenceNodePerResource),
+	string(ReferenceNodeBalanced),
+}
+
+// ParseReferenceNodePercentile parses a percentile between 1 and 100.
+func ParseReferenceNodePercentile(value string) (int64, error) {
+	percentile, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if percentile < 1 || percentile > MaxReferenceNodePercentile {
+		return 0, fmt.Errorf("percentile %d is not between 1 and %d", percentile, MaxReferenceNodePercentile)
+	}
+	return percentile, nil
+}
+
+type referenceNodeParams struct {
+	strategy   ReferenceNodeStrategy
+	percentile int64
+	// smallest selects the smallest instead of a percentile of the nodes
+	smallest bool
+}
+
+// reference is the resources bounding the maximum allowed resources and the nodes providing them.
+type reference struct {
+	allocatable corev1.ResourceList
+	nodes       []string
+	// templates are the names of the node templates among the nodes
+	templates []string
+}
+
+// selectReference picks the reference node or, for per-resource strategies, nodes among the viable ones.
+func selectReference(nodes []corev1.Node, params referenceNodeParams) reference {
+	cpu := func(node *corev1.Node) float64 { return node.Status.Allocatable.Cpu().AsApproximateFloat64() }
+	memory := func(node *corev1.Node) float64 { return node.Status.Allocatable.Memory().AsApproximateFloat64() }
+	switch params.strategy {
+	case ReferenceNodeCPU:
+		return wholeNode(rankNode(nodes, cpu, params))
+	case ReferenceNodePerResource:
+		cpuNode, memNode := rankNode(nodes, cpu, params), rankNode(nodes, memory, params)
+		ref := wholeNode(cpuNode)
+		if memNode.Name != cpuNode.Name {
+			ref.allocatable = corev1.ResourceList{
+				corev1.ResourceCPU:    *cpuNode.Status.Allocatable.Cpu(),
+				corev1.ResourceMemory: *memNode.Status.Allocatable.Memory(),
+			}
+			ref.nodes = append(ref.nodes, memNode.Name)
+			if name := templateName(&memNode); name != "" {
+				ref.templates = append(ref.templates, name)
+			}
+		}
+		return ref
+	case ReferenceNodeBalanced:
+		var maxCPU, maxMemory float64
+		for i := range nodes {
+			maxCPU, maxMemory = max(maxCPU, cpu(&nodes[i])), max(maxMemory, memory(&nodes[i]))
+		}
+		balanced := func(node *corev1.Node) float64 {
+			if maxCPU == 0 || maxMemory == 0 {
+				return 0
+			}
+			return min(cpu(node)/maxCPU, memory(node)/maxMemory)
+		}
+		return wholeNode(rankNode(nodes, balanced, params))
+	default:
+		return wholeNode(rankNode(nodes, memory, params))
+	}
+}
+
+func wholeNode(node corev1.Node) reference {
+	ref := reference{allocatable: node.Status.Allocatable, nodes: []string{node.Name}}
+	if name := templateName(&node); name != "" {
+		ref.templates = []string{name}
+	}
+	return ref
+}
+
+// rankNode sorts the nodes ascending by score and returns the smallest one
+// or the one at the percentile using the nearest-rank method.
+func rankNode(nodes []corev1.Node, score func(*corev1.Node) float64, params referenceNodeParams) corev1.Node {
+	ranked := slices.Clone(nodes)
+	slices.SortStableFunc(ranked, func(a, b corev1.Node) int {
+		if c := cmp.Compare(score(&a), score(&b)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if params.smallest {
+		return ranked[0]
+	}
+	percentile := min(max(params.percentile, 1), MaxReferenceNodePercentile)
+	rank := (percentile*int64(len(ranked)) + MaxReferenceNodePercentile - 1) / MaxReferenceNodePercentile
+	return ranked[max(rank-1, 0)]
+}
+
+// referenceNodeParams returns how the reference node of the target is selected.
+// Invalid annotations are reported and the defaults are used instead.
+func (v *VpaRunnable) referenceNodeParams(target filter.TargetedVpa, annotations map[string]string,
+	decision *maxAllowedDecision) referenceNodeParams {
+
+	params := referenceNodeParams{
+		strategy:   v.ReferenceNodeStrategy,
+		percentile: v.ReferenceNodePercentile,
+		// DaemonSets needs to fit onto all nodes their pods can be placed on.
+		// Therefore the smallest of them is used to derive an upper recommendation
+		// bound. Other payloads usually create less pods.
+		smallest: target.Type == filter.TargetDaemonSet,
+	}
+	if params.strategy == "" {
+		params.strategy = ReferenceNodeMemory
+	}
+	if params.percentile == 0 {
+		params.percentile = MaxReferenceNodePercentile
+	}
+	if value, ok := annotations[ReferenceNodeAnnotationKey]; ok {
+		if slices.Contains(SupportedReferenceNodeStrategies, value) {
+			params.strategy = ReferenceNodeStrategy(value)
+		} else {
+			decision.warn(reasonInvalidReferenceNode, "SelectReferenceNode",
+				"Ignoring invalid reference node strategy %q, must be one of: %s",
+				value, strings.Join(SupportedReferenceNodeStrategies, ","))
+		}
+	}
+	if value, ok := annotations[ReferenceNodePercentileAnnotationKey]; ok {
+		percentile, err := ParseReferenceNodePercentile(value)
+		if err == nil {
+			params.percentile = percentile
+		} else {
+			decision.warn(reasonInvalidReferenceNode, "SelectReferenceNode",
+				"Ignoring invalid reference node percentile %q: %s", value, err.Error())
+		}
+	}
+	return params
+}
@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Scope restricts the workloads the vpa_butler serves vpas for.
+// The zero value includes all workloads.
+type Scope struct {
+	// IncludeNamespaces restricts serving vpas to namespaces matching any of the glob patterns, if not empty.
+	IncludeNamespaces []string
+	// ExcludeNamespaces prevents serving vpas in namespaces matching any of the glob patterns.
+	ExcludeNamespaces []string
+	// WorkloadSelector restricts serving vpas to workloads matching the label selector, if not nil.
+	WorkloadSelector labels.Selector
+}
+
+// NewScope creates a Scope from comma-separated lists of namespace
+// glob patterns and a label selector. Empty strings impose no restriction.
+func NewScope(includeNamespaces, excludeNamespaces, workloadSelector string) (Scope, error) {
+	var scope Scope
+	var err error
+	scope.IncludeNamespaces, err = parsePatterns(includeNamespaces)
+	if err != nil {
+		return Scope{}, err
+	}
+	scope.ExcludeNamespaces, err = parsePatterns(excludeNamespaces)
+	if err != nil {
+		return Scope{}, err
+	}
+	if workloadSelector != "" {
+		scope.WorkloadSelector, err = labels.Parse(workloadSelector)
+		if err != nil {
+			return Scope{}, fmt.Errorf("invalid workload selector %q: %w", workloadSelector, err)
+		}
+	}
+	return scope, nil
+}
+
+func parsePatterns(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	patterns := strings.Split(s, ",")
+	for i, pattern := range patterns {
+		patterns[i] = strings.TrimSpace(pattern)
+		if _, err := path.Match(patterns[i], ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern %q: %w", patterns[i], err)
+		}
+	}
+	return patterns, nil
+}
+
+// Includes returns whether the namespace and labels of the workload are within the scope.
+func (s Scope) Includes(workload metav1.Object) bool {
+	namespace := workload.GetNamespace()
+	if len(s.IncludeNamespaces) > 0 && !matchesAny(s.IncludeNamespaces, namespace) {
+		return false
+	}
+	if matchesAny(s.ExcludeNamespaces, namespace) {
+		return false
+	}
+	if s.WorkloadSelector != nil && !s.WorkloadSelector.Matches(labels.Set(workload.GetLabels())) {
+		return false
+	}
+	return true
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		// patterns are validated by NewScope
+		if matched, _ := path.Match(pattern, name); matched { //nolint:errcheck // see above comment
+			return true
+		}
+	}
+	return false
+}
+
+// isDisabled returns true, if the workload or its namespace opted out
+// of the vpa_butler via the enabled annotation.
+func isDisabled(ctx context.Context, c client.Reader, workload metav1.Object) (bool, error) {
+	annotations, err := effectiveAnnotations(ctx, c, workload)
+	if err != nil {
+		return false, err
+	}
+	value, ok := annotations[EnabledAnnotationKey]
+	if !ok {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	return err == nil && !enabled, nil
+}
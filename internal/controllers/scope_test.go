@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+
+	"github.com/sapcc/vpa_butler/internal/controllers"
+)
+
+var _ = Describe("Scope", func() {
+
+	makeWorkload := func(namespace string, workloadLabels map[string]string) *appsv1.Deployment {
+		deployment := &appsv1.Deployment{}
+		deployment.Namespace = namespace
+		deployment.Labels = workloadLabels
+		return deployment
+	}
+
+	It("includes everything by default", func() {
+		scope, err := controllers.NewScope("", "", "")
+		Expect(err).To(Succeed())
+		Expect(scope.Includes(makeWorkload("kube-system", nil))).To(BeTrue())
+	})
+
+	It("respects included and excluded namespaces", func() {
+		scope, err := controllers.NewScope("team-*, default", "team-ops", "")
+		Expect(err).To(Succeed())
+		Expect(scope.Includes(makeWorkload("default", nil))).To(BeTrue())
+		Expect(scope.Includes(makeWorkload("team-a", nil))).To(BeTrue())
+		Expect(scope.Includes(makeWorkload("team-ops", nil))).To(BeFalse())
+		Expect(scope.Includes(makeWorkload("kube-system", nil))).To(BeFalse())
+	})
+
+	It("respects the workload selector", func() {
+		scope, err := controllers.NewScope("", "", "vpa notin (off)")
+		Expect(err).To(Succeed())
+		Expect(scope.Includes(makeWorkload("default", nil))).To(BeTrue())
+		Expect(scope.Includes(makeWorkload("default", map[string]string{"vpa": "off"}))).To(BeFalse())
+	})
+
+	It("fails on invalid input", func() {
+		_, err := controllers.NewScope("[", "", "")
+		Expect(err).To(HaveOccurred())
+		_, err = controllers.NewScope("", "", "a in (")
+		Expect(err).To(HaveOccurred())
+	})
+
+})
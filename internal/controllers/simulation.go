@@ -0,0 +1,245 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/events"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// VpaAction is a change the vpa_butler applies to a vpa.
+type VpaAction string
+
+const (
+	VpaCreate VpaAction = "Create"
+	VpaPatch  VpaAction = "Patch"
+	VpaDelete VpaAction = "Delete"
+
+	// maxSimulatedReconciles bounds how often a vpa is reconciled due to its own changes.
+	maxSimulatedReconciles = 3
+)
+
+// VpaChange is a change to a vpa found by a Simulation.
+// Vpa is the vpa after the change, or before it for deletions.
+type VpaChange struct {
+	Action VpaAction
+	Vpa    *vpav1.VerticalPodAutoscaler
+}
+
+// Simulation runs the GenericControllers, the VpaController and the VpaRunnable
+// once against the objects of a snapshot instead of an api server.
+// The Client of the Controller and the Runnable is replaced by one holding the snapshot.
+type Simulation struct {
+	Scheme *runtime.Scheme
+	// Scope and Log are passed to the GenericControllers.
+	Scope      Scope
+	Log        logr.Logger
+	Controller *VpaController
+	Runnable   *VpaRunnable
+}
+
+// Run returns the changes to vpas the vpa_butler would apply, when serving the given objects.
+// The changes are ordered by namespace and name of the vpas.
+func (s *Simulation) Run(ctx context.Context, objects []client.Object) ([]VpaChange, error) {
+	c := s.newClient(objects)
+	before, err := listVpas(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	instances := []client.Object{
+		&appsv1.Deployment{}, &appsv1.DaemonSet{}, &appsv1.StatefulSet{}, &batchv1.CronJob{}, &batchv1.Job{},
+	}
+	for _, kind := range s.Controller.CustomKinds {
+		instances = append(instances, kind.newObject())
+	}
+	for _, instance := range instances {
+		if err := s.serveVpas(ctx, c, instance); err != nil {
+			return nil, err
+		}
+	}
+
+	s.Controller.Client = c
+	s.Controller.Scheme = s.Scheme
+	if s.Controller.Recorder == nil {
+		s.Controller.Recorder = &events.FakeRecorder{}
+	}
+	vpas, err := listVpas(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range slices.SortedFunc(maps.Keys(vpas), compareKeys) {
+		if err := s.configureVpa(ctx, c, key); err != nil {
+			return nil, fmt.Errorf("failed to configure vpa %s: %w", key, err)
+		}
+	}
+
+	s.Runnable.Client = c
+	if err := s.Runnable.buildChain(); err != nil {
+		return nil, err
+	}
+	vpas, err = listVpas(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range slices.SortedFunc(maps.Keys(vpas), compareKeys) {
+		if err := s.Runnable.reconcile(ctx, key, changeReasonResync); err != nil {
+			return nil, fmt.Errorf("failed to set maximum allowed resources of vpa %s: %w", key, err)
+		}
+	}
+
+	after, err := listVpas(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return diffVpas(before, after), nil
+}
+
+// configureVpa reconciles the vpa like the VpaController, which is triggered again by its own changes.
+// This converges vpas of the snapshot, whose fields are owned by no field manager before their first apply.
+func (s *Simulation) configureVpa(ctx context.Context, c client.Client, key types.NamespacedName) error {
+	for range maxSimulatedReconciles {
+		var vpa vpav1.VerticalPodAutoscaler
+		if err := c.Get(ctx, key, &vpa); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		if _, err := s.Controller.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+			return err
+		}
+		var reconciled vpav1.VerticalPodAutoscaler
+		if err := c.Get(ctx, key, &reconciled); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		if reconciled.ResourceVersion == vpa.ResourceVersion {
+			return nil
+		}
+	}
+	return nil
+}
+
+// newClient returns a client serving the objects. Like the cache of a manager
+// it sets the kind of returned typed objects, which some reconcilers rely on,
+// and returns the managed fields upgraded by the VpaController.
+func (s *Simulation) newClient(objects []client.Object) client.Client {
+	setKind := func(obj runtime.Object) error {
+		gvk, err := apiutil.GVKForObject(obj, s.Scheme)
+		if err != nil {
+			return err
+		}
+		obj.GetObjectKind().SetGroupVersionKind(gvk)
+		return nil
+	}
+	return fake.NewClientBuilder().
+		WithScheme(s.Scheme).
+		WithObjects(objects...).
+		WithReturnManagedFields().
+		WithIndex(&vpav1.VerticalPodAutoscaler{}, vpaTargetIndex, indexVpaTarget).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object,
+				opts ...client.GetOption) error {
+
+				if err := c.Get(ctx, key, obj, opts...); err != nil {
+					return err
+				}
+				return setKind(obj)
+			},
+			List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+				if err := c.List(ctx, list, opts...); err != nil {
+					return err
+				}
+				return meta.EachListItem(list, setKind)
+			},
+		}).
+		Build()
+}
+
+// serveVpas reconciles all workloads of the instance's kind like a GenericController.
+func (s *Simulation) serveVpas(ctx context.Context, c client.Client, instance client.Object) error {
+	controller := GenericController{Client: c, Scope: s.Scope}
+	if err := controller.setInstance(instance, s.Scheme); err != nil {
+		return err
+	}
+	controller.Log = s.Log.WithName(controller.typeName + "-controller")
+	list, err := controller.newList()
+	if err != nil {
+		return err
+	}
+	if err := c.List(ctx, list); err != nil {
+		return fmt.Errorf("failed to list %s: %w", controller.gvk.Kind, err)
+	}
+	return meta.EachListItem(list, func(item runtime.Object) error {
+		accessor, err := meta.Accessor(item)
+		if err != nil {
+			return err
+		}
+		key := types.NamespacedName{Namespace: accessor.GetNamespace(), Name: accessor.GetName()}
+		if _, err := controller.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+			return fmt.Errorf("failed to serve vpa for %s %s: %w", controller.gvk.Kind, key, err)
+		}
+		return nil
+	})
+}
+
+func listVpas(ctx context.Context, c client.Reader) (map[types.NamespacedName]*vpav1.VerticalPodAutoscaler, error) {
+	var vpas vpav1.VerticalPodAutoscalerList
+	if err := c.List(ctx, &vpas); err != nil {
+		return nil, fmt.Errorf("failed to list vpas: %w", err)
+	}
+	result := make(map[types.NamespacedName]*vpav1.VerticalPodAutoscaler, len(vpas.Items))
+	for i := range vpas.Items {
+		result[client.ObjectKeyFromObject(&vpas.Items[i])] = &vpas.Items[i]
+	}
+	return result, nil
+}
+
+func diffVpas(before, after map[types.NamespacedName]*vpav1.VerticalPodAutoscaler) []VpaChange {
+	changes := make([]VpaChange, 0)
+	for key, vpa := range after {
+		previous, ok := before[key]
+		switch {
+		case !ok:
+			changes = append(changes, VpaChange{Action: VpaCreate, Vpa: vpa})
+		case !equalServedFields(previous, vpa):
+			changes = append(changes, VpaChange{Action: VpaPatch, Vpa: vpa})
+		}
+	}
+	for key, vpa := range before {
+		if _, ok := after[key]; !ok {
+			changes = append(changes, VpaChange{Action: VpaDelete, Vpa: vpa})
+		}
+	}
+	slices.SortFunc(changes, func(a, b VpaChange) int {
+		return compareKeys(client.ObjectKeyFromObject(a.Vpa), client.ObjectKeyFromObject(b.Vpa))
+	})
+	return changes
+}
+
+// equalServedFields compares the fields of vpas written by the vpa_butler.
+func equalServedFields(a, b *vpav1.VerticalPodAutoscaler) bool {
+	return equality.Semantic.DeepEqual(a.Spec, b.Spec) &&
+		equality.Semantic.DeepEqual(a.Annotations, b.Annotations) &&
+		equality.Semantic.DeepEqual(a.Labels, b.Labels) &&
+		equality.Semantic.DeepEqual(a.OwnerReferences, b.OwnerReferences)
+}
+
+func compareKeys(a, b types.NamespacedName) int {
+	return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+}
@@ -0,0 +1,266 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package simulation_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/sapcc/vpa_butler/internal/controllers"
+	"github.com/sapcc/vpa_butler/internal/snapshot"
+)
+
+const (
+	// excludedNamespacePattern is excluded from serving vpas by the scope of the simulation.
+	excludedNamespacePattern = "excluded-*"
+
+	simulatedCluster = `
+apiVersion: v1
+kind: Node
+metadata:
+  name: simulated-node
+status:
+  allocatable:
+    cpu: "1"
+    memory: "2000"
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: simulated
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: excluded-simulated
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: simulated
+spec:
+  selector:
+    matchLabels:
+      app: app
+  template:
+    metadata:
+      labels:
+        app: app
+    spec:
+      containers:
+      - name: app
+        image: app
+`
+	servedVpa = `
+---
+apiVersion: autoscaling.k8s.io/v1
+kind: VerticalPodAutoscaler
+metadata:
+  name: app-deployment
+  namespace: simulated
+  annotations:
+    managedBy: vpa_butler
+spec:
+  targetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: app
+  resourcePolicy:
+    containerPolicies:
+    - containerName: "*"
+      maxAllowed:
+        cpu: "2"
+        memory: "4000"
+`
+	handCraftedVpa = `
+---
+apiVersion: autoscaling.k8s.io/v1
+kind: VerticalPodAutoscaler
+metadata:
+  name: hand-crafted
+  namespace: simulated
+spec:
+  targetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: app
+`
+	excludedDeployment = `
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: excluded
+  namespace: excluded-simulated
+spec:
+  selector:
+    matchLabels:
+      app: excluded
+  template:
+    metadata:
+      labels:
+        app: excluded
+    spec:
+      containers:
+      - name: excluded
+        image: excluded
+`
+
+	nodeTemplates = `
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: node-templates
+  namespace: butler
+data:
+  big: |
+    labels:
+      pool: big
+    allocatable:
+      cpu: "4"
+      memory: "8000"
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: big
+  namespace: simulated
+spec:
+  selector:
+    matchLabels:
+      app: big
+  template:
+    metadata:
+      labels:
+        app: big
+    spec:
+      nodeSelector:
+        pool: big
+      containers:
+      - name: big
+        image: big
+`
+)
+
+var (
+	testMinAllowedCPU    = resource.MustParse("100m")
+	testMinAllowedMemory = resource.MustParse("128Mi")
+	// nodeTemplatesRef references the ConfigMap of nodeTemplates.
+	nodeTemplatesRef = types.NamespacedName{Namespace: "butler", Name: "node-templates"}
+)
+
+type simulatedChange struct {
+	action controllers.VpaAction
+	name   string
+	// cpu and memory are the expected maximum allowed resources, if not empty
+	cpu    string
+	memory string
+}
+
+// anonymize returns the cluster as anonymized snapshot like the snapshot command writes it.
+func anonymize(cluster string) string {
+	GinkgoHelper()
+	decoder := utilyaml.NewYAMLOrJSONDecoder(strings.NewReader(cluster), len(cluster))
+	anonymizer := snapshot.NewAnonymizer()
+	objects := make([]*unstructured.Unstructured, 0)
+	for {
+		var obj unstructured.Unstructured
+		err := decoder.Decode(&obj.Object)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		Expect(err).ToNot(HaveOccurred())
+		if len(obj.Object) == 0 {
+			continue
+		}
+		snapshot.Sanitize(&obj)
+		anonymizer.Anonymize(&obj)
+		objects = append(objects, &obj)
+	}
+	var out strings.Builder
+	Expect(snapshot.Write(&out, objects)).To(Succeed())
+	return out.String()
+}
+
+func simulate(cluster string, templates types.NamespacedName) []controllers.VpaChange {
+	GinkgoHelper()
+	objects, err := snapshot.Read(strings.NewReader(cluster), scheme)
+	Expect(err).ToNot(HaveOccurred())
+	simulation := controllers.Simulation{
+		Scheme: scheme,
+		Scope:  controllers.Scope{ExcludeNamespaces: []string{excludedNamespacePattern}},
+		Log:    GinkgoLogr,
+		Controller: &controllers.VpaController{
+			Log:               GinkgoLogr.WithName("vpa-controller"),
+			MinAllowedCPU:     testMinAllowedCPU,
+			MinAllowedMemory:  testMinAllowedMemory,
+			HpaConflictPolicy: controllers.HpaConflictRestrictResources,
+		},
+		Runnable: &controllers.VpaRunnable{
+			CapacityPercent: 90,
+			NodeTemplates:   templates,
+			Log:             GinkgoLogr.WithName("vpa-runnable"),
+		},
+	}
+	changes, err := simulation.Run(context.Background(), objects)
+	Expect(err).ToNot(HaveOccurred())
+	return changes
+}
+
+var _ = Describe("Simulation", func() {
+
+	DescribeTable("reports the changes to vpas",
+		func(cluster string, expected []simulatedChange) {
+			changes := simulate(cluster, types.NamespacedName{})
+			Expect(changes).To(HaveLen(len(expected)))
+			for i, change := range changes {
+				Expect(change.Action).To(Equal(expected[i].action))
+				Expect(change.Vpa.Namespace).To(Equal("simulated"))
+				Expect(change.Vpa.Name).To(Equal(expected[i].name))
+				if expected[i].cpu == "" {
+					continue
+				}
+				policies := change.Vpa.Spec.ResourcePolicy.ContainerPolicies
+				Expect(policies).To(HaveLen(1))
+				Expect(policies[0].MaxAllowed.Cpu().Equal(resource.MustParse(expected[i].cpu))).To(BeTrue())
+				Expect(policies[0].MaxAllowed.Memory().Equal(resource.MustParse(expected[i].memory))).To(BeTrue())
+			}
+		},
+		Entry("creates a vpa for a workload", simulatedCluster, []simulatedChange{
+			{action: controllers.VpaCreate, name: "app-deployment", cpu: "900m", memory: "1800"},
+		}),
+		Entry("patches an outdated served vpa", simulatedCluster+servedVpa, []simulatedChange{
+			{action: controllers.VpaPatch, name: "app-deployment", cpu: "900m", memory: "1800"},
+		}),
+		Entry("deletes the served vpa in favor of a hand-crafted one", simulatedCluster+servedVpa+handCraftedVpa,
+			[]simulatedChange{
+				{action: controllers.VpaDelete, name: "app-deployment"},
+			}),
+		Entry("does not serve vpas for excluded workloads", simulatedCluster+excludedDeployment, []simulatedChange{
+			{action: controllers.VpaCreate, name: "app-deployment", cpu: "900m", memory: "1800"},
+		}),
+	)
+
+	It("finds the node templates within an anonymized snapshot", func() {
+		changes := simulate(anonymize(simulatedCluster+nodeTemplates), nodeTemplatesRef)
+		Expect(changes).To(HaveLen(2))
+		Expect(changes[0].Vpa.Name).To(Equal("workload-1-deployment"))
+		Expect(changes[1].Vpa.Name).To(Equal("workload-2-deployment"))
+		policies := changes[1].Vpa.Spec.ResourcePolicy.ContainerPolicies
+		Expect(policies).To(HaveLen(1))
+		Expect(policies[0].MaxAllowed.Cpu().Equal(resource.MustParse("3600m"))).To(BeTrue())
+		Expect(policies[0].MaxAllowed.Memory().Equal(resource.MustParse("7200"))).To(BeTrue())
+	})
+})
@@ -13,6 +13,9 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -20,10 +23,18 @@ import (
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	"github.com/sapcc/vpa_butler/api/v1alpha1"
 	"github.com/sapcc/vpa_butler/internal/controllers"
 	"github.com/sapcc/vpa_butler/internal/metrics"
 )
 
+const (
+	// excludedNamespacePattern is excluded from serving vpas by the scope of the GenericControllers.
+	excludedNamespacePattern = "excluded-*"
+	// nodeTemplatesName is the ConfigMap within the default namespace holding node templates.
+	nodeTemplatesName = "node-templates"
+)
+
 func TestControllers(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Controllers Suite")
@@ -34,9 +45,20 @@ var (
 	k8sManager     ctrl.Manager
 	k8sClient      client.Client
 	stopController context.CancelFunc
+	vpaRunnable    *controllers.VpaRunnable
 
 	testMinAllowedCPU    = resource.MustParse("100m")
 	testMinAllowedMemory = resource.MustParse("128Mi")
+
+	customKind = controllers.CustomKind{
+		GroupVersionKind: schema.GroupVersionKind{
+			Group:   "test.vpa-butler.cloud.sap",
+			Version: "v1",
+			Kind:    "CustomWorkload",
+		},
+		PodTemplatePath: "{.spec.template}",
+		SelectorPath:    "{.spec.selector}",
+	}
 )
 
 var _ = BeforeSuite(func() {
@@ -45,7 +67,7 @@ var _ = BeforeSuite(func() {
 
 	By("bootstrapping test environment")
 	testEnv = &envtest.Environment{
-		CRDDirectoryPaths: []string{"../../test/crds"},
+		CRDDirectoryPaths: []string{"../../test/crds", "../../crd"},
 	}
 
 	cfg, err := testEnv.Start()
@@ -58,31 +80,47 @@ var _ = BeforeSuite(func() {
 	Expect(err).NotTo(HaveOccurred())
 	err = appsv1.AddToScheme(testEnv.Scheme)
 	Expect(err).NotTo(HaveOccurred())
+	err = v1alpha1.AddToScheme(testEnv.Scheme)
+	Expect(err).NotTo(HaveOccurred())
 
 	k8sManager, err = ctrl.NewManager(cfg, ctrl.Options{
 		Scheme: testEnv.Scheme,
 	})
 	Expect(err).ToNot(HaveOccurred())
+	Expect(controllers.RegisterIndexes(context.Background(), k8sManager.GetFieldIndexer())).To(Succeed())
 
 	err = (&controllers.VpaController{
-		Client:           k8sManager.GetClient(),
-		Log:              GinkgoLogr.WithName("vpa-controller"),
-		Scheme:           k8sManager.GetScheme(),
-		Version:          "test",
-		MinAllowedCPU:    testMinAllowedCPU,
-		MinAllowedMemory: testMinAllowedMemory,
+		Client:            k8sManager.GetClient(),
+		Log:               GinkgoLogr.WithName("vpa-controller"),
+		Scheme:            k8sManager.GetScheme(),
+		Version:           "test",
+		MinAllowedCPU:     testMinAllowedCPU,
+		MinAllowedMemory:  testMinAllowedMemory,
+		CustomKinds:       []controllers.CustomKind{customKind},
+		HpaConflictPolicy: controllers.HpaConflictRestrictResources,
 	}).SetupWithManager(k8sManager)
 	Expect(err).ToNot(HaveOccurred())
 
-	Expect(controllers.SetupForAppsV1(k8sManager)).To(Succeed())
+	Expect((&controllers.PolicyController{}).SetupWithManager(k8sManager)).To(Succeed())
+	scope := controllers.Scope{ExcludeNamespaces: []string{excludedNamespacePattern}}
+	genericRecorder := k8sManager.GetEventRecorder("generic-controller")
+	Expect(controllers.SetupForAppsV1(k8sManager, scope, genericRecorder)).To(Succeed())
+	Expect(controllers.SetupForBatchV1(k8sManager, scope, genericRecorder)).To(Succeed())
+	Expect(controllers.SetupForCustomKinds(k8sManager, []controllers.CustomKind{customKind}, scope,
+		genericRecorder)).To(Succeed())
 
-	Expect(k8sManager.Add(&controllers.VpaRunnable{
+	vpaRunnable = &controllers.VpaRunnable{
 		Client:          k8sManager.GetClient(),
-		Period:          100 * time.Millisecond,
+		Cache:           k8sManager.GetCache(),
+		Period:          time.Hour, // changes need to be picked up by events
 		JitterFactor:    1,
 		CapacityPercent: 90,
+		NodeTemplates:   types.NamespacedName{Namespace: metav1.NamespaceDefault, Name: nodeTemplatesName},
+		CustomKinds:     []controllers.CustomKind{customKind},
 		Log:             GinkgoLogr.WithName("vpa-runnable"),
-	})).To(Succeed())
+		Recorder:        k8sManager.GetEventRecorder("vpa-runnable"),
+	}
+	Expect(k8sManager.Add(vpaRunnable)).To(Succeed())
 
 	go func() {
 		stopCtx, cancel := context.WithCancel(ctrl.SetupSignalHandler())
@@ -13,22 +13,31 @@ import (
 	"github.com/pkg/errors"
 	appsv1 "k8s.io/api/apps/v1"
 	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/events"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	"github.com/sapcc/vpa_butler/api/v1alpha1"
 	"github.com/sapcc/vpa_butler/internal/common"
 	"github.com/sapcc/vpa_butler/internal/metrics"
+	"github.com/sapcc/vpa_butler/internal/policy"
 )
 
 const (
@@ -37,11 +46,14 @@ const (
 
 type VpaController struct {
 	client.Client
-	Log              logr.Logger
-	Scheme           *runtime.Scheme
-	MinAllowedCPU    resource.Quantity
-	MinAllowedMemory resource.Quantity
-	Version          string
+	Log               logr.Logger
+	Scheme            *runtime.Scheme
+	MinAllowedCPU     resource.Quantity
+	MinAllowedMemory  resource.Quantity
+	Version           string
+	CustomKinds       []CustomKind
+	HpaConflictPolicy HpaConflictPolicy
+	Recorder          events.EventRecorder
 }
 
 func (v *VpaController) SetupWithManager(mgr ctrl.Manager) error {
@@ -49,9 +61,16 @@ func (v *VpaController) SetupWithManager(mgr ctrl.Manager) error {
 	v.Client = mgr.GetClient()
 	v.Log = mgr.GetLogger().WithName(name)
 	v.Scheme = mgr.GetScheme()
+	if v.Recorder == nil {
+		v.Recorder = mgr.GetEventRecorder(name)
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		Named(name).
 		For(&vpav1.VerticalPodAutoscaler{}).
+		Watches(&autoscalingv2.HorizontalPodAutoscaler{}, handler.EnqueueRequestsFromMapFunc(v.mapHpaToVpa)).
+		Watches(&v1alpha1.ButlerPolicy{}, handler.EnqueueRequestsFromMapFunc(v.mapPolicyToVpas)).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(v.mapNamespaceToVpas),
+			builder.WithPredicates(namespaceAnnotationsChanged())).
 		WithOptions(controller.Options{MaxConcurrentReconciles: 1}).
 		Complete(v)
 }
@@ -79,13 +98,47 @@ func (v *VpaController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	if deleted || !common.ManagedByButler(vpa) {
 		return ctrl.Result{}, nil
 	}
-	deleted, err = v.deleteOldVpa(ctx, vpa)
+	deleted, err = v.deleteOldVpa(ctx, vpa, target.object)
 	if err != nil || deleted {
 		return ctrl.Result{}, err
 	}
 	return ctrl.Result{}, v.reconcileVpa(ctx, target)
 }
 
+// mapPolicyToVpas enqueues all served vpas, as a change to a
+// ButlerPolicy can change the policy applying to any of them.
+func (v *VpaController) mapPolicyToVpas(ctx context.Context, _ client.Object) []reconcile.Request {
+	var vpas vpav1.VerticalPodAutoscalerList
+	if err := v.List(ctx, &vpas); err != nil {
+		v.Log.Error(err, "failed to list vpas for butler policy change")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0)
+	for i := range vpas.Items {
+		if common.ManagedByButler(&vpas.Items[i]) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&vpas.Items[i])})
+		}
+	}
+	return requests
+}
+
+// mapNamespaceToVpas enqueues all served vpas within a namespace,
+// as its annotations provide defaults for the workloads within.
+func (v *VpaController) mapNamespaceToVpas(ctx context.Context, obj client.Object) []reconcile.Request {
+	var vpas vpav1.VerticalPodAutoscalerList
+	if err := v.List(ctx, &vpas, client.InNamespace(obj.GetName())); err != nil {
+		v.Log.Error(err, "failed to list vpas for namespace change", "namespace", obj.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0)
+	for i := range vpas.Items {
+		if common.ManagedByButler(&vpas.Items[i]) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&vpas.Items[i])})
+		}
+	}
+	return requests
+}
+
 type replicatedObject struct {
 	object   client.Object
 	replicas *int32
@@ -122,6 +175,30 @@ func (v *VpaController) extractTarget(ctx context.Context, vpa *vpav1.VerticalPo
 				vpa.Namespace, ref.Name, ref.Kind)
 		}
 		return replicatedObject{object: &ds}, nil
+	case CronJobStr:
+		var cronJob batchv1.CronJob
+		err := v.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: vpa.Namespace}, &cronJob)
+		if err != nil {
+			return replicatedObject{}, fmt.Errorf("failed to fetch target %s/%s of kind %s for vpa",
+				vpa.Namespace, ref.Name, ref.Kind)
+		}
+		return replicatedObject{object: &cronJob}, nil
+	case JobStr:
+		var job batchv1.Job
+		err := v.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: vpa.Namespace}, &job)
+		if err != nil {
+			return replicatedObject{}, fmt.Errorf("failed to fetch target %s/%s of kind %s for vpa",
+				vpa.Namespace, ref.Name, ref.Kind)
+		}
+		return replicatedObject{object: &job}, nil
+	}
+	if kind, ok := findCustomKind(v.CustomKinds, &ref); ok {
+		obj, err := kind.get(ctx, v, types.NamespacedName{Name: ref.Name, Namespace: vpa.Namespace})
+		if err != nil {
+			return replicatedObject{}, fmt.Errorf("failed to fetch target %s/%s of kind %s for vpa",
+				vpa.Namespace, ref.Name, ref.Kind)
+		}
+		return replicatedObject{object: obj, replicas: kind.replicas(obj)}, nil
 	}
 	v.Log.Info("unknown target kind", "kind", ref.Kind, "name", vpa.Name, "namespace", vpa.Namespace)
 	return replicatedObject{}, nil
@@ -138,8 +215,18 @@ func (v *VpaController) cleanupServedVpa(ctx context.Context, params cleanupPara
 	if params.vpa.Spec.TargetRef == nil {
 		return false, nil
 	}
-	var vpas = new(vpav1.VerticalPodAutoscalerList)
-	if err := v.List(ctx, vpas, client.InNamespace(params.vpa.GetNamespace())); err != nil {
+	refs := []autoscalingv1.CrossVersionObjectReference{*params.vpa.Spec.TargetRef}
+	if params.target != nil {
+		for _, owner := range params.target.GetOwnerReferences() {
+			refs = append(refs, autoscalingv1.CrossVersionObjectReference{
+				Kind:       owner.Kind,
+				Name:       owner.Name,
+				APIVersion: owner.APIVersion,
+			})
+		}
+	}
+	vpas, err := listVpasTargeting(ctx, v, params.vpa.GetNamespace(), refs)
+	if err != nil {
 		return false, err
 	}
 	// There are two cases to consider:
@@ -150,8 +237,8 @@ func (v *VpaController) cleanupServedVpa(ctx context.Context, params cleanupPara
 	//    undefined behavior, but the butler does not care) no if applies and eventually the
 	//    hand-crafted reconciled vpas is compared to the served one. It gets deleted and we can
 	//    return early.
-	for i := range vpas.Items {
-		vpa := vpas.Items[i]
+	for i := range vpas {
+		vpa := vpas[i]
 		if !equalTargetAcrossOwnerRefs(&vpa, params) {
 			continue
 		}
@@ -161,6 +248,8 @@ func (v *VpaController) cleanupServedVpa(ctx context.Context, params cleanupPara
 			}
 			v.Log.Info("Deleted served vpa as a custom vpa was created",
 				"namespace", vpa.GetNamespace(), "name", vpa.GetName())
+			recordVpaEvent(v.Recorder, &vpa, params.target, corev1.EventTypeNormal, reasonCustomVpaFound,
+				"DeleteVpa", "Deleted served vpa %s as the custom vpa %s was created", vpa.Name, params.vpa.Name)
 			return false, nil
 		}
 		if common.ManagedByButler(params.vpa) {
@@ -169,6 +258,8 @@ func (v *VpaController) cleanupServedVpa(ctx context.Context, params cleanupPara
 			}
 			v.Log.Info("Deleted served vpa as a custom vpa was created",
 				"namespace", params.vpa.GetNamespace(), "name", params.vpa.GetName())
+			recordVpaEvent(v.Recorder, params.vpa, params.target, corev1.EventTypeNormal, reasonCustomVpaFound,
+				"DeleteVpa", "Deleted served vpa %s as the custom vpa %s was created", params.vpa.Name, vpa.Name)
 			return true, nil
 		}
 	}
@@ -178,13 +269,17 @@ func (v *VpaController) cleanupServedVpa(ctx context.Context, params cleanupPara
 }
 
 // Clean-up vpa resources with old naming schema.
-func (v *VpaController) deleteOldVpa(ctx context.Context, vpa *vpav1.VerticalPodAutoscaler) (bool, error) {
-	if !isNewNamingSchema(vpa.GetName()) {
+func (v *VpaController) deleteOldVpa(ctx context.Context, vpa *vpav1.VerticalPodAutoscaler,
+	target client.Object) (bool, error) {
+
+	if !v.isNewNamingSchema(vpa.GetName()) {
 		err := v.Delete(ctx, vpa)
 		if err != nil {
 			return false, err
 		}
 		v.Log.Info("Cleanup old vpa successful", "namespace", vpa.GetNamespace(), "name", vpa.GetName())
+		recordVpaEvent(v.Recorder, vpa, target, corev1.EventTypeNormal, reasonOutdatedVpaName, "DeleteVpa",
+			"Deleted served vpa %s named after an outdated schema", vpa.Name)
 		return true, nil
 	}
 	return false, nil
@@ -199,7 +294,7 @@ func (v *VpaController) deleteOrphanedVpa(ctx context.Context, vpa *vpav1.Vertic
 	}
 	if vpa.Spec.TargetRef == nil {
 		v.Log.Info("Deleting Vpa with orphaned target")
-		return true, v.Delete(ctx, vpa)
+		return true, v.deleteOrphaned(ctx, vpa)
 	}
 	name := types.NamespacedName{Namespace: vpa.Namespace, Name: vpa.Spec.TargetRef.Name}
 	var obj client.Object
@@ -210,15 +305,38 @@ func (v *VpaController) deleteOrphanedVpa(ctx context.Context, vpa *vpav1.Vertic
 		obj = &appsv1.StatefulSet{}
 	case DaemonSetStr:
 		obj = &appsv1.DaemonSet{}
+	case CronJobStr:
+		obj = &batchv1.CronJob{}
+	case JobStr:
+		obj = &batchv1.Job{}
+	default:
+		kind, ok := findCustomKind(v.CustomKinds, vpa.Spec.TargetRef)
+		if !ok {
+			return false, nil
+		}
+		obj = kind.newObject()
 	}
 	err := v.Get(ctx, name, obj)
 	if apierrors.IsNotFound(err) {
 		v.Log.Info("Deleting Vpa with orphaned target")
-		return true, v.Delete(ctx, vpa)
+		return true, v.deleteOrphaned(ctx, vpa)
 	}
 	return false, err
 }
 
+func (v *VpaController) deleteOrphaned(ctx context.Context, vpa *vpav1.VerticalPodAutoscaler) error {
+	if err := v.Delete(ctx, vpa); err != nil {
+		return err
+	}
+	target := "without target"
+	if vpa.Spec.TargetRef != nil {
+		target = "as its target " + vpa.Spec.TargetRef.Kind + " " + vpa.Spec.TargetRef.Name + " is gone"
+	}
+	recordVpaEvent(v.Recorder, vpa, nil, corev1.EventTypeNormal, reasonOrphanedVpa, "DeleteVpa",
+		"Deleted served vpa %s %s", vpa.Name, target)
+	return nil
+}
+
 func (v *VpaController) reconcileVpa(ctx context.Context, vpaOwner replicatedObject) error {
 	var vpa = new(vpav1.VerticalPodAutoscaler)
 	vpa.Namespace = vpaOwner.object.GetNamespace()
@@ -232,6 +350,12 @@ func (v *VpaController) reconcileVpa(ctx context.Context, vpaOwner replicatedObj
 		exists = false
 	}
 
+	if exists {
+		if err := upgradeManagedFields(ctx, v.Client, vpa); err != nil {
+			return err
+		}
+	}
+
 	if o, err := meta.Accessor(vpa); err == nil {
 		if o.GetDeletionTimestamp() != nil {
 			return fmt.Errorf("the resource %s/%s already exists but is marked for deletion",
@@ -239,30 +363,149 @@ func (v *VpaController) reconcileVpa(ctx context.Context, vpaOwner replicatedObj
 		}
 	}
 
+	conflict, err := v.findHpaConflict(ctx, vpaOwner.object)
+	if err != nil {
+		return err
+	}
+	butlerPolicy, err := policy.Find(ctx, v, vpaOwner.object.GetObjectKind().GroupVersionKind().Kind, vpaOwner.object)
+	if err != nil {
+		return err
+	}
+
+	annotations, err := effectiveAnnotations(ctx, v, vpaOwner.object)
+	if err != nil {
+		return err
+	}
+
 	before := vpa.DeepCopy()
-	if err := v.configureVpa(vpaOwner, vpa); err != nil {
+	err = v.configureVpa(vpa, configureParams{
+		vpaOwner:    vpaOwner,
+		conflict:    conflict,
+		policy:      butlerPolicy,
+		annotations: annotations,
+	})
+	if err != nil {
 		return errors.Wrap(err, "mutating object failed")
 	}
 
-	if !exists {
+	if exists && equality.Semantic.DeepEqual(before, vpa) {
+		return nil
+	}
+	if exists {
+		v.Log.Info("Patching vpa", "name", vpa.Name, "namespace", vpa.Namespace)
+	} else {
 		v.Log.Info("Creating vpa", "name", vpa.Name, "namespace", vpa.Namespace)
-		return v.Create(ctx, vpa)
 	}
-
-	if equality.Semantic.DeepEqual(before, vpa) {
-		return nil
+	applied, err := v.controllerFields(vpa, vpaOwner.object)
+	if err != nil {
+		return err
 	}
-	patch := client.MergeFrom(before)
-	v.Log.Info("Patching vpa", "name", vpa.Name, "namespace", vpa.Namespace)
-	if err := v.Patch(ctx, vpa, patch); err != nil {
+	if err := applyVpa(ctx, v.Client, applied, FieldManagerController); err != nil {
+		var conflictErr *FieldManagerConflictError
+		if errors.As(err, &conflictErr) {
+			// retrying does not help until the other field manager releases the fields
+			v.recordApplyConflict(vpa, vpaOwner.object, conflictErr)
+			return reconcile.TerminalError(err)
+		}
 		return err
 	}
+	v.recordConfiguration(vpa, vpaOwner.object, conflict)
 	return nil
 }
 
-func (v *VpaController) configureVpa(vpaOwner replicatedObject, vpa *vpav1.VerticalPodAutoscaler) error {
-	common.ConfigureVpaBaseline(vpa, vpaOwner.object, common.VpaUpdateMode)
-	annotations := vpaOwner.object.GetAnnotations()
+// controllerFields returns a vpa holding only the fields of the configured vpa owned by the VpaController.
+func (v *VpaController) controllerFields(vpa *vpav1.VerticalPodAutoscaler,
+	vpaOwner client.Object) (*vpav1.VerticalPodAutoscaler, error) {
+
+	applied := &vpav1.VerticalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            vpa.Name,
+			Namespace:       vpa.Namespace,
+			ResourceVersion: vpa.ResourceVersion,
+			Annotations: map[string]string{
+				common.AnnotationManagedBy: vpa.Annotations[common.AnnotationManagedBy],
+				annotationVpaButlerVersion: vpa.Annotations[annotationVpaButlerVersion],
+			},
+		},
+		Spec: vpav1.VerticalPodAutoscalerSpec{
+			TargetRef:      vpa.Spec.TargetRef,
+			UpdatePolicy:   vpa.Spec.UpdatePolicy,
+			ResourcePolicy: vpa.Spec.ResourcePolicy,
+		},
+	}
+	if policyName, ok := vpa.Annotations[PolicyAnnotationKey]; ok {
+		applied.Annotations[PolicyAnnotationKey] = policyName
+	}
+	if err := controllerutil.SetOwnerReference(vpaOwner, applied, v.Scheme); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// recordApplyConflict emits an event naming the field managers
+// owning fields of the served vpa, which the vpa_butler applies.
+func (v *VpaController) recordApplyConflict(vpa *vpav1.VerticalPodAutoscaler, vpaOwner client.Object,
+	conflictErr *FieldManagerConflictError) {
+
+	recordVpaEvent(v.Recorder, vpa, vpaOwner, corev1.EventTypeWarning, reasonFieldManagerConflict, "ApplyVpa",
+		"Fields configured by the vpa_butler are owned by %s", strings.Join(conflictErr.Managers, ","))
+}
+
+// recordConfiguration emits events explaining decisions taken while configuring the vpa.
+func (v *VpaController) recordConfiguration(vpa *vpav1.VerticalPodAutoscaler, workload client.Object,
+	conflict hpaConflict) {
+
+	if !conflict.exists() {
+		return
+	}
+	var controlled []corev1.ResourceName
+	if ptr.Deref(vpa.Spec.UpdatePolicy.UpdateMode, vpav1.UpdateModeAuto) != vpav1.UpdateModeOff {
+		controlled = controlledResources(vpa)
+	}
+	v.recordHpaConflict(vpa, workload, conflict, controlled)
+}
+
+// controlledResources returns the resources controlled by the first container policy of the vpa.
+// Vpas without controlled resources, e.g. edited by hand, control cpu and memory like the vpa does by default.
+func controlledResources(vpa *vpav1.VerticalPodAutoscaler) []corev1.ResourceName {
+	if vpa.Spec.ResourcePolicy == nil || len(vpa.Spec.ResourcePolicy.ContainerPolicies) == 0 ||
+		vpa.Spec.ResourcePolicy.ContainerPolicies[0].ControlledResources == nil {
+
+		return []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+	}
+	return *vpa.Spec.ResourcePolicy.ContainerPolicies[0].ControlledResources
+}
+
+type configureParams struct {
+	vpaOwner replicatedObject
+	conflict hpaConflict
+	// policy is nil, if no ButlerPolicy matches the vpa owner
+	policy *v1alpha1.ButlerPolicy
+	// annotations of the vpa owner merged with the defaults of its namespace
+	annotations map[string]string
+}
+
+func (v *VpaController) configureVpa(vpa *vpav1.VerticalPodAutoscaler, params configureParams) error {
+	vpaOwner, conflict := params.vpaOwner, params.conflict
+	updateMode := defaultUpdateMode(vpaOwner.object)
+	ctrlValues := common.VpaControlledValues
+	minAllowed := corev1.ResourceList{
+		corev1.ResourceCPU:    v.MinAllowedCPU,
+		corev1.ResourceMemory: v.MinAllowedMemory,
+	}
+	if params.policy != nil {
+		spec := params.policy.Spec
+		updateMode = ptr.Deref(spec.UpdateMode, updateMode)
+		ctrlValues = ptr.Deref(spec.ControlledValues, ctrlValues)
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			if quantity, ok := spec.MinAllowed[name]; ok {
+				minAllowed[name] = quantity
+			}
+		}
+	}
+
+	common.ConfigureVpaBaseline(vpa, vpaOwner.object, updateMode)
+	annotations := params.annotations
 
 	if updateModeStr, ok := annotations[UpdateModeAnnotationKey]; ok {
 		if slices.Contains(common.SupportedUpdatedModes, updateModeStr) {
@@ -271,6 +514,19 @@ func (v *VpaController) configureVpa(vpaOwner replicatedObject, vpa *vpav1.Verti
 		}
 	}
 
+	resourceList := []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+	if conflict.exists() {
+		// a hpa scaling on a resource the vpa controls makes both fight each other
+		resourceList = slices.DeleteFunc(resourceList, func(name corev1.ResourceName) bool {
+			return slices.Contains(conflict.resources, name)
+		})
+		if v.HpaConflictPolicy == HpaConflictOff || len(resourceList) == 0 {
+			resourceList = []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+			updateMode := vpav1.UpdateModeOff
+			vpa.Spec.UpdatePolicy.UpdateMode = &updateMode
+		}
+	}
+
 	vpa.Spec.UpdatePolicy.MinReplicas = nil
 	if vpa.Spec.UpdatePolicy.UpdateMode != nil {
 		autoModes := []vpav1.UpdateMode{vpav1.UpdateModeAuto, vpav1.UpdateModeRecreate}
@@ -281,23 +537,18 @@ func (v *VpaController) configureVpa(vpaOwner replicatedObject, vpa *vpav1.Verti
 		}
 	}
 
-	ctrlValues := common.VpaControlledValues
 	if ctrlValuesStr, ok := annotations[ControlledValuesAnnotationKey]; ok {
 		if slices.Contains(common.SupportedControlledValues, ctrlValuesStr) {
 			ctrlValues = vpav1.ContainerControlledValues(ctrlValuesStr)
 		}
 	}
 
-	resourceList := []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
 	if vpa.Spec.ResourcePolicy == nil || len(vpa.Spec.ResourcePolicy.ContainerPolicies) == 0 {
 		containerResourcePolicy := vpav1.ContainerResourcePolicy{
 			ContainerName:       "*",
 			ControlledResources: &resourceList,
 			ControlledValues:    &ctrlValues,
-			MinAllowed: corev1.ResourceList{
-				corev1.ResourceCPU:    v.MinAllowedCPU,
-				corev1.ResourceMemory: v.MinAllowedMemory,
-			},
+			MinAllowed:          minAllowed,
 		}
 		vpa.Spec.ResourcePolicy = &vpav1.PodResourcePolicy{
 			ContainerPolicies: []vpav1.ContainerResourcePolicy{containerResourcePolicy},
@@ -307,19 +558,33 @@ func (v *VpaController) configureVpa(vpaOwner replicatedObject, vpa *vpav1.Verti
 			current := &vpa.Spec.ResourcePolicy.ContainerPolicies[i]
 			current.ControlledResources = &resourceList
 			current.ControlledValues = &ctrlValues
-			current.MinAllowed = corev1.ResourceList{
-				corev1.ResourceCPU:    v.MinAllowedCPU,
-				corev1.ResourceMemory: v.MinAllowedMemory,
-			}
+			current.MinAllowed = minAllowed.DeepCopy()
 		}
 	}
 	vpa.Annotations[annotationVpaButlerVersion] = v.Version
+	if params.policy != nil {
+		vpa.Annotations[PolicyAnnotationKey] = params.policy.Name
+	} else {
+		delete(vpa.Annotations, PolicyAnnotationKey)
+	}
 
 	return controllerutil.SetOwnerReference(vpaOwner.object, vpa, v.Scheme)
 }
 
-func isNewNamingSchema(name string) bool {
-	suffixes := []string{"-daemonset", "-statefulset", "-deployment"}
+// Pods of cronjobs and jobs are short-lived, so they get a dedicated default update mode.
+func defaultUpdateMode(vpaOwner client.Object) vpav1.UpdateMode {
+	switch vpaOwner.(type) {
+	case *batchv1.CronJob, *batchv1.Job:
+		return common.VpaBatchUpdateMode
+	}
+	return common.VpaUpdateMode
+}
+
+func (v *VpaController) isNewNamingSchema(name string) bool {
+	suffixes := []string{"-daemonset", "-statefulset", "-deployment", "-cronjob", "-job"}
+	for _, kind := range v.CustomKinds {
+		suffixes = append(suffixes, "-"+strings.ToLower(kind.Kind))
+	}
 	for _, suffix := range suffixes {
 		if strings.HasSuffix(name, suffix) {
 			return true
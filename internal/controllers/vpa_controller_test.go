@@ -14,12 +14,15 @@ import (
 	. "github.com/onsi/gomega"
 	appsv1 "k8s.io/api/apps/v1"
 	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/sapcc/vpa_butler/internal/common"
@@ -242,6 +245,190 @@ var _ = Describe("VpaController", func() {
 			}).Should(Equal(vpav1.ContainerControlledValuesRequestsAndLimits))
 		})
 
+		It("applies the served vpa with dedicated field managers", func() {
+			Eventually(func(g Gomega) []string {
+				var vpa vpav1.VerticalPodAutoscaler
+				g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+					Name:      "test-deployment-deployment",
+					Namespace: metav1.NamespaceDefault,
+				}, &vpa)).To(Succeed())
+				managers := make([]string, 0)
+				for _, entry := range vpa.ManagedFields {
+					if entry.Operation == metav1.ManagedFieldsOperationApply {
+						managers = append(managers, entry.Manager)
+					}
+				}
+				return managers
+			}).Should(ConsistOf(controllers.FieldManagerController, controllers.FieldManagerCapacity))
+		})
+
+		It("reports fields owned by other managers as conflict", func() {
+			var vpa vpav1.VerticalPodAutoscaler
+			name := types.NamespacedName{Namespace: metav1.NamespaceDefault, Name: "test-deployment-deployment"}
+			Eventually(func(g Gomega) *vpav1.PodResourcePolicy {
+				g.Expect(k8sClient.Get(context.Background(), name, &vpa)).To(Succeed())
+				return vpa.Spec.ResourcePolicy
+			}).ShouldNot(BeNil())
+			vpa.Spec.UpdatePolicy.UpdateMode = ptr.To(vpav1.UpdateModeRecreate)
+			Expect(k8sClient.Update(context.Background(), &vpa, client.FieldOwner("kubectl-edit"))).To(Succeed())
+
+			Eventually(func(g Gomega) []string {
+				var events eventsv1.EventList
+				g.Expect(k8sClient.List(context.Background(), &events, client.InNamespace(metav1.NamespaceDefault))).To(Succeed())
+				notes := make([]string, 0)
+				for _, event := range events.Items {
+					if event.Regarding.Name == name.Name && event.Reason == "FieldManagerConflict" {
+						notes = append(notes, event.Note)
+					}
+				}
+				return notes
+			}).Should(ContainElement(ContainSubstring("kubectl-edit")))
+			Expect(k8sClient.Get(context.Background(), name, &vpa)).To(Succeed())
+			Expect(*vpa.Spec.UpdatePolicy.UpdateMode).To(Equal(vpav1.UpdateModeRecreate))
+		})
+
+	})
+
+	When("the namespace of a deployment is annotated", func() {
+
+		var deployment *appsv1.Deployment
+
+		BeforeEach(func() {
+			deployment = makeDeployment(1)
+			Expect(k8sClient.Create(context.Background(), deployment)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			annotateNamespace(metav1.NamespaceDefault, nil)
+			Expect(k8sClient.Delete(context.Background(), deployment)).To(Succeed())
+			deleteVpa("test-deployment-deployment")
+		})
+
+		getVpa := func() (*vpav1.VerticalPodAutoscaler, error) {
+			var vpa vpav1.VerticalPodAutoscaler
+			err := k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      "test-deployment-deployment",
+				Namespace: metav1.NamespaceDefault,
+			}, &vpa)
+			return &vpa, err
+		}
+
+		It("uses the namespace annotations as defaults", func() {
+			annotateNamespace(metav1.NamespaceDefault, map[string]string{
+				controllers.UpdateModeAnnotationKey:       string(vpav1.UpdateModeInitial),
+				controllers.ControlledValuesAnnotationKey: string(vpav1.ContainerControlledValuesRequestsAndLimits),
+			})
+			Eventually(func(g Gomega) {
+				vpa, err := getVpa()
+				g.Expect(err).To(Succeed())
+				g.Expect(*vpa.Spec.UpdatePolicy.UpdateMode).To(Equal(vpav1.UpdateModeInitial))
+				g.Expect(vpa.Spec.ResourcePolicy).ToNot(BeNil())
+				g.Expect(vpa.Spec.ResourcePolicy.ContainerPolicies).To(HaveLen(1))
+				g.Expect(*vpa.Spec.ResourcePolicy.ContainerPolicies[0].ControlledValues).To(
+					Equal(vpav1.ContainerControlledValuesRequestsAndLimits))
+			}).Should(Succeed())
+		})
+
+		It("prefers the annotations of the deployment", func() {
+			unmodified := deployment.DeepCopy()
+			deployment.Annotations = map[string]string{controllers.UpdateModeAnnotationKey: string(vpav1.UpdateModeRecreate)}
+			Expect(k8sClient.Patch(context.Background(), deployment, client.MergeFrom(unmodified))).To(Succeed())
+			expectRecreate := func(g Gomega) {
+				vpa, err := getVpa()
+				g.Expect(err).To(Succeed())
+				g.Expect(*vpa.Spec.UpdatePolicy.UpdateMode).To(Equal(vpav1.UpdateModeRecreate))
+			}
+			Eventually(expectRecreate).Should(Succeed())
+			annotateNamespace(metav1.NamespaceDefault, map[string]string{
+				controllers.UpdateModeAnnotationKey: string(vpav1.UpdateModeInitial),
+			})
+			Consistently(expectRecreate).Should(Succeed())
+		})
+
+	})
+
+	When("a hpa scales a deployment on cpu", func() {
+		var deployment *appsv1.Deployment
+		var hpa *autoscalingv2.HorizontalPodAutoscaler
+
+		BeforeEach(func() {
+			deployment = makeDeployment(2)
+			Expect(k8sClient.Create(context.Background(), deployment)).To(Succeed())
+			hpa = &autoscalingv2.HorizontalPodAutoscaler{}
+			hpa.Name = "test-hpa"
+			hpa.Namespace = metav1.NamespaceDefault
+			hpa.Spec.ScaleTargetRef = autoscalingv2.CrossVersionObjectReference{
+				Kind:       controllers.DeploymentStr,
+				Name:       deploymentName,
+				APIVersion: "apps/v1",
+			}
+			hpa.Spec.MaxReplicas = 4
+			hpa.Spec.Metrics = []autoscalingv2.MetricSpec{{
+				Type: autoscalingv2.ResourceMetricSourceType,
+				Resource: &autoscalingv2.ResourceMetricSource{
+					Name: corev1.ResourceCPU,
+					Target: autoscalingv2.MetricTarget{
+						Type:               autoscalingv2.UtilizationMetricType,
+						AverageUtilization: ptr.To[int32](80),
+					},
+				},
+			}}
+			Expect(k8sClient.Create(context.Background(), hpa)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(k8sClient.Delete(context.Background(), hpa)).To(Succeed())
+			deleteVpa("test-deployment-deployment")
+			Expect(k8sClient.Delete(context.Background(), deployment)).To(Succeed())
+		})
+
+		It("removes cpu from the controlled resources", func() {
+			Eventually(func(g Gomega) []corev1.ResourceName {
+				var vpa vpav1.VerticalPodAutoscaler
+				g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+					Name:      "test-deployment-deployment",
+					Namespace: metav1.NamespaceDefault,
+				}, &vpa)).To(Succeed())
+				g.Expect(vpa.Spec.ResourcePolicy).ToNot(BeNil())
+				g.Expect(vpa.Spec.ResourcePolicy.ContainerPolicies).ToNot(BeEmpty())
+				return *vpa.Spec.ResourcePolicy.ContainerPolicies[0].ControlledResources
+			}).Should(Equal([]corev1.ResourceName{corev1.ResourceMemory}))
+		})
+
+		It("emits an event explaining the decision", func() {
+			Eventually(func(g Gomega) []string {
+				var events eventsv1.EventList
+				g.Expect(k8sClient.List(context.Background(), &events, client.InNamespace(metav1.NamespaceDefault))).To(Succeed())
+				reasons := make([]string, 0)
+				for _, event := range events.Items {
+					if event.Regarding.Name == "test-deployment-deployment" {
+						reasons = append(reasons, event.Reason)
+					}
+				}
+				return reasons
+			}).Should(ContainElement("HpaConflict"))
+			Eventually(func() []string {
+				onWorkload, _ := workloadEventReasons(deployment.UID)
+				return onWorkload
+			}).Should(ContainElement("HpaConflict"))
+		})
+
+		It("restores the controlled resources once the hpa is removed", func() {
+			Expect(k8sClient.Delete(context.Background(), hpa)).To(Succeed())
+			Eventually(func(g Gomega) []corev1.ResourceName {
+				var vpa vpav1.VerticalPodAutoscaler
+				g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+					Name:      "test-deployment-deployment",
+					Namespace: metav1.NamespaceDefault,
+				}, &vpa)).To(Succeed())
+				g.Expect(vpa.Spec.ResourcePolicy).ToNot(BeNil())
+				g.Expect(vpa.Spec.ResourcePolicy.ContainerPolicies).ToNot(BeEmpty())
+				return *vpa.Spec.ResourcePolicy.ContainerPolicies[0].ControlledResources
+			}).Should(Equal([]corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}))
+			// recreate for the AfterEach
+			hpa.ResourceVersion = ""
+			Expect(k8sClient.Create(context.Background(), hpa)).To(Succeed())
+		})
 	})
 
 	When("reconciling a vpa", func() {
@@ -5,167 +5,458 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/events"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/sapcc/vpa_butler/internal/common"
 	"github.com/sapcc/vpa_butler/internal/filter"
+	"github.com/sapcc/vpa_butler/internal/metrics"
+	"github.com/sapcc/vpa_butler/internal/platform"
 )
 
-const scaleDivisor int64 = 100
+const (
+	scaleDivisor int64 = 100
+	// vpaRunnableWorkers is the amount of served vpas reconciled concurrently.
+	vpaRunnableWorkers = 4
+)
 
 // VpaRunnable is responsible for setting the maximum allowed resources
-// of a served Vpa. As all served Vpas have to evaluated against all nodes
-// we fetch the Vpas, their target and the nodes only once.
+// of a served Vpa. Changes to nodes, workloads and served Vpas enqueue
+// the affected served Vpas, which are then reconciled by a pool of workers.
+// All served Vpas are enqueued once per Period as a safety net.
 type VpaRunnable struct {
 	client.Client
+	// Cache provides the informers, whose events enqueue served Vpas.
+	Cache           cache.Cache
 	Period          time.Duration
 	JitterFactor    float64
 	CapacityPercent int64
-	Log             logr.Logger
+	// DistributionMode is the default for targets not annotated otherwise.
+	DistributionMode DistributionMode
+	// ReferenceNodeStrategy and ReferenceNodePercentile are the defaults for targets not annotated otherwise.
+	ReferenceNodeStrategy   ReferenceNodeStrategy
+	ReferenceNodePercentile int64
+	// NodeGracePeriod is how long a node needs to be unhealthy or a deletion
+	// candidate, before it is no longer considered for the maximum allowed resources.
+	NodeGracePeriod time.Duration
+	// NodeFilters are the names of the filters deciding on the viable nodes, nil enables the defaults.
+	NodeFilters      []string
+	NodePoolSelector labels.Selector
+	// NodeTemplates references a ConfigMap describing node pools, which may be scaled to zero.
+	NodeTemplates types.NamespacedName
+	// Platforms resolves the platforms of images for the Platform filter. It is not consulted, if nil.
+	Platforms   *platform.Resolver
+	CustomKinds []CustomKind
+	Log         logr.Logger
+	Recorder    events.EventRecorder
+	queue       workqueue.TypedRateLimitingInterface[queueItem]
+	// chain is built on start, while the explain handler may already serve requests
+	chain atomic.Pointer[filter.Chain]
+	// reasons holds why a queued item was enqueued first
+	reasons map[queueItem]string
+	// snapshots holds the states of queued nodes and DaemonSets seen by the event handlers,
+	// which are no longer in the cache, e.g. before an update or of deleted objects
+	snapshots map[queueItem][]client.Object
+	queuedMu  sync.Mutex
+	overhead  overheadCache
+}
+
+// itemKind distinguishes the objects queued by the VpaRunnable.
+type itemKind int
+
+const (
+	// itemVpa is a served vpa, whose maximum allowed resources are reconciled.
+	itemVpa itemKind = iota
+	// itemNode is a changed node, whose served vpas are enqueued.
+	itemNode
+	// itemDaemonSet is a changed DaemonSet, whose overhead affects the served vpas on its nodes.
+	itemDaemonSet
+	// itemImage is an image, whose platforms were resolved, named by the key.
+	itemImage
+)
+
+// queueItem is a served vpa, a changed node or DaemonSet or a resolved image. The served vpas affected by a change
+// are determined by the workers, as evaluating all of them would block the informers otherwise.
+type queueItem struct {
+	kind itemKind
+	key  types.NamespacedName
 }
 
 func (v *VpaRunnable) Start(ctx context.Context) error {
-	wait.JitterUntilWithContext(ctx, v.reconcile, v.Period, v.JitterFactor, false)
+	if err := v.buildChain(); err != nil {
+		return err
+	}
+	v.reasons = make(map[queueItem]string)
+	v.snapshots = make(map[queueItem][]client.Object)
+	v.queue = workqueue.NewTypedRateLimitingQueueWithConfig(
+		workqueue.DefaultTypedControllerRateLimiter[queueItem](),
+		workqueue.TypedRateLimitingQueueConfig[queueItem]{Name: "vpa-runnable"},
+	)
+	go func() {
+		<-ctx.Done()
+		v.queue.ShutDown()
+	}()
+	if err := v.registerEventHandlers(ctx); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	if v.Platforms != nil {
+		v.Platforms.OnResolved = func(image string) {
+			v.enqueueChange(imageItem(image), changeReasonImageResolved)
+		}
+		wg.Go(func() { v.Platforms.Run(ctx) })
+	}
+	for range vpaRunnableWorkers {
+		wg.Go(func() {
+			for v.processNextItem(ctx) {
+			}
+		})
+	}
+	resync := func(ctx context.Context) { v.enqueueAll(ctx, changeReasonResync) }
+	wait.JitterUntilWithContext(ctx, resync, v.Period, v.JitterFactor, false)
+	wg.Wait()
 	return nil
 }
 
-func (v *VpaRunnable) reconcile(ctx context.Context) {
-	var nodes corev1.NodeList
-	err := v.List(ctx, &nodes)
+// NeedLeaderElection makes the manager start the VpaRunnable only on the leader,
+// as replicas setting the maximum allowed resources concurrently would patch served vpas twice.
+func (v *VpaRunnable) NeedLeaderElection() bool {
+	return true
+}
+
+// filterNames returns the names of the configured node filters.
+func (v *VpaRunnable) filterNames() []string {
+	if v.NodeFilters == nil {
+		return filter.DefaultFilters
+	}
+	return v.NodeFilters
+}
+
+// buildChain builds the chain of the configured node filters.
+func (v *VpaRunnable) buildChain() error {
+	chain, err := filter.NewChain(v.filterNames(), filter.Config{
+		GracePeriod:      v.NodeGracePeriod,
+		NodePoolSelector: v.NodePoolSelector,
+	})
 	if err != nil {
-		v.Log.Error(err, "failed to list nodes to determine maximum allowed resources")
-		return
+		return err
 	}
+	v.chain.Store(chain)
+	return nil
+}
+
+func (v *VpaRunnable) processNextItem(ctx context.Context) bool {
+	item, shutdown := v.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer v.queue.Done(item)
+	reason := v.popReason(item)
+	switch item.kind {
+	case itemNode:
+		v.enqueueForNodes(ctx, reason, v.changedNodes(ctx, item)...)
+	case itemDaemonSet:
+		v.enqueueForDaemonSets(ctx, v.changedDaemonSets(ctx, item)...)
+	case itemImage:
+		v.enqueueForImage(ctx, reason, item.key.Name)
+	default:
+		if err := v.reconcile(ctx, item.key, reason); err != nil {
+			v.Log.Error(err, "failed to set maximum allowed resources for vpa",
+				"namespace", item.key.Namespace, "name", item.key.Name)
+			v.storeReason(item, reason)
+			v.queue.AddRateLimited(item)
+			return true
+		}
+	}
+	v.queue.Forget(item)
+	return true
+}
+
+// enqueue adds the vpa to the queue. The reason is reported, when the maximum allowed resources change.
+func (v *VpaRunnable) enqueue(key types.NamespacedName, reason string) {
+	item := queueItem{kind: itemVpa, key: key}
+	v.storeReason(item, reason)
+	v.queue.Add(item)
+}
+
+// enqueueChange adds the changed node or DaemonSet to the queue
+// along with states of it, which are no longer in the cache.
+func (v *VpaRunnable) enqueueChange(item queueItem, reason string, snapshots ...client.Object) {
+	v.storeReason(item, reason)
+	v.queuedMu.Lock()
+	v.snapshots[item] = append(v.snapshots[item], snapshots...)
+	v.queuedMu.Unlock()
+	v.queue.Add(item)
+}
+
+func (v *VpaRunnable) storeReason(item queueItem, reason string) {
+	v.queuedMu.Lock()
+	defer v.queuedMu.Unlock()
+	if _, ok := v.reasons[item]; !ok {
+		v.reasons[item] = reason
+	}
+}
+
+func (v *VpaRunnable) popReason(item queueItem) string {
+	v.queuedMu.Lock()
+	defer v.queuedMu.Unlock()
+	reason, ok := v.reasons[item]
+	if !ok && item.kind == itemNode {
+		// nodes are queued without reason, once their grace period passed
+		return changeReasonNodeChanged
+	}
+	if !ok {
+		return changeReasonResync
+	}
+	delete(v.reasons, item)
+	return reason
+}
+
+func (v *VpaRunnable) popSnapshots(item queueItem) []client.Object {
+	v.queuedMu.Lock()
+	defer v.queuedMu.Unlock()
+	snapshots := v.snapshots[item]
+	delete(v.snapshots, item)
+	return snapshots
+}
+
+// enqueueAll enqueues all served vpas.
+func (v *VpaRunnable) enqueueAll(ctx context.Context, reason string) {
+	v.enqueueServed(ctx, reason, func(*vpav1.VerticalPodAutoscaler) bool { return true })
+}
+
+// enqueueServed enqueues the served vpas passing the given predicate.
+func (v *VpaRunnable) enqueueServed(ctx context.Context, reason string, pred func(vpa *vpav1.VerticalPodAutoscaler) bool,
+	opts ...client.ListOption) {
+
 	var vpas vpav1.VerticalPodAutoscalerList
-	err = v.List(ctx, &vpas)
-	if err != nil {
+	if err := v.List(ctx, &vpas, opts...); err != nil {
 		v.Log.Error(err, "failed to list vpas to determine maximum allowed resources")
 		return
 	}
-	targetedVpas := make([]filter.TargetedVpa, 0)
 	for i := range vpas.Items {
-		current := vpas.Items[i]
-		if common.ManagedByButler(&current) {
-			targeted, err := v.extractTarget(ctx, &current)
-			if err != nil {
-				v.Log.Error(err, "failed to extract target")
-				continue
-			}
-			targetedVpas = append(targetedVpas, targeted)
+		vpa := &vpas.Items[i]
+		if common.ManagedByButler(vpa) && pred(vpa) {
+			v.enqueue(client.ObjectKeyFromObject(vpa), reason)
 		}
 	}
-	schedulable := filter.Schedulable(nodes.Items)
-	for _, target := range targetedVpas {
-		v.reconcileMaxResource(ctx, target, schedulable)
+}
+
+func (v *VpaRunnable) reconcile(ctx context.Context, key types.NamespacedName, reason string) error {
+	var vpa vpav1.VerticalPodAutoscaler
+	if err := v.Get(ctx, key, &vpa); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !common.ManagedByButler(&vpa) {
+		return nil
+	}
+	// the VpaController did not configure the vpa yet,
+	// which enqueues it again by updating its spec
+	if vpa.Spec.ResourcePolicy == nil || len(vpa.Spec.ResourcePolicy.ContainerPolicies) == 0 {
+		return nil
+	}
+	target, err := v.extractTarget(ctx, &vpa)
+	if err != nil {
+		return err
+	}
+	schedulable, err := v.schedulableNodes(ctx)
+	if err != nil {
+		return err
 	}
+	return v.reconcileMaxResource(ctx, target, schedulable, reason)
+}
+
+// schedulableNodes returns the schedulable nodes including the node templates.
+func (v *VpaRunnable) schedulableNodes(ctx context.Context) ([]corev1.Node, error) {
+	var nodes corev1.NodeList
+	// the nodes are only read, so copying them from the cache is not required
+	if err := v.List(ctx, &nodes, client.UnsafeDisableDeepCopy); err != nil {
+		return nil, fmt.Errorf("failed to list nodes to determine maximum allowed resources: %w", err)
+	}
+	templates, err := v.nodeTemplates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return filter.Schedulable(slices.Concat(nodes.Items, templates)), nil
 }
 
 func (v *VpaRunnable) extractTarget(ctx context.Context, vpa *vpav1.VerticalPodAutoscaler) (filter.TargetedVpa, error) {
 	if vpa.Spec.TargetRef == nil {
 		return filter.TargetedVpa{}, fmt.Errorf("vpa %s/%s has nil target ref", vpa.Namespace, vpa.Name)
 	}
-	ref := *vpa.Spec.TargetRef
+	ref := vpa.Spec.TargetRef
+	obj, err := v.newTarget(ref)
+	if err != nil {
+		return filter.TargetedVpa{}, fmt.Errorf("%w for vpa %s/%s", err, vpa.Namespace, vpa.Name)
+	}
+	err = v.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: vpa.Namespace}, obj)
+	if err != nil {
+		return filter.TargetedVpa{}, fmt.Errorf("failed to fetch target %s/%s of kind %s for vpa",
+			vpa.Namespace, ref.Name, ref.Kind)
+	}
+	target, err := v.describeTarget(obj)
+	if err != nil {
+		return filter.TargetedVpa{}, err
+	}
+	target.Vpa = vpa
+	return target, nil
+}
+
+// newTarget returns an empty object of the referenced kind.
+func (v *VpaRunnable) newTarget(ref *autoscalingv1.CrossVersionObjectReference) (client.Object, error) {
 	switch ref.Kind {
 	case DeploymentStr:
-		var deployment appsv1.Deployment
-		err := v.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: vpa.Namespace}, &deployment)
-		if err != nil {
-			return filter.TargetedVpa{}, fmt.Errorf("failed to fetch target %s/%s of kind %s for vpa",
-				vpa.Namespace, ref.Name, ref.Kind)
-		}
+		return &appsv1.Deployment{}, nil
+	case StatefulSetStr:
+		return &appsv1.StatefulSet{}, nil
+	case DaemonSetStr:
+		return &appsv1.DaemonSet{}, nil
+	case CronJobStr:
+		return &batchv1.CronJob{}, nil
+	case JobStr:
+		return &batchv1.Job{}, nil
+	}
+	if kind, ok := findCustomKind(v.CustomKinds, ref); ok {
+		return kind.newObject(), nil
+	}
+	return nil, fmt.Errorf("unknown target kind %s encountered", ref.Kind)
+}
+
+// describeTarget extracts the parts of a workload relevant for
+// determining the maximum allowed resources. The Vpa is left empty.
+func (v *VpaRunnable) describeTarget(obj client.Object) (filter.TargetedVpa, error) {
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
 		return filter.TargetedVpa{
 			Type:       filter.TargetDeployment,
-			Vpa:        vpa,
-			PodSpec:    deployment.Spec.Template.Spec,
-			Selector:   *deployment.Spec.Selector,
-			ObjectMeta: deployment.ObjectMeta,
+			PodSpec:    workload.Spec.Template.Spec,
+			Selector:   ptr.Deref(workload.Spec.Selector, metav1.LabelSelector{}),
+			ObjectMeta: workload.ObjectMeta,
 		}, nil
-	case StatefulSetStr:
-		var sts appsv1.StatefulSet
-		err := v.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: vpa.Namespace}, &sts)
-		if err != nil {
-			return filter.TargetedVpa{}, fmt.Errorf("failed to fetch target %s/%s of kind %s for vpa",
-				vpa.Namespace, ref.Name, ref.Kind)
-		}
+	case *appsv1.StatefulSet:
 		return filter.TargetedVpa{
 			Type:       filter.TargetStatefulSet,
-			Vpa:        vpa,
-			PodSpec:    sts.Spec.Template.Spec,
-			Selector:   *sts.Spec.Selector,
-			ObjectMeta: sts.ObjectMeta,
+			PodSpec:    workload.Spec.Template.Spec,
+			Selector:   ptr.Deref(workload.Spec.Selector, metav1.LabelSelector{}),
+			ObjectMeta: workload.ObjectMeta,
 		}, nil
-	case DaemonSetStr:
-		var ds appsv1.DaemonSet
-		err := v.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: vpa.Namespace}, &ds)
-		if err != nil {
-			return filter.TargetedVpa{}, fmt.Errorf("failed to fetch target %s/%s of kind %s for vpa",
-				vpa.Namespace, ref.Name, ref.Kind)
-		}
+	case *appsv1.DaemonSet:
 		return filter.TargetedVpa{
 			Type:       filter.TargetDaemonSet,
-			Vpa:        vpa,
-			PodSpec:    ds.Spec.Template.Spec,
-			Selector:   *ds.Spec.Selector,
-			ObjectMeta: ds.ObjectMeta,
+			PodSpec:    workload.Spec.Template.Spec,
+			Selector:   ptr.Deref(workload.Spec.Selector, metav1.LabelSelector{}),
+			ObjectMeta: workload.ObjectMeta,
+		}, nil
+	case *batchv1.CronJob:
+		jobSpec := workload.Spec.JobTemplate.Spec
+		return filter.TargetedVpa{
+			Type:       filter.TargetCronJob,
+			PodSpec:    jobSpec.Template.Spec,
+			Selector:   ptr.Deref(jobSpec.Selector, metav1.LabelSelector{}),
+			ObjectMeta: workload.ObjectMeta,
+		}, nil
+	case *batchv1.Job:
+		return filter.TargetedVpa{
+			Type:       filter.TargetJob,
+			PodSpec:    workload.Spec.Template.Spec,
+			Selector:   ptr.Deref(workload.Spec.Selector, metav1.LabelSelector{}),
+			ObjectMeta: workload.ObjectMeta,
 		}, nil
+	case *unstructured.Unstructured:
+		ref := &autoscalingv1.CrossVersionObjectReference{Kind: workload.GetKind(), APIVersion: workload.GetAPIVersion()}
+		if kind, ok := findCustomKind(v.CustomKinds, ref); ok {
+			return v.describeCustomTarget(workload, kind)
+		}
 	}
-	return filter.TargetedVpa{}, fmt.Errorf("unknown target kind %s for vpa %s/%s encountered",
-		ref.Kind, vpa.Namespace, vpa.Name)
+	return filter.TargetedVpa{}, fmt.Errorf("unknown target %T %s/%s encountered", obj, obj.GetNamespace(), obj.GetName())
 }
 
-func (v *VpaRunnable) reconcileMaxResource(ctx context.Context, target filter.TargetedVpa, schedulable []corev1.Node) {
-	viable, err := filter.Evaluate(target, schedulable)
+func (v *VpaRunnable) describeCustomTarget(obj *unstructured.Unstructured, kind CustomKind) (filter.TargetedVpa, error) {
+	template, err := kind.podTemplate(obj)
 	if err != nil {
-		v.Log.Error(err, "failed to determine valid nodes", "namespace", target.Vpa.Namespace, "name", target.Vpa.Name)
-		return
+		return filter.TargetedVpa{}, err
 	}
-	if len(viable) == 0 {
-		v.Log.Error(err, "no valid nodes for vpa target found", "namespace", target.Vpa.Namespace, "name", target.Vpa.Name)
-		return
+	selector, err := kind.selector(obj)
+	if err != nil {
+		return filter.TargetedVpa{}, err
 	}
-	distributionFunc := uniformDistribution
-	if target.ObjectMeta.Annotations != nil && len(target.PodSpec.Containers) > 1 {
-		if mainContainer, ok := target.ObjectMeta.Annotations[MainContainerAnnotationKey]; ok {
-			distributionFunc = asymmetricDistribution(mainContainer)
+	return filter.TargetedVpa{
+		Type:       filter.TargetCustom,
+		PodSpec:    template.Spec,
+		Selector:   selector,
+		ObjectMeta: objectMeta(obj),
+	}, nil
+}
+
+func (v *VpaRunnable) reconcileMaxResource(ctx context.Context, target filter.TargetedVpa,
+	schedulable []corev1.Node, reason string) error {
+
+	decision, err := v.decide(ctx, target, schedulable)
+	if err != nil {
+		return err
+	}
+	if log := v.Log.V(1); log.Enabled() {
+		removed := make([]any, 0, 2*len(decision.steps))
+		for _, step := range decision.steps {
+			removed = append(removed, step.Filter, len(step.Removed))
 		}
+		log.Info("Filtered nodes", append([]any{"namespace", target.Vpa.Namespace, "name", target.Vpa.Name,
+			"nodes", len(schedulable), "viable", len(decision.viable)}, removed...)...)
 	}
-	var largest corev1.Node
-	// DaemonSets needs to fit onto all nodes their pods can be placed on.
-	// Therefore the smallest of them is used to derive an upper recommendation
-	// bound. Other payloads usually create less pods.
-	if target.Type == filter.TargetDaemonSet {
-		largest = minByMemory(viable)
-	} else {
-		largest = maxByMemory(viable)
-	}
-	err = v.patchMaxResources(ctx, patchParams{
-		vpa: target.Vpa,
-		namedResources: distributionFunc(resourceDistributionParams{
-			target:          target,
-			largest:         &largest,
-			capacityPercent: v.CapacityPercent,
-		}),
-	})
-	if err != nil {
-		v.Log.Error(err, "failed to set maximum allowed resources for vpa",
-			"name", target.Vpa.Name, "namespace", target.Vpa.Namespace)
-		return
+	workload := workloadReference(target)
+	for _, w := range decision.warnings {
+		v.Log.Info(w.note, "namespace", target.Vpa.Namespace, "name", target.Vpa.Name)
+		recordVpaEvent(v.Recorder, target.Vpa, workload, corev1.EventTypeWarning, w.reason, w.action, "%s", w.note)
+	}
+	if skipped := decision.skipped; skipped != nil {
+		// node events enqueue the vpa again, once nodes become viable
+		v.Log.Info(skipped.note, "namespace", target.Vpa.Namespace, "name", target.Vpa.Name,
+			"nodes", decision.reference.nodes)
+		recordVpaEvent(v.Recorder, target.Vpa, workload, corev1.EventTypeWarning, skipped.reason, skipped.action,
+			"Not updating maximum allowed resources: %s", skipped.note)
+		return nil
 	}
+	return v.patchMaxResources(ctx, patchParams{
+		vpa:            target.Vpa,
+		workload:       workload,
+		reason:         reason,
+		templates:      decision.reference.templates,
+		namedResources: decision.namedResources,
+	})
 }
 
 type patchParams struct {
 	vpa            *vpav1.VerticalPodAutoscaler
+	workload       runtime.Object
 	namedResources []common.NamedResourceList
+	// reason describes why the maximum allowed resources are reconciled
+	reason string
+	// templates are the node templates providing the reference resources
+	templates []string
 }
 
 func (v *VpaRunnable) patchMaxResources(ctx context.Context, params patchParams) error {
@@ -189,88 +480,60 @@ func (v *VpaRunnable) patchMaxResources(ctx context.Context, params patchParams)
 			ControlledValues:    controlledValues,
 		}
 	}
+	template := strings.Join(params.templates, ",")
+	if equality.Semantic.DeepEqual(unmodified.Spec.ResourcePolicy.ContainerPolicies, policies) &&
+		vpa.Annotations[NodeTemplateAnnotationKey] == template {
+		return nil
+	}
 	vpa.Spec.ResourcePolicy.ContainerPolicies = policies
-	return v.Patch(ctx, vpa, client.MergeFrom(unmodified))
-}
-
-func maxByMemory(nodes []corev1.Node) corev1.Node {
-	var maxNode corev1.Node
-	for _, node := range nodes {
-		if node.Status.Allocatable.Memory().Cmp(*maxNode.Status.Allocatable.Memory()) == 1 {
-			maxNode = node
+	// the container policies are an atomic list, so they are applied as a whole
+	applied := &vpav1.VerticalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: vpa.Name, Namespace: vpa.Namespace, ResourceVersion: vpa.ResourceVersion},
+		Spec: vpav1.VerticalPodAutoscalerSpec{
+			ResourcePolicy: &vpav1.PodResourcePolicy{ContainerPolicies: policies},
+		},
+	}
+	if template == "" {
+		delete(vpa.Annotations, NodeTemplateAnnotationKey)
+	} else {
+		if vpa.Annotations == nil {
+			vpa.Annotations = make(map[string]string)
 		}
+		vpa.Annotations[NodeTemplateAnnotationKey] = template
+		applied.Annotations = map[string]string{NodeTemplateAnnotationKey: template}
 	}
-	return maxNode
-}
-
-func minByMemory(nodes []corev1.Node) corev1.Node {
-	var minNode corev1.Node
-	minNode.Status.Allocatable = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Ti")}
-	for _, node := range nodes {
-		if node.Status.Allocatable.Memory().Cmp(*minNode.Status.Allocatable.Memory()) == -1 {
-			minNode = node
+	if err := applyVpa(ctx, v.Client, applied, FieldManagerCapacity); err != nil {
+		var conflictErr *FieldManagerConflictError
+		if errors.As(err, &conflictErr) {
+			// retrying does not help until the other field manager releases the container policies
+			recordVpaEvent(v.Recorder, vpa, params.workload, corev1.EventTypeWarning, reasonFieldManagerConflict,
+				"UpdateMaxAllowed", "Maximum allowed resources are owned by %s", strings.Join(conflictErr.Managers, ","))
+			return nil
 		}
+		return err
 	}
-	return minNode
-}
-
-func scaleQuantityMilli(q *resource.Quantity, percent int64) *resource.Quantity {
-	return resource.NewMilliQuantity(q.MilliValue()*percent/scaleDivisor, q.Format)
-}
-
-func scaleQuantity(q *resource.Quantity, percent int64) *resource.Quantity {
-	return resource.NewQuantity(q.Value()*percent/scaleDivisor, q.Format)
-}
-
-type resourceDistributionParams struct {
-	target          filter.TargetedVpa
-	largest         *corev1.Node
-	capacityPercent int64
+	before := formatMaxAllowed(unmodified.Spec.ResourcePolicy.ContainerPolicies)
+	after := formatMaxAllowed(policies)
+	v.Log.Info("Changed maximum allowed resources", "namespace", vpa.Namespace, "name", vpa.Name,
+		"before", before, "after", after, "reason", params.reason)
+	metrics.RecordMaxAllowedChange(params.reason)
+	recordVpaEvent(v.Recorder, vpa, params.workload, corev1.EventTypeNormal, reasonMaxAllowedChanged, "UpdateMaxAllowed",
+		"Changed maximum allowed resources from %s to %s due to %s", before, after, params.reason)
+	return nil
 }
 
-type maxResourceDistributionFunc func(params resourceDistributionParams) []common.NamedResourceList
-
-func uniformDistribution(params resourceDistributionParams) []common.NamedResourceList {
-	containers := int64(len(params.target.PodSpec.Containers))
-	// distribute a fraction of maximum capacity evenly across containers
-	cpuScaled := scaleQuantityMilli(params.largest.Status.Allocatable.Cpu(), params.capacityPercent/containers)
-	memScaled := scaleQuantity(params.largest.Status.Allocatable.Memory(), params.capacityPercent/containers)
-	return []common.NamedResourceList{
-		{
-			ContainerName: "*",
-			Resources: corev1.ResourceList{
-				corev1.ResourceCPU:    *cpuScaled,
-				corev1.ResourceMemory: *memScaled,
-			},
-		},
+// formatMaxAllowed renders the maximum allowed resources of the container policies in a compact way.
+func formatMaxAllowed(policies []vpav1.ContainerResourcePolicy) string {
+	if len(policies) == 0 {
+		return "none"
 	}
-}
-
-func asymmetricDistribution(mainContainer string) maxResourceDistributionFunc {
-	return func(params resourceDistributionParams) []common.NamedResourceList {
-		totalFraction, mainFraction := 4, 3
-		containers := params.target.PodSpec.Containers
-		totalWeight := int64(totalFraction * (len(containers) - 1))
-		mainWeight := int64(mainFraction * (len(containers) - 1))
-		cpuMain := scaleQuantityMilli(params.largest.Status.Allocatable.Cpu(), params.capacityPercent*mainWeight/totalWeight)
-		memMain := scaleQuantity(params.largest.Status.Allocatable.Memory(), params.capacityPercent*mainWeight/totalWeight)
-		cpuOther := scaleQuantityMilli(params.largest.Status.Allocatable.Cpu(), params.capacityPercent/totalWeight)
-		memOther := scaleQuantity(params.largest.Status.Allocatable.Memory(), params.capacityPercent/totalWeight)
-		return []common.NamedResourceList{
-			{
-				ContainerName: mainContainer,
-				Resources: corev1.ResourceList{
-					corev1.ResourceCPU:    *cpuMain,
-					corev1.ResourceMemory: *memMain,
-				},
-			},
-			{
-				ContainerName: "*",
-				Resources: corev1.ResourceList{
-					corev1.ResourceCPU:    *cpuOther,
-					corev1.ResourceMemory: *memOther,
-				},
-			},
+	formatted := make([]string, len(policies))
+	for i, policy := range policies {
+		resources := "unbounded"
+		if len(policy.MaxAllowed) > 0 {
+			resources = "cpu=" + policy.MaxAllowed.Cpu().String() + ",memory=" + policy.MaxAllowed.Memory().String()
 		}
+		formatted[i] = policy.ContainerName + "[" + resources + "]"
 	}
+	return strings.Join(formatted, " ")
 }
@@ -0,0 +1,495 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/sapcc/vpa_butler/api/v1alpha1"
+	"github.com/sapcc/vpa_butler/internal/common"
+	"github.com/sapcc/vpa_butler/internal/filter"
+)
+
+const (
+	reasonMaxAllowedChanged   = "MaxAllowedChanged"
+	reasonNoValidNodes        = "NoValidNodes"
+	reasonPodOverheadExceeded = "PodOverheadExceeded"
+
+	// reasons for reconciling the maximum allowed resources of a served vpa
+	changeReasonResync                = "Resync"
+	changeReasonNodeAdded             = "NodeAdded"
+	changeReasonNodeRemoved           = "NodeRemoved"
+	changeReasonNodeChanged           = "NodeChanged"
+	changeReasonVpaChanged            = "VpaChanged"
+	changeReasonRecommendationChanged = "RecommendationChanged"
+	changeReasonWorkloadChanged       = "WorkloadChanged"
+	changeReasonAnnotationChanged     = "AnnotationChanged"
+	changeReasonPolicyChanged         = "PolicyChanged"
+	changeReasonDaemonSetChanged      = "DaemonSetChanged"
+	changeReasonTemplatesChanged      = "NodeTemplatesChanged"
+	changeReasonImageResolved         = "ImageResolved"
+)
+
+// registerEventHandlers enqueues the served vpas affected by changes
+// to nodes, node templates, workloads, daemonset overhead, vpas, namespaces and butler policies.
+// Changed nodes and DaemonSets are queued themselves and resolved to served vpas by the workers.
+func (v *VpaRunnable) registerEventHandlers(ctx context.Context) error {
+	if v.Cache == nil {
+		return errors.New("vpa runnable requires a cache to watch for changes")
+	}
+	type registration struct {
+		obj     client.Object
+		handler toolscache.ResourceEventHandler
+	}
+	registrations := []registration{
+		{obj: &corev1.Node{}, handler: v.nodeHandler()},
+		{obj: &vpav1.VerticalPodAutoscaler{}, handler: v.vpaHandler()},
+		{obj: &corev1.Namespace{}, handler: v.namespaceHandler(ctx)},
+		{obj: &v1alpha1.ButlerPolicy{}, handler: v.policyHandler(ctx)},
+		{obj: &appsv1.Deployment{}, handler: v.workloadHandler(DeploymentStr)},
+		{obj: &appsv1.StatefulSet{}, handler: v.workloadHandler(StatefulSetStr)},
+		{obj: &appsv1.DaemonSet{}, handler: v.workloadHandler(DaemonSetStr)},
+		{obj: &appsv1.DaemonSet{}, handler: v.daemonSetOverheadHandler()},
+		{obj: &batchv1.CronJob{}, handler: v.workloadHandler(CronJobStr)},
+		{obj: &batchv1.Job{}, handler: v.workloadHandler(JobStr)},
+	}
+	if v.NodeTemplates.Name != "" {
+		registrations = append(registrations, registration{obj: &corev1.ConfigMap{}, handler: v.nodeTemplatesHandler(ctx)})
+	}
+	for _, kind := range v.CustomKinds {
+		registrations = append(registrations, registration{obj: kind.newObject(), handler: v.workloadHandler(kind.Kind)})
+	}
+	for _, r := range registrations {
+		informer, err := v.Cache.GetInformer(ctx, r.obj)
+		if err != nil {
+			return fmt.Errorf("failed to get informer for %T: %w", r.obj, err)
+		}
+		if _, err := informer.AddEventHandler(r.handler); err != nil {
+			return fmt.Errorf("failed to add event handler for %T: %w", r.obj, err)
+		}
+	}
+	return nil
+}
+
+// nodeHandler queues the changed nodes keeping their previous states.
+func (v *VpaRunnable) nodeHandler() toolscache.ResourceEventHandler {
+	return toolscache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj any, isInInitialList bool) {
+			// the initial list is covered by enqueuing all served vpas on start
+			v.overhead.invalidate()
+			if node, ok := obj.(*corev1.Node); ok && !isInInitialList {
+				v.enqueueChange(nodeItem(node), changeReasonNodeAdded)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj any) {
+			before, ok := oldObj.(*corev1.Node)
+			if !ok {
+				return
+			}
+			after, ok := newObj.(*corev1.Node)
+			if !ok || !nodeChanged(before, after) {
+				return
+			}
+			v.overhead.invalidate()
+			v.enqueueChange(nodeItem(after), changeReasonNodeChanged, before)
+			// unhealthy nodes and deletion candidates are dropped once the grace period passed
+			if !slices.Contains(v.filterNames(), filter.NodeConditionsFilter) {
+				return
+			}
+			if remaining, pending := filter.GracePeriodRemaining(after, v.NodeGracePeriod, time.Now()); pending {
+				v.queue.AddAfter(nodeItem(after), remaining)
+			}
+		},
+		DeleteFunc: func(obj any) {
+			v.overhead.invalidate()
+			if node, ok := fromTombstone(obj).(*corev1.Node); ok {
+				v.enqueueChange(nodeItem(node), changeReasonNodeRemoved, node)
+			}
+		},
+	}
+}
+
+func nodeItem(node *corev1.Node) queueItem {
+	return queueItem{kind: itemNode, key: types.NamespacedName{Name: node.Name}}
+}
+
+// changedNodes returns the states of the queued node seen by the event handlers and its current state.
+func (v *VpaRunnable) changedNodes(ctx context.Context, item queueItem) []corev1.Node {
+	snapshots := v.popSnapshots(item)
+	nodes := make([]corev1.Node, 0, len(snapshots)+1)
+	for _, obj := range snapshots {
+		if node, ok := obj.(*corev1.Node); ok {
+			nodes = append(nodes, *node)
+		}
+	}
+	var current corev1.Node
+	if err := v.Get(ctx, item.key, &current); err != nil {
+		if !apierrors.IsNotFound(err) {
+			v.Log.Error(err, "failed to get changed node", "node", item.key.Name)
+		}
+		return nodes
+	}
+	return append(nodes, current)
+}
+
+// nodeChanged returns whether a node update can change the maximum allowed resources.
+func nodeChanged(before, after *corev1.Node) bool {
+	return !equality.Semantic.DeepEqual(before.Status.Allocatable, after.Status.Allocatable) ||
+		!maps.Equal(before.Labels, after.Labels) ||
+		!equality.Semantic.DeepEqual(before.Spec.Taints, after.Spec.Taints) ||
+		before.Spec.Unschedulable != after.Spec.Unschedulable ||
+		!maps.Equal(conditionStatuses(before), conditionStatuses(after)) ||
+		(before.DeletionTimestamp == nil) != (after.DeletionTimestamp == nil)
+}
+
+// conditionStatuses returns the status of each node condition ignoring heartbeats.
+func conditionStatuses(node *corev1.Node) map[corev1.NodeConditionType]corev1.ConditionStatus {
+	statuses := make(map[corev1.NodeConditionType]corev1.ConditionStatus, len(node.Status.Conditions))
+	for _, condition := range node.Status.Conditions {
+		statuses[condition.Type] = condition.Status
+	}
+	return statuses
+}
+
+// enqueueForNodes enqueues the served vpas, whose targets can be scheduled onto any of the nodes.
+func (v *VpaRunnable) enqueueForNodes(ctx context.Context, reason string, nodes ...corev1.Node) {
+	schedulable := filter.Schedulable(nodes)
+	if len(schedulable) == 0 {
+		return
+	}
+	// the decision's chain without resolving the platforms of images, which keeps a superset of its nodes
+	chain := v.chain.Load().Without(filter.PlatformFilter)
+	v.enqueueServed(ctx, reason, func(vpa *vpav1.VerticalPodAutoscaler) bool {
+		target, err := v.extractTarget(ctx, vpa)
+		if err != nil {
+			// let the reconciliation report the error
+			return true
+		}
+		viable, _, err := chain.Evaluate(target, schedulable)
+		return err != nil || len(viable) > 0
+	})
+}
+
+// daemonSetOverheadHandler enqueues the served vpas, whose targets share
+// nodes with a DaemonSet, when the overhead of that DaemonSet changes.
+func (v *VpaRunnable) daemonSetOverheadHandler() toolscache.ResourceEventHandler {
+	return toolscache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj any, isInInitialList bool) {
+			v.overhead.invalidate()
+			if ds, ok := obj.(*appsv1.DaemonSet); ok && !isInInitialList {
+				v.enqueueChange(daemonSetItem(ds), changeReasonDaemonSetChanged)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj any) {
+			before, ok := oldObj.(*appsv1.DaemonSet)
+			if !ok {
+				return
+			}
+			after, ok := newObj.(*appsv1.DaemonSet)
+			if !ok || !daemonSetOverheadChanged(before, after) {
+				return
+			}
+			v.overhead.invalidate()
+			v.enqueueChange(daemonSetItem(after), changeReasonDaemonSetChanged, before)
+		},
+		DeleteFunc: func(obj any) {
+			v.overhead.invalidate()
+			if ds, ok := fromTombstone(obj).(*appsv1.DaemonSet); ok {
+				v.enqueueChange(daemonSetItem(ds), changeReasonDaemonSetChanged, ds)
+			}
+		},
+	}
+}
+
+func daemonSetItem(ds *appsv1.DaemonSet) queueItem {
+	return queueItem{kind: itemDaemonSet, key: client.ObjectKeyFromObject(ds)}
+}
+
+// changedDaemonSets returns the states of the queued DaemonSet seen by the event handlers and its current state.
+func (v *VpaRunnable) changedDaemonSets(ctx context.Context, item queueItem) []*appsv1.DaemonSet {
+	snapshots := v.popSnapshots(item)
+	daemonSets := make([]*appsv1.DaemonSet, 0, len(snapshots)+1)
+	for _, obj := range snapshots {
+		if ds, ok := obj.(*appsv1.DaemonSet); ok {
+			daemonSets = append(daemonSets, ds)
+		}
+	}
+	var current appsv1.DaemonSet
+	if err := v.Get(ctx, item.key, &current); err != nil {
+		if !apierrors.IsNotFound(err) {
+			v.Log.Error(err, "failed to get changed daemonset", "namespace", item.key.Namespace, "name", item.key.Name)
+		}
+		return daemonSets
+	}
+	return append(daemonSets, &current)
+}
+
+// daemonSetOverheadChanged returns whether a DaemonSet update changes the
+// resources requested by its pods or the nodes they are placed on.
+func daemonSetOverheadChanged(before, after *appsv1.DaemonSet) bool {
+	beforeSpec, afterSpec := before.Spec.Template.Spec, after.Spec.Template.Spec
+	return !equality.Semantic.DeepEqual(podRequests(beforeSpec), podRequests(afterSpec)) ||
+		beforeSpec.NodeName != afterSpec.NodeName ||
+		!maps.Equal(beforeSpec.NodeSelector, afterSpec.NodeSelector) ||
+		!equality.Semantic.DeepEqual(beforeSpec.Affinity, afterSpec.Affinity) ||
+		!equality.Semantic.DeepEqual(beforeSpec.Tolerations, afterSpec.Tolerations)
+}
+
+// enqueueForDaemonSets enqueues the served vpas, whose targets can be scheduled
+// onto any of the nodes the pods of the DaemonSets are placed on.
+func (v *VpaRunnable) enqueueForDaemonSets(ctx context.Context, daemonSets ...*appsv1.DaemonSet) {
+	var nodes corev1.NodeList
+	if err := v.List(ctx, &nodes, client.UnsafeDisableDeepCopy); err != nil {
+		v.Log.Error(err, "failed to list nodes to enqueue vpas for daemonset change")
+		return
+	}
+	schedulable := filter.Schedulable(nodes.Items)
+	var landing []corev1.Node
+	for _, ds := range daemonSets {
+		dsNodes, err := daemonSetNodes(ds, schedulable)
+		if err != nil {
+			v.Log.Error(err, "failed to enqueue vpas for daemonset change")
+			continue
+		}
+		landing = append(landing, dsNodes...)
+	}
+	if len(landing) == 0 {
+		return
+	}
+	v.enqueueForNodes(ctx, changeReasonDaemonSetChanged, landing...)
+}
+
+// nodeTemplatesHandler enqueues all served vpas, when the node templates change.
+func (v *VpaRunnable) nodeTemplatesHandler(ctx context.Context) toolscache.ResourceEventHandler {
+	isNodeTemplates := func(obj any) bool {
+		configMap, ok := fromTombstone(obj).(*corev1.ConfigMap)
+		return ok && client.ObjectKeyFromObject(configMap) == v.NodeTemplates
+	}
+	return toolscache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj any, isInInitialList bool) {
+			if !isNodeTemplates(obj) {
+				return
+			}
+			v.overhead.invalidate()
+			if !isInInitialList {
+				v.enqueueAll(ctx, changeReasonTemplatesChanged)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj any) {
+			before, ok := oldObj.(*corev1.ConfigMap)
+			if !ok || !isNodeTemplates(newObj) {
+				return
+			}
+			if after, ok := newObj.(*corev1.ConfigMap); ok && !maps.Equal(before.Data, after.Data) {
+				v.overhead.invalidate()
+				v.enqueueAll(ctx, changeReasonTemplatesChanged)
+			}
+		},
+		DeleteFunc: func(obj any) {
+			if isNodeTemplates(obj) {
+				v.overhead.invalidate()
+				v.enqueueAll(ctx, changeReasonTemplatesChanged)
+			}
+		},
+	}
+}
+
+func (v *VpaRunnable) vpaHandler() toolscache.ResourceEventHandler {
+	return toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			if vpa, ok := obj.(*vpav1.VerticalPodAutoscaler); ok && common.ManagedByButler(vpa) {
+				v.enqueue(client.ObjectKeyFromObject(vpa), changeReasonVpaChanged)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj any) {
+			before, ok := oldObj.(*vpav1.VerticalPodAutoscaler)
+			if !ok {
+				return
+			}
+			after, ok := newObj.(*vpav1.VerticalPodAutoscaler)
+			if !ok || !common.ManagedByButler(after) {
+				return
+			}
+			if before.Generation != after.Generation || !maps.Equal(before.Annotations, after.Annotations) {
+				v.enqueue(client.ObjectKeyFromObject(after), changeReasonVpaChanged)
+				return
+			}
+			// the status does not bump the generation, but is distributed by the recommendation mode
+			if !equality.Semantic.DeepEqual(uncappedTargets(before), uncappedTargets(after)) {
+				v.enqueue(client.ObjectKeyFromObject(after), changeReasonRecommendationChanged)
+			}
+		},
+	}
+}
+
+// uncappedTargets returns the uncapped target recommendation of each container.
+func uncappedTargets(vpa *vpav1.VerticalPodAutoscaler) map[string]corev1.ResourceList {
+	if vpa.Status.Recommendation == nil {
+		return nil
+	}
+	targets := make(map[string]corev1.ResourceList, len(vpa.Status.Recommendation.ContainerRecommendations))
+	for _, recommendation := range vpa.Status.Recommendation.ContainerRecommendations {
+		targets[recommendation.ContainerName] = recommendation.UncappedTarget
+	}
+	return targets
+}
+
+func (v *VpaRunnable) namespaceHandler(ctx context.Context) toolscache.ResourceEventHandler {
+	changed := namespaceAnnotationsChanged()
+	return toolscache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj any) {
+			before, ok := oldObj.(*corev1.Namespace)
+			if !ok {
+				return
+			}
+			after, ok := newObj.(*corev1.Namespace)
+			if !ok || !changed.Update(event.UpdateEvent{ObjectOld: before, ObjectNew: after}) {
+				return
+			}
+			v.enqueueServed(ctx, changeReasonAnnotationChanged,
+				func(*vpav1.VerticalPodAutoscaler) bool { return true }, client.InNamespace(after.Name))
+		},
+	}
+}
+
+// policyHandler enqueues all served vpas, as a policy can apply to any of them.
+func (v *VpaRunnable) policyHandler(ctx context.Context) toolscache.ResourceEventHandler {
+	return toolscache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(_ any, isInInitialList bool) {
+			if !isInInitialList {
+				v.enqueueAll(ctx, changeReasonPolicyChanged)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj any) {
+			before, ok := oldObj.(*v1alpha1.ButlerPolicy)
+			if !ok {
+				return
+			}
+			after, ok := newObj.(*v1alpha1.ButlerPolicy)
+			if ok && before.Generation != after.Generation {
+				v.enqueueAll(ctx, changeReasonPolicyChanged)
+			}
+		},
+		DeleteFunc: func(any) {
+			v.enqueueAll(ctx, changeReasonPolicyChanged)
+		},
+	}
+}
+
+// workloadHandler enqueues the served vpa of a workload, whose
+// update can change the maximum allowed resources.
+func (v *VpaRunnable) workloadHandler(kind string) toolscache.ResourceEventHandler {
+	return toolscache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj any) {
+			before, ok := oldObj.(client.Object)
+			if !ok {
+				return
+			}
+			after, ok := newObj.(client.Object)
+			if !ok {
+				return
+			}
+			reason, changed := v.workloadChanged(before, after)
+			if changed {
+				v.enqueue(types.NamespacedName{Namespace: after.GetNamespace(), Name: vpaName(after.GetName(), kind)}, reason)
+			}
+		},
+	}
+}
+
+// schedulingInputs are the parts of a workload determining its maximum allowed resources.
+type schedulingInputs struct {
+	Annotations               map[string]string
+	Labels                    map[string]string
+	NodeName                  string
+	NodeSelector              map[string]string
+	Affinity                  *corev1.Affinity
+	Tolerations               []corev1.Toleration
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint
+	OS                        *corev1.PodOS
+	Overhead                  corev1.ResourceList
+	InitContainers            []containerInputs
+	Containers                []containerInputs
+}
+
+// containerInputs are the parts of a container read by the node filters and the distribution.
+type containerInputs struct {
+	Name          string
+	Image         string
+	Requests      corev1.ResourceList
+	RestartPolicy *corev1.ContainerRestartPolicy
+}
+
+// workloadChanged returns whether the scheduling inputs of the workload changed and why.
+func (v *VpaRunnable) workloadChanged(before, after client.Object) (string, bool) {
+	beforeTarget, err := v.describeTarget(before)
+	if err != nil {
+		return changeReasonWorkloadChanged, true
+	}
+	afterTarget, err := v.describeTarget(after)
+	if err != nil {
+		return changeReasonWorkloadChanged, true
+	}
+	beforeInputs, afterInputs := newSchedulingInputs(beforeTarget), newSchedulingInputs(afterTarget)
+	if equality.Semantic.DeepEqual(beforeInputs, afterInputs) {
+		return "", false
+	}
+	beforeInputs.Annotations, afterInputs.Annotations = nil, nil
+	if equality.Semantic.DeepEqual(beforeInputs, afterInputs) {
+		return changeReasonAnnotationChanged, true
+	}
+	return changeReasonWorkloadChanged, true
+}
+
+func newSchedulingInputs(target filter.TargetedVpa) schedulingInputs {
+	return schedulingInputs{
+		Annotations:               target.ObjectMeta.Annotations,
+		Labels:                    target.ObjectMeta.Labels,
+		NodeName:                  target.PodSpec.NodeName,
+		NodeSelector:              target.PodSpec.NodeSelector,
+		Affinity:                  target.PodSpec.Affinity,
+		Tolerations:               target.PodSpec.Tolerations,
+		TopologySpreadConstraints: target.PodSpec.TopologySpreadConstraints,
+		OS:                        target.PodSpec.OS,
+		Overhead:                  target.PodSpec.Overhead,
+		InitContainers:            newContainerInputs(target.PodSpec.InitContainers),
+		Containers:                newContainerInputs(target.PodSpec.Containers),
+	}
+}
+
+func newContainerInputs(containers []corev1.Container) []containerInputs {
+	result := make([]containerInputs, len(containers))
+	for i, container := range containers {
+		result[i] = containerInputs{
+			Name:          container.Name,
+			Image:         container.Image,
+			Requests:      container.Resources.Requests,
+			RestartPolicy: container.RestartPolicy,
+		}
+	}
+	return result
+}
+
+func fromTombstone(obj any) any {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package controllers_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+
+	"github.com/sapcc/vpa_butler/internal/controllers"
+)
+
+var _ = Describe("WorkloadChanged", func() {
+
+	var before *appsv1.Deployment
+
+	BeforeEach(func() {
+		before = makeDeployment(1)
+		before.Spec.Template.Spec.Containers[0].Image = "app:1"
+	})
+
+	DescribeTable("enqueues the served vpa when a scheduling input changes",
+		func(mutate func(spec *corev1.PodSpec)) {
+			after := before.DeepCopy()
+			mutate(&after.Spec.Template.Spec)
+			reason, changed := controllers.WorkloadChanged(&controllers.VpaRunnable{}, before, after)
+			Expect(changed).To(BeTrue())
+			Expect(reason).To(Equal("WorkloadChanged"))
+		},
+		Entry("init containers", func(spec *corev1.PodSpec) {
+			spec.InitContainers = []corev1.Container{{Name: "init"}}
+		}),
+		Entry("native sidecars", func(spec *corev1.PodSpec) {
+			spec.InitContainers = []corev1.Container{{Name: "sidecar"}}
+			before.Spec.Template.Spec.InitContainers = []corev1.Container{{Name: "sidecar"}}
+			spec.InitContainers[0].RestartPolicy = ptr.To(corev1.ContainerRestartPolicyAlways)
+		}),
+		Entry("pod overhead", func(spec *corev1.PodSpec) {
+			spec.Overhead = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")}
+		}),
+		Entry("topology spread constraints", func(spec *corev1.PodSpec) {
+			spec.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{{
+				MaxSkew:           1,
+				TopologyKey:       corev1.LabelTopologyZone,
+				WhenUnsatisfiable: corev1.DoNotSchedule,
+			}}
+		}),
+		Entry("operating system", func(spec *corev1.PodSpec) {
+			spec.OS = &corev1.PodOS{Name: corev1.Linux}
+		}),
+		Entry("images", func(spec *corev1.PodSpec) {
+			spec.Containers[0].Image = "app:2"
+		}),
+		Entry("resource requests", func(spec *corev1.PodSpec) {
+			spec.Containers[0].Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+		}),
+	)
+
+	It("does not enqueue the served vpa when other fields change", func() {
+		after := before.DeepCopy()
+		after.Spec.Replicas = ptr.To(int32(3))
+		after.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "DEBUG", Value: "true"}}
+		_, changed := controllers.WorkloadChanged(&controllers.VpaRunnable{}, before, after)
+		Expect(changed).To(BeFalse())
+	})
+})
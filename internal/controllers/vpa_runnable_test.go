@@ -5,22 +5,31 @@ package controllers_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	"github.com/sapcc/vpa_butler/api/v1alpha1"
 	"github.com/sapcc/vpa_butler/internal/common"
 	"github.com/sapcc/vpa_butler/internal/controllers"
 
 	appsv1 "k8s.io/api/apps/v1"
 	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
 	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/utils/ptr"
 )
 
 const (
@@ -63,6 +72,18 @@ func expectMaxResources(name, cpu, mem string) {
 	}).Should(Succeed())
 }
 
+func expectNodeTemplateAnnotation(name, template string) {
+	GinkgoHelper()
+	Eventually(func(g Gomega) string {
+		var vpa vpav1.VerticalPodAutoscaler
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+		}, &vpa)).To(Succeed())
+		return vpa.Annotations[controllers.NodeTemplateAnnotationKey]
+	}).Should(Equal(template))
+}
+
 var _ = Describe("VpaRunnable", func() {
 
 	var node *corev1.Node
@@ -89,6 +110,119 @@ var _ = Describe("VpaRunnable", func() {
 			expectMaxResources(deployVpaName, "900m", "1800")
 		})
 
+		It("updates maximum allocatable resources when the node changes", func() {
+			expectMaxResources(deployVpaName, "900m", "1800")
+			unmodified := node.DeepCopy()
+			node.Status.Allocatable = corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("2"),
+				corev1.ResourceMemory: resource.MustParse("4000"),
+			}
+			Expect(k8sClient.Status().Patch(context.Background(), node, client.MergeFrom(unmodified))).To(Succeed())
+			expectMaxResources(deployVpaName, "1800m", "3600")
+			Eventually(func(g Gomega) []string {
+				var events eventsv1.EventList
+				g.Expect(k8sClient.List(context.Background(), &events, client.InNamespace(metav1.NamespaceDefault))).To(Succeed())
+				notes := make([]string, 0)
+				for _, event := range events.Items {
+					if event.Regarding.Name == deployVpaName && event.Reason == "MaxAllowedChanged" {
+						notes = append(notes, event.Note)
+					}
+				}
+				return notes
+			}).Should(ContainElement(
+				Equal("Changed maximum allowed resources from *[cpu=900m,memory=1800] to *[cpu=1800m,memory=3600] due to NodeChanged"),
+			))
+		})
+
+		It("keeps the minimum and maximum allowed resources applied concurrently", func() {
+			expectMaxResources(deployVpaName, "900m", "1800")
+			butlerPolicy := &v1alpha1.ButlerPolicy{}
+			butlerPolicy.Name = "concurrent-policy"
+			butlerPolicy.Spec.NamespaceSelector = &metav1.LabelSelector{
+				MatchLabels: map[string]string{corev1.LabelMetadataName: metav1.NamespaceDefault},
+			}
+			butlerPolicy.Spec.Kinds = []string{controllers.DeploymentStr}
+			butlerPolicy.Spec.MinAllowed = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m")}
+			unmodified := node.DeepCopy()
+			node.Status.Allocatable = corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("2"),
+				corev1.ResourceMemory: resource.MustParse("4000"),
+			}
+			// the VpaController applies the minimum while the VpaRunnable applies the maximum
+			var wg sync.WaitGroup
+			wg.Go(func() {
+				defer GinkgoRecover()
+				Expect(k8sClient.Create(context.Background(), butlerPolicy)).To(Succeed())
+			})
+			wg.Go(func() {
+				defer GinkgoRecover()
+				Expect(k8sClient.Status().Patch(context.Background(), node, client.MergeFrom(unmodified))).To(Succeed())
+			})
+			wg.Wait()
+			DeferCleanup(func() {
+				Expect(k8sClient.Delete(context.Background(), butlerPolicy)).To(Succeed())
+			})
+			Eventually(func(g Gomega) {
+				var vpa vpav1.VerticalPodAutoscaler
+				g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+					Name:      deployVpaName,
+					Namespace: metav1.NamespaceDefault,
+				}, &vpa)).To(Succeed())
+				g.Expect(vpa.Spec.ResourcePolicy.ContainerPolicies).To(HaveLen(1))
+				policy := vpa.Spec.ResourcePolicy.ContainerPolicies[0]
+				g.Expect(policy.MinAllowed.Cpu().MilliValue()).To(BeEquivalentTo(200))
+				g.Expect(policy.MaxAllowed.Cpu().MilliValue()).To(BeEquivalentTo(1800))
+				g.Expect(policy.MaxAllowed.Memory().Value()).To(BeEquivalentTo(3600))
+			}).Should(Succeed())
+			Consistently(func(g Gomega) {
+				var vpa vpav1.VerticalPodAutoscaler
+				g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+					Name:      deployVpaName,
+					Namespace: metav1.NamespaceDefault,
+				}, &vpa)).To(Succeed())
+				policy := vpa.Spec.ResourcePolicy.ContainerPolicies[0]
+				g.Expect(policy.MinAllowed.Cpu().MilliValue()).To(BeEquivalentTo(200))
+				g.Expect(policy.MaxAllowed.Cpu().MilliValue()).To(BeEquivalentTo(1800))
+			}).Should(Succeed())
+		})
+
+		It("considers node templates", func() {
+			expectMaxResources(deployVpaName, "900m", "1800")
+			templates := &corev1.ConfigMap{}
+			templates.Name = nodeTemplatesName
+			templates.Namespace = metav1.NamespaceDefault
+			templates.Data = map[string]string{
+				"big-pool": "allocatable:\n  cpu: \"4\"\n  memory: \"8000\"\n",
+			}
+			Expect(k8sClient.Create(context.Background(), templates)).To(Succeed())
+			expectMaxResources(deployVpaName, "3600m", "7200")
+			expectNodeTemplateAnnotation(deployVpaName, "big-pool")
+			Expect(k8sClient.Delete(context.Background(), templates)).To(Succeed())
+			expectMaxResources(deployVpaName, "900m", "1800")
+			expectNodeTemplateAnnotation(deployVpaName, "")
+		})
+
+		It("subtracts the overhead of daemonsets from the node capacity", func() {
+			expectMaxResources(deployVpaName, "900m", "1800")
+			overhead := makeDaemonSet()
+			overhead.Name = "overhead"
+			overhead.Spec.Template.Spec.Containers = []corev1.Container{{
+				Name:  "overhead",
+				Image: "nginx",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU:    resource.MustParse("100m"),
+						corev1.ResourceMemory: resource.MustParse("200"),
+					},
+				},
+			}}
+			Expect(k8sClient.Create(context.Background(), overhead)).To(Succeed())
+			expectMaxResources(deployVpaName, "810m", "1620")
+			Expect(k8sClient.Delete(context.Background(), overhead)).To(Succeed())
+			deleteVpa("overhead-daemonset")
+			expectMaxResources(deployVpaName, "900m", "1800")
+		})
+
 		AfterEach(func() {
 			deleteVpa(deployVpaName)
 			Expect(k8sClient.Delete(context.Background(), deployment)).To(Succeed())
@@ -133,6 +267,42 @@ var _ = Describe("VpaRunnable", func() {
 
 	})
 
+	When("a cronjob is created", func() {
+		var cronJob *batchv1.CronJob
+
+		BeforeEach(func() {
+			cronJob = makeCronJob()
+			Expect(k8sClient.Create(context.Background(), cronJob)).To(Succeed())
+		})
+
+		It("sets the maximum allocatable resources from the job template", func() {
+			expectMaxResources(cronJobName+"-cronjob", "900m", "1800")
+		})
+
+		AfterEach(func() {
+			deleteVpa(cronJobName + "-cronjob")
+			Expect(k8sClient.Delete(context.Background(), cronJob)).To(Succeed())
+		})
+	})
+
+	When("a workload of a custom kind is created", func() {
+		var workload *unstructured.Unstructured
+
+		BeforeEach(func() {
+			workload = makeCustomWorkload()
+			Expect(k8sClient.Create(context.Background(), workload)).To(Succeed())
+		})
+
+		It("sets the maximum allocatable resources", func() {
+			expectMaxResources(customWorkloadName+"-customworkload", "900m", "1800")
+		})
+
+		AfterEach(func() {
+			deleteVpa(customWorkloadName + "-customworkload")
+			Expect(k8sClient.Delete(context.Background(), workload)).To(Succeed())
+		})
+	})
+
 	When("creating a hand-crafted vpa and a deployment afterwards", func() {
 		var vpa *vpav1.VerticalPodAutoscaler
 		var deployment *appsv1.Deployment
@@ -219,6 +389,56 @@ var _ = Describe("VpaRunnable", func() {
 		It("prefers the node with the least memory for setting maximum allowed resources for daemonsets", func() {
 			expectMaxResources("test-daemonset-daemonset", "3600m", "450")
 		})
+
+		It("takes the bounds from different nodes using the per-resource strategy", func() {
+			expectMaxResources(deployVpaName, "900m", "1800")
+			unmodified := deployment.DeepCopy()
+			deployment.Annotations = map[string]string{
+				controllers.ReferenceNodeAnnotationKey: string(controllers.ReferenceNodePerResource),
+			}
+			Expect(k8sClient.Patch(context.Background(), deployment, client.MergeFrom(unmodified))).To(Succeed())
+			expectMaxResources(deployVpaName, "3600m", "1800")
+		})
+
+		It("selects the node by percentile", func() {
+			expectMaxResources(deployVpaName, "900m", "1800")
+			unmodified := deployment.DeepCopy()
+			deployment.Annotations = map[string]string{
+				controllers.ReferenceNodePercentileAnnotationKey: "50",
+			}
+			Expect(k8sClient.Patch(context.Background(), deployment, client.MergeFrom(unmodified))).To(Succeed())
+			expectMaxResources(deployVpaName, "3600m", "450")
+		})
+
+		It("explains the maximum allowed resources", func() {
+			expectMaxResources(deployVpaName, "900m", "1800")
+			var explanation struct {
+				Viable            []string `json:"viable"`
+				ReferenceNodes    []string `json:"referenceNodes"`
+				Distribution      string   `json:"distribution"`
+				ContainerPolicies []struct {
+					ContainerName string              `json:"containerName"`
+					MaxAllowed    corev1.ResourceList `json:"maxAllowed"`
+				} `json:"containerPolicies"`
+			}
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, controllers.ExplainPath+"default/"+deployVpaName, http.NoBody)
+			vpaRunnable.ExplainHandler().ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &explanation)).To(Succeed())
+			Expect(explanation.Viable).To(ConsistOf("the-node", "second-node"))
+			Expect(explanation.ReferenceNodes).To(Equal([]string{"the-node"}))
+			Expect(explanation.Distribution).To(Equal(string(controllers.DistributionUniform)))
+			Expect(explanation.ContainerPolicies).To(HaveLen(1))
+			Expect(explanation.ContainerPolicies[0].ContainerName).To(Equal("*"))
+			Expect(explanation.ContainerPolicies[0].MaxAllowed.Cpu().Equal(resource.MustParse("900m"))).To(BeTrue())
+			Expect(explanation.ContainerPolicies[0].MaxAllowed.Memory().Equal(resource.MustParse("1800"))).To(BeTrue())
+
+			recorder = httptest.NewRecorder()
+			request = httptest.NewRequest(http.MethodGet, controllers.ExplainPath+"default/unknown", http.NoBody)
+			vpaRunnable.ExplainHandler().ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusNotFound))
+		})
 	})
 
 	When("using a deployment with two containers", func() {
@@ -263,6 +483,147 @@ var _ = Describe("VpaRunnable", func() {
 			Expect(policies[1].MaxAllowed.Memory().Value()).To(BeEquivalentTo(440))
 		})
 
+		It("distributes resources proportional to container weights", func() {
+			unmodified := deployment.DeepCopy()
+			deployment.Annotations = map[string]string{controllers.ContainerWeightsAnnotationKey: "test-container=3,next=1:3"}
+			Expect(k8sClient.Patch(context.Background(), deployment, client.MergeFrom(unmodified))).To(Succeed())
+			var vpaRef types.NamespacedName
+			vpaRef.Name = deployVpaName
+			vpaRef.Namespace = metav1.NamespaceDefault
+
+			var vpa vpav1.VerticalPodAutoscaler
+			var policies []vpav1.ContainerResourcePolicy
+			Eventually(func(g Gomega) []string {
+				g.Expect(k8sClient.Get(context.Background(), vpaRef, &vpa)).To(Succeed())
+				if vpa.Spec.ResourcePolicy == nil {
+					return nil
+				}
+				policies = vpa.Spec.ResourcePolicy.ContainerPolicies
+				names := make([]string, len(policies))
+				for i, policy := range policies {
+					names[i] = policy.ContainerName
+				}
+				return names
+			}).Should(Equal([]string{"test-container", "next"}))
+			Expect(policies[0].MaxAllowed.Cpu().MilliValue()).To(BeEquivalentTo(675))
+			Expect(policies[0].MaxAllowed.Memory().Value()).To(BeEquivalentTo(900))
+			Expect(policies[1].MaxAllowed.Cpu().MilliValue()).To(BeEquivalentTo(225))
+			Expect(policies[1].MaxAllowed.Memory().Value()).To(BeEquivalentTo(900))
+		})
+
+		It("distributes resources proportional to recommendations", func() {
+			var vpaRef types.NamespacedName
+			vpaRef.Name = deployVpaName
+			vpaRef.Namespace = metav1.NamespaceDefault
+			expectMaxResources(deployVpaName, "450m", "900")
+
+			var vpa vpav1.VerticalPodAutoscaler
+			Expect(k8sClient.Get(context.Background(), vpaRef, &vpa)).To(Succeed())
+			unmodifiedVpa := vpa.DeepCopy()
+			vpa.Status.Recommendation = &vpav1.RecommendedPodResources{
+				ContainerRecommendations: []vpav1.RecommendedContainerResources{
+					{
+						ContainerName: "test-container",
+						UncappedTarget: corev1.ResourceList{
+							corev1.ResourceCPU:    resource.MustParse("300m"),
+							corev1.ResourceMemory: resource.MustParse("300"),
+						},
+					},
+					{
+						ContainerName: "next",
+						UncappedTarget: corev1.ResourceList{
+							corev1.ResourceCPU:    resource.MustParse("100m"),
+							corev1.ResourceMemory: resource.MustParse("300"),
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Patch(context.Background(), &vpa, client.MergeFrom(unmodifiedVpa))).To(Succeed())
+
+			unmodified := deployment.DeepCopy()
+			deployment.Annotations = map[string]string{
+				controllers.DistributionModeAnnotationKey: string(controllers.DistributionRecommendation),
+			}
+			Expect(k8sClient.Patch(context.Background(), deployment, client.MergeFrom(unmodified))).To(Succeed())
+
+			var policies []vpav1.ContainerResourcePolicy
+			Eventually(func(g Gomega) []string {
+				g.Expect(k8sClient.Get(context.Background(), vpaRef, &vpa)).To(Succeed())
+				policies = vpa.Spec.ResourcePolicy.ContainerPolicies
+				names := make([]string, len(policies))
+				for i, policy := range policies {
+					names[i] = policy.ContainerName
+				}
+				return names
+			}).Should(Equal([]string{"test-container", "next"}))
+			Expect(policies[0].MaxAllowed.Cpu().MilliValue()).To(BeEquivalentTo(675))
+			Expect(policies[0].MaxAllowed.Memory().Value()).To(BeEquivalentTo(900))
+			Expect(policies[1].MaxAllowed.Cpu().MilliValue()).To(BeEquivalentTo(225))
+			Expect(policies[1].MaxAllowed.Memory().Value()).To(BeEquivalentTo(900))
+		})
+
+		It("reports invalid container weights", func() {
+			unmodified := deployment.DeepCopy()
+			deployment.Annotations = map[string]string{controllers.ContainerWeightsAnnotationKey: "unknown=3"}
+			Expect(k8sClient.Patch(context.Background(), deployment, client.MergeFrom(unmodified))).To(Succeed())
+			Eventually(func(g Gomega) []string {
+				var events eventsv1.EventList
+				g.Expect(k8sClient.List(context.Background(), &events, client.InNamespace(metav1.NamespaceDefault))).To(Succeed())
+				notes := make([]string, 0)
+				for _, event := range events.Items {
+					if event.Regarding.Name == deployVpaName && event.Reason == "InvalidContainerWeights" {
+						notes = append(notes, event.Note)
+					}
+				}
+				return notes
+			}).Should(ContainElement(
+				Equal(`Ignoring invalid container weights "unknown=3": container "unknown" is not part of the pod`),
+			))
+			expectMaxResources(deployVpaName, "450m", "900")
+		})
+
+		AfterEach(func() {
+			deleteVpa(deployVpaName)
+			Expect(k8sClient.Delete(context.Background(), deployment)).To(Succeed())
+		})
+	})
+
+	When("using a deployment with a native sidecar", func() {
+		var deployment *appsv1.Deployment
+
+		BeforeEach(func() {
+			deployment = makeDeployment(1)
+			deployment.Spec.Template.Spec.InitContainers = []corev1.Container{{
+				Name:          "proxy",
+				Image:         "envoy",
+				RestartPolicy: ptr.To(corev1.ContainerRestartPolicyAlways),
+			}}
+			Expect(k8sClient.Create(context.Background(), deployment)).To(Succeed())
+		})
+
+		It("bounds the sidecar as a container of its own", func() {
+			var vpaRef types.NamespacedName
+			vpaRef.Name = deployVpaName
+			vpaRef.Namespace = metav1.NamespaceDefault
+
+			var vpa vpav1.VerticalPodAutoscaler
+			var policies []vpav1.ContainerResourcePolicy
+			Eventually(func(g Gomega) []vpav1.ContainerResourcePolicy {
+				g.Expect(k8sClient.Get(context.Background(), vpaRef, &vpa)).To(Succeed())
+				if vpa.Spec.ResourcePolicy == nil {
+					return nil
+				}
+				policies = vpa.Spec.ResourcePolicy.ContainerPolicies
+				return policies
+			}).Should(HaveLen(2))
+			Expect(policies[0].ContainerName).To(Equal("proxy"))
+			Expect(policies[0].MaxAllowed.Cpu().MilliValue()).To(BeEquivalentTo(450))
+			Expect(policies[0].MaxAllowed.Memory().Value()).To(BeEquivalentTo(900))
+			Expect(policies[1].ContainerName).To(Equal("*"))
+			Expect(policies[1].MaxAllowed.Cpu().MilliValue()).To(BeEquivalentTo(450))
+			Expect(policies[1].MaxAllowed.Memory().Value()).To(BeEquivalentTo(900))
+		})
+
 		AfterEach(func() {
 			deleteVpa(deployVpaName)
 			Expect(k8sClient.Delete(context.Background(), deployment)).To(Succeed())
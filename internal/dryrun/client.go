@@ -0,0 +1,202 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package dryrun
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-logr/logr"
+	"gomodules.xyz/jsonpatch/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	"github.com/sapcc/vpa_butler/internal/metrics"
+)
+
+// auditingClient sends all mutations with server-side dry-run.
+// Each mutation is logged as structured diff and counted.
+type auditingClient struct {
+	client.Client
+	log logr.Logger
+}
+
+// NewClient wraps the client, so it reads like before, but sends all mutations with server-side dry-run.
+// Each intended mutation is logged including the patch, the complete object or, for applies, the changes
+// to the live object and is counted by the vpa_butler_dry_run_mutations_total metric.
+func NewClient(c client.Client, log logr.Logger) client.Client {
+	return &auditingClient{Client: client.NewDryRunClient(c), log: log}
+}
+
+func (c *auditingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.audit("create", obj, "object", obj)
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *auditingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.audit("update", obj, "object", obj)
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *auditingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch,
+	opts ...client.PatchOption) error {
+
+	c.audit("patch", obj, patchValues(obj, patch)...)
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *auditingClient) Apply(ctx context.Context, obj runtime.ApplyConfiguration, opts ...client.ApplyOption) error {
+	return c.auditApply(ctx, obj, nil, func() error {
+		return c.Client.Apply(ctx, obj, opts...)
+	})
+}
+
+func (c *auditingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	c.audit("delete", obj)
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func (c *auditingClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	c.audit("deleteallof", obj)
+	return c.Client.DeleteAllOf(ctx, obj, opts...)
+}
+
+func (c *auditingClient) Status() client.SubResourceWriter {
+	return c.SubResource("status")
+}
+
+func (c *auditingClient) SubResource(subResource string) client.SubResourceClient {
+	return &auditingSubResourceClient{
+		SubResourceClient: c.Client.SubResource(subResource),
+		parent:            c,
+		subResource:       subResource,
+	}
+}
+
+// audit logs and counts the mutation of the object.
+func (c *auditingClient) audit(verb string, obj client.Object, values ...any) {
+	kind := obj.GetObjectKind().GroupVersionKind().Kind
+	if gvk, err := apiutil.GVKForObject(obj, c.Scheme()); err == nil {
+		kind = gvk.Kind
+	}
+	metrics.RecordDryRunMutation(verb, kind)
+	c.log.Info("Dry-run "+verb, append([]any{"kind", kind, "namespace", obj.GetNamespace(), "name", obj.GetName()},
+		values...)...)
+}
+
+// auditApply logs and counts applying the configuration, whose kind and name are only accessible encoded.
+// As the configuration holds just the applied fields, the dry-run response is compared to the live object
+// instead, so only the changes the apply would make are logged.
+func (c *auditingClient) auditApply(ctx context.Context, obj runtime.ApplyConfiguration, values []any,
+	apply func() error) error {
+
+	applied, err := decodeUnstructured(obj)
+	if err != nil {
+		c.log.Error(err, "failed to encode apply configuration for auditing")
+		return apply()
+	}
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(applied.GroupVersionKind())
+	liveErr := c.Get(ctx, client.ObjectKeyFromObject(applied), live)
+	if err := apply(); err != nil {
+		c.audit("apply", applied, append(values, "applyConfiguration", applied.Object)...)
+		return err
+	}
+	response, err := decodeUnstructured(obj)
+	switch {
+	case err != nil:
+		c.audit("apply", applied, append(values, "applyConfiguration", applied.Object)...)
+	case apierrors.IsNotFound(liveErr):
+		c.audit("apply", applied, append(values, "object", response.Object)...)
+	case liveErr != nil:
+		c.audit("apply", applied, append(values, "applyConfiguration", applied.Object, "liveError", liveErr.Error())...)
+	default:
+		c.audit("apply", applied, append(values, diffValues(live, response)...)...)
+	}
+	return nil
+}
+
+// decodeUnstructured returns the apply configuration as unstructured object.
+func decodeUnstructured(obj runtime.ApplyConfiguration) (*unstructured.Unstructured, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var u unstructured.Unstructured
+	if err := json.Unmarshal(data, &u.Object); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// diffValues returns the changes from the live object to the dry-run response as JSON patch.
+// Fields maintained by the api server on every write are left out.
+func diffValues(live, response *unstructured.Unstructured) []any {
+	encoded := make([][]byte, 0, 2)
+	for _, obj := range []*unstructured.Unstructured{live, response} {
+		obj = obj.DeepCopy()
+		for _, field := range []string{"managedFields", "resourceVersion", "generation"} {
+			unstructured.RemoveNestedField(obj.Object, "metadata", field)
+		}
+		data, err := json.Marshal(obj.Object)
+		if err != nil {
+			return []any{"diffError", err.Error()}
+		}
+		encoded = append(encoded, data)
+	}
+	operations, err := jsonpatch.CreatePatch(encoded[0], encoded[1])
+	if err != nil {
+		return []any{"diffError", err.Error()}
+	}
+	return []any{"diff", operations}
+}
+
+// patchValues returns the patch as structured log values. It needs to be
+// called before sending the patch, which overwrites the object.
+func patchValues(obj client.Object, patch client.Patch) []any {
+	data, err := patch.Data(obj)
+	if err != nil {
+		return []any{"patchError", err.Error()}
+	}
+	return []any{"patchType", string(patch.Type()), "patch", json.RawMessage(data)}
+}
+
+// auditingSubResourceClient sends all mutations of a subresource with server-side dry-run.
+type auditingSubResourceClient struct {
+	client.SubResourceClient
+	parent      *auditingClient
+	subResource string
+}
+
+func (c *auditingSubResourceClient) Create(ctx context.Context, obj, subResource client.Object,
+	opts ...client.SubResourceCreateOption) error {
+
+	c.parent.audit("create", obj, "subResource", c.subResource, "object", subResource)
+	return c.SubResourceClient.Create(ctx, obj, subResource, opts...)
+}
+
+func (c *auditingSubResourceClient) Update(ctx context.Context, obj client.Object,
+	opts ...client.SubResourceUpdateOption) error {
+
+	c.parent.audit("update", obj, "subResource", c.subResource, "object", obj)
+	return c.SubResourceClient.Update(ctx, obj, opts...)
+}
+
+func (c *auditingSubResourceClient) Patch(ctx context.Context, obj client.Object, patch client.Patch,
+	opts ...client.SubResourcePatchOption) error {
+
+	c.parent.audit("patch", obj, append([]any{"subResource", c.subResource}, patchValues(obj, patch)...)...)
+	return c.SubResourceClient.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *auditingSubResourceClient) Apply(ctx context.Context, obj runtime.ApplyConfiguration,
+	opts ...client.SubResourceApplyOption) error {
+
+	return c.parent.auditApply(ctx, obj, []any{"subResource", c.subResource}, func() error {
+		return c.SubResourceClient.Apply(ctx, obj, opts...)
+	})
+}
@@ -0,0 +1,168 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package dryrun_test
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/sapcc/vpa_butler/internal/dryrun"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// dryRunMutations returns the value of the dry-run mutations counter for the verb and kind.
+func dryRunMutations(verb, kind string) float64 {
+	GinkgoHelper()
+	families, err := ctrlmetrics.Registry.Gather()
+	Expect(err).ToNot(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "vpa_butler_dry_run_mutations_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["verb"] == verb && labels["kind"] == kind {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Client", func() {
+
+	var underlying client.WithWatch
+	var c client.Client
+	var vpa *vpav1.VerticalPodAutoscaler
+
+	BeforeEach(func() {
+		scheme := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(vpav1.AddToScheme(scheme)).To(Succeed())
+		vpa = &vpav1.VerticalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: metav1.NamespaceDefault},
+		}
+		underlying = fake.NewClientBuilder().WithScheme(scheme).WithObjects(vpa.DeepCopy()).Build()
+		c = dryrun.NewClient(underlying, logr.Discard())
+	})
+
+	It("does not persist creations", func() {
+		before := dryRunMutations("create", "VerticalPodAutoscaler")
+		created := &vpav1.VerticalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: "created", Namespace: metav1.NamespaceDefault},
+		}
+		Expect(c.Create(context.Background(), created)).To(Succeed())
+		var list vpav1.VerticalPodAutoscalerList
+		Expect(underlying.List(context.Background(), &list)).To(Succeed())
+		Expect(list.Items).To(HaveLen(1))
+		Expect(dryRunMutations("create", "VerticalPodAutoscaler")).To(Equal(before + 1))
+	})
+
+	It("does not persist patches", func() {
+		before := dryRunMutations("patch", "VerticalPodAutoscaler")
+		Expect(c.Get(context.Background(), client.ObjectKeyFromObject(vpa), vpa)).To(Succeed())
+		original := vpa.DeepCopy()
+		vpa.Labels = map[string]string{"patched": "true"}
+		Expect(c.Patch(context.Background(), vpa, client.MergeFrom(original))).To(Succeed())
+		var fetched vpav1.VerticalPodAutoscaler
+		Expect(underlying.Get(context.Background(), client.ObjectKeyFromObject(vpa), &fetched)).To(Succeed())
+		Expect(fetched.Labels).To(BeEmpty())
+		Expect(dryRunMutations("patch", "VerticalPodAutoscaler")).To(Equal(before + 1))
+	})
+
+	It("sends applies with dry-run", func() {
+		// the fake client ignores dry-run for applies, so only the options are checked
+		var options client.ApplyOptions
+		intercepted := interceptor.NewClient(underlying, interceptor.Funcs{
+			Apply: func(_ context.Context, _ client.WithWatch, _ runtime.ApplyConfiguration,
+				opts ...client.ApplyOption) error {
+
+				options.ApplyOptions(opts)
+				return nil
+			},
+		})
+		c = dryrun.NewClient(intercepted, logr.Discard())
+		before := dryRunMutations("apply", "VerticalPodAutoscaler")
+		var applied unstructured.Unstructured
+		applied.SetGroupVersionKind(vpav1.SchemeGroupVersion.WithKind("VerticalPodAutoscaler"))
+		applied.SetNamespace(vpa.Namespace)
+		applied.SetName(vpa.Name)
+		Expect(c.Apply(context.Background(), client.ApplyConfigurationFromUnstructured(&applied),
+			client.FieldOwner("test"))).To(Succeed())
+		Expect(options.DryRun).To(Equal([]string{metav1.DryRunAll}))
+		Expect(dryRunMutations("apply", "VerticalPodAutoscaler")).To(Equal(before + 1))
+	})
+
+	It("logs the changes an apply would make", func() {
+		logged := make([]string, 0)
+		log := funcr.NewJSON(func(obj string) { logged = append(logged, obj) }, funcr.Options{})
+		var applied unstructured.Unstructured
+		intercepted := interceptor.NewClient(underlying, interceptor.Funcs{
+			Apply: func(ctx context.Context, c client.WithWatch, _ runtime.ApplyConfiguration,
+				_ ...client.ApplyOption) error {
+
+				// the api server responds with the complete object
+				key := client.ObjectKeyFromObject(&applied)
+				Expect(c.Get(ctx, key, &applied)).To(Succeed())
+				applied.SetLabels(map[string]string{"applied": "true"})
+				return nil
+			},
+		})
+		c = dryrun.NewClient(intercepted, log)
+		applied.SetGroupVersionKind(vpav1.SchemeGroupVersion.WithKind("VerticalPodAutoscaler"))
+		applied.SetNamespace(vpa.Namespace)
+		applied.SetName(vpa.Name)
+		applied.SetLabels(map[string]string{"applied": "true"})
+		Expect(c.Apply(context.Background(), client.ApplyConfigurationFromUnstructured(&applied),
+			client.FieldOwner("test"))).To(Succeed())
+		Expect(logged).To(ConsistOf(And(
+			ContainSubstring(`"path":"/metadata/labels"`),
+			Not(ContainSubstring(`"path":"/metadata/name"`)),
+			Not(ContainSubstring("applyConfiguration")),
+		)))
+	})
+
+	It("does not persist deletions", func() {
+		before := dryRunMutations("delete", "VerticalPodAutoscaler")
+		Expect(c.Delete(context.Background(), vpa)).To(Succeed())
+		Expect(underlying.Get(context.Background(), client.ObjectKeyFromObject(vpa), vpa)).To(Succeed())
+		Expect(dryRunMutations("delete", "VerticalPodAutoscaler")).To(Equal(before + 1))
+	})
+})
+
+var _ = Describe("Recorder", func() {
+
+	It("counts events instead of emitting them", func() {
+		before := dryRunMutations("event", "Node")
+		recorder := &dryrun.Recorder{Log: logr.Discard(), Scheme: clientgoscheme.Scheme}
+		recorder.Eventf(&corev1.Node{}, nil, corev1.EventTypeWarning, "NoValidNodes", "Reconcile", "%d nodes", 0)
+		Expect(dryRunMutations("event", "Node")).To(Equal(before + 1))
+	})
+
+	It("counts events regarding referenced objects by their kind", func() {
+		before := dryRunMutations("event", "Deployment")
+		recorder := &dryrun.Recorder{Log: logr.Discard(), Scheme: clientgoscheme.Scheme}
+		workload := &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "test"}
+		recorder.Eventf(workload, &vpav1.VerticalPodAutoscaler{}, corev1.EventTypeNormal, "VpaCreated", "CreateVpa",
+			"Created vpa")
+		Expect(dryRunMutations("event", "Deployment")).To(Equal(before + 1))
+	})
+})
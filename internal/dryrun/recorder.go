@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package dryrun
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/events"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	"github.com/sapcc/vpa_butler/internal/metrics"
+)
+
+// Recorder logs events instead of emitting them, as the event broadcaster
+// of the manager does not use the client and cannot send them with dry-run.
+type Recorder struct {
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+var _ events.EventRecorder = &Recorder{}
+
+func (r *Recorder) Eventf(regarding, related runtime.Object, eventtype, reason, action, note string, args ...any) {
+	kind, namespace, name := r.describe(regarding)
+	metrics.RecordDryRunMutation("event", kind)
+	values := []any{"kind", kind, "namespace", namespace, "name", name, "type", eventtype, "reason", reason,
+		"action", action, "note", fmt.Sprintf(note, args...)}
+	if related != nil {
+		relatedKind, _, relatedName := r.describe(related)
+		values = append(values, "relatedKind", relatedKind, "relatedName", relatedName)
+	}
+	r.Log.Info("Dry-run event", values...)
+}
+
+// describe returns the kind, namespace and name of an object or of the object referenced.
+func (r *Recorder) describe(obj runtime.Object) (kind, namespace, name string) {
+	if ref, ok := obj.(*corev1.ObjectReference); ok {
+		return ref.Kind, ref.Namespace, ref.Name
+	}
+	kind = obj.GetObjectKind().GroupVersionKind().Kind
+	if r.Scheme != nil {
+		if gvk, err := apiutil.GVKForObject(obj, r.Scheme); err == nil {
+			kind = gvk.Kind
+		}
+	}
+	if accessor, ok := obj.(client.Object); ok {
+		namespace, name = accessor.GetNamespace(), accessor.GetName()
+	}
+	return kind, namespace, name
+}
@@ -0,0 +1,240 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package filter
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	v1helper "k8s.io/component-helpers/scheduling/corev1"
+	"k8s.io/klog/v2"
+
+	"github.com/sapcc/vpa_butler/internal/platform"
+)
+
+const (
+	NodeNameFilter         = "NodeName"
+	TaintTolerationFilter  = "TaintToleration"
+	NodeAffinityFilter     = "NodeAffinity"
+	NodeConditionsFilter   = "NodeConditions"
+	PreferNoScheduleFilter = "PreferNoSchedule"
+	TopologySpreadFilter   = "TopologySpread"
+	PlatformFilter         = "Platform"
+	NodePoolFilter         = "NodePool"
+)
+
+// DefaultFilters are the filters enabled unless configured otherwise.
+var DefaultFilters = []string{NodeNameFilter, TaintTolerationFilter, NodeAffinityFilter, NodeConditionsFilter}
+
+// Config parameterizes the registered filters.
+type Config struct {
+	// GracePeriod is passed to the NodeConditions filter.
+	GracePeriod time.Duration
+	// NodePoolSelector is the allow-list of the NodePool filter, which keeps all nodes if nil.
+	NodePoolSelector labels.Selector
+	// Now returns the current time and defaults to time.Now.
+	Now func() time.Time
+}
+
+type factory func(config Config) NodeFilter
+
+var registry = map[string]factory{
+	NodeNameFilter:        func(Config) NodeFilter { return NodeName },
+	TaintTolerationFilter: func(Config) NodeFilter { return TaintToleration },
+	NodeAffinityFilter:    func(Config) NodeFilter { return NodeAffinity },
+	NodeConditionsFilter: func(config Config) NodeFilter {
+		return func(target TargetedVpa, nodes []corev1.Node) ([]corev1.Node, error) {
+			return NodeConditions(config.GracePeriod, config.Now())(target, nodes)
+		}
+	},
+	PreferNoScheduleFilter: func(Config) NodeFilter { return PreferNoSchedule },
+	TopologySpreadFilter:   func(Config) NodeFilter { return TopologySpread },
+	PlatformFilter:         func(Config) NodeFilter { return Platform },
+	NodePoolFilter: func(config Config) NodeFilter {
+		return func(_ TargetedVpa, nodes []corev1.Node) ([]corev1.Node, error) {
+			return NodePool(config.NodePoolSelector, nodes), nil
+		}
+	},
+}
+
+// Names returns the names of all registered filters.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+type namedFilter struct {
+	name   string
+	filter NodeFilter
+}
+
+// Chain applies the enabled filters in order.
+type Chain struct {
+	filters []namedFilter
+}
+
+// Step records the nodes a filter of a chain removed.
+type Step struct {
+	Filter  string
+	Removed []string
+}
+
+// NewChain returns a chain of the named filters, which must be registered.
+func NewChain(names []string, config Config) (*Chain, error) {
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	chain := &Chain{filters: make([]namedFilter, 0, len(names))}
+	for _, name := range names {
+		create, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown node filter %q, must be one of: %s", name, strings.Join(Names(), ","))
+		}
+		chain.filters = append(chain.filters, namedFilter{name: name, filter: create(config)})
+	}
+	return chain, nil
+}
+
+// Evaluate returns the nodes kept by all filters and which nodes each filter removed.
+func (c *Chain) Evaluate(target TargetedVpa, nodes []corev1.Node) ([]corev1.Node, []Step, error) {
+	steps := make([]Step, 0, len(c.filters))
+	next := nodes
+	for _, f := range c.filters {
+		kept, err := f.filter(target, next)
+		if err != nil {
+			return nil, nil, fmt.Errorf("node filter %s failed: %w", f.name, err)
+		}
+		steps = append(steps, Step{Filter: f.name, Removed: removedNodes(next, kept)})
+		next = kept
+	}
+	return next, steps, nil
+}
+
+// Without returns a chain of the remaining filters in the same order.
+func (c *Chain) Without(names ...string) *Chain {
+	remaining := &Chain{filters: make([]namedFilter, 0, len(c.filters))}
+	for _, f := range c.filters {
+		if !slices.Contains(names, f.name) {
+			remaining.filters = append(remaining.filters, f)
+		}
+	}
+	return remaining
+}
+
+func removedNodes(before, after []corev1.Node) []string {
+	kept := make(map[string]bool, len(after))
+	for _, node := range after {
+		kept[node.Name] = true
+	}
+	removed := make([]string, 0)
+	for _, node := range before {
+		if !kept[node.Name] {
+			removed = append(removed, node.Name)
+		}
+	}
+	return removed
+}
+
+// PreferNoSchedule removes nodes with PreferNoSchedule taints the pods do not tolerate.
+// As the scheduler still places pods onto such nodes, if there are no others, all nodes
+// are kept when none of them is free of untolerated PreferNoSchedule taints.
+func PreferNoSchedule(target TargetedVpa, nodes []corev1.Node) ([]corev1.Node, error) {
+	preferNoSchedule := func(t *corev1.Taint) bool {
+		return t.Effect == corev1.TaintEffectPreferNoSchedule
+	}
+	preferred := make([]corev1.Node, 0)
+	for _, node := range nodes {
+		_, untolerated := v1helper.FindMatchingUntoleratedTaint(
+			klog.New(logr.Discard().GetSink()),
+			node.Spec.Taints,
+			target.PodSpec.Tolerations,
+			preferNoSchedule,
+			true,
+		)
+		if !untolerated {
+			preferred = append(preferred, node)
+		}
+	}
+	if len(preferred) == 0 {
+		return nodes, nil
+	}
+	return preferred, nil
+}
+
+// TopologySpread removes nodes lacking the topology key of a DoNotSchedule
+// topology spread constraint, as the scheduler does not place pods onto them.
+func TopologySpread(target TargetedVpa, nodes []corev1.Node) ([]corev1.Node, error) {
+	var keys []string
+	for _, constraint := range target.PodSpec.TopologySpreadConstraints {
+		if constraint.WhenUnsatisfiable == corev1.DoNotSchedule {
+			keys = append(keys, constraint.TopologyKey)
+		}
+	}
+	if len(keys) == 0 {
+		return nodes, nil
+	}
+	spreadable := make([]corev1.Node, 0)
+	for _, node := range nodes {
+		if hasLabels(&node, keys) {
+			spreadable = append(spreadable, node)
+		}
+	}
+	return spreadable, nil
+}
+
+func hasLabels(node *corev1.Node, keys []string) bool {
+	for _, key := range keys {
+		if _, ok := node.Labels[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Platform removes nodes, whose operating system does not match the one of the pods or
+// which do not match any platform the images of the pods are available for.
+// Nodes without the well-known labels are kept.
+func Platform(target TargetedVpa, nodes []corev1.Node) ([]corev1.Node, error) {
+	var os string
+	if target.PodSpec.OS != nil {
+		os = string(target.PodSpec.OS.Name)
+	}
+	matching := make([]corev1.Node, 0)
+	for _, node := range nodes {
+		nodeOS, nodeArch := node.Labels[corev1.LabelOSStable], node.Labels[corev1.LabelArchStable]
+		if os != "" && nodeOS != "" && nodeOS != os {
+			continue
+		}
+		if len(target.Platforms) > 0 && !slices.ContainsFunc(target.Platforms, func(p platform.Platform) bool {
+			return p.Matches(nodeOS, nodeArch)
+		}) {
+			continue
+		}
+		matching = append(matching, node)
+	}
+	return matching, nil
+}
+
+// NodePool keeps the nodes matching the selector or all nodes, if it is nil.
+func NodePool(selector labels.Selector, nodes []corev1.Node) []corev1.Node {
+	if selector == nil {
+		return nodes
+	}
+	allowed := make([]corev1.Node, 0)
+	for _, node := range nodes {
+		if selector.Matches(labels.Set(node.Labels)) {
+			allowed = append(allowed, node)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,141 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package filter_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/sapcc/vpa_butler/internal/filter"
+	"github.com/sapcc/vpa_butler/internal/platform"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func labeledNode(name string, nodeLabels map[string]string) corev1.Node {
+	return corev1.Node{ObjectMeta: v1.ObjectMeta{Name: name, Labels: nodeLabels}}
+}
+
+var _ = Describe("Chain", func() {
+
+	It("rejects unknown filters", func() {
+		_, err := filter.NewChain([]string{"Unknown"}, filter.Config{})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reports the nodes removed by each filter", func() {
+		chain, err := filter.NewChain([]string{filter.NodeNameFilter, filter.NodePoolFilter}, filter.Config{
+			NodePoolSelector: labels.SelectorFromSet(labels.Set{"pool": "a"}),
+		})
+		Expect(err).To(Succeed())
+		nodes := []corev1.Node{
+			labeledNode("node1", map[string]string{"pool": "a"}),
+			labeledNode("node2", map[string]string{"pool": "b"}),
+		}
+		viable, steps, err := chain.Evaluate(filter.TargetedVpa{}, nodes)
+		Expect(err).To(Succeed())
+		Expect(viable).To(HaveLen(1))
+		Expect(viable[0].Name).To(Equal("node1"))
+		Expect(steps).To(Equal([]filter.Step{
+			{Filter: filter.NodeNameFilter, Removed: []string{}},
+			{Filter: filter.NodePoolFilter, Removed: []string{"node2"}},
+		}))
+	})
+
+	It("omits the excluded filters", func() {
+		chain, err := filter.NewChain([]string{filter.NodeNameFilter, filter.NodePoolFilter}, filter.Config{
+			NodePoolSelector: labels.SelectorFromSet(labels.Set{"pool": "a"}),
+		})
+		Expect(err).To(Succeed())
+		nodes := []corev1.Node{labeledNode("node1", map[string]string{"pool": "b"})}
+		viable, steps, err := chain.Without(filter.NodePoolFilter).Evaluate(filter.TargetedVpa{}, nodes)
+		Expect(err).To(Succeed())
+		Expect(viable).To(HaveLen(1))
+		Expect(steps).To(Equal([]filter.Step{{Filter: filter.NodeNameFilter, Removed: []string{}}}))
+	})
+
+})
+
+var _ = Describe("PreferNoSchedule", func() {
+
+	tainted := corev1.Node{
+		ObjectMeta: v1.ObjectMeta{Name: "tainted"},
+		Spec: corev1.NodeSpec{
+			Taints: []corev1.Taint{{Key: "avoid", Effect: corev1.TaintEffectPreferNoSchedule}},
+		},
+	}
+
+	It("removes nodes with untolerated PreferNoSchedule taints", func() {
+		Expect(filter.PreferNoSchedule(filter.TargetedVpa{}, []corev1.Node{tainted, {}})).To(HaveLen(1))
+	})
+
+	It("keeps all nodes, if all of them are tainted", func() {
+		Expect(filter.PreferNoSchedule(filter.TargetedVpa{}, []corev1.Node{tainted})).To(HaveLen(1))
+	})
+
+})
+
+var _ = Describe("TopologySpread", func() {
+
+	target := filter.TargetedVpa{PodSpec: corev1.PodSpec{
+		TopologySpreadConstraints: []corev1.TopologySpreadConstraint{{
+			TopologyKey:       corev1.LabelTopologyZone,
+			WhenUnsatisfiable: corev1.DoNotSchedule,
+		}},
+	}}
+
+	It("removes nodes lacking the topology key", func() {
+		nodes := []corev1.Node{
+			labeledNode("zoned", map[string]string{corev1.LabelTopologyZone: "a"}),
+			labeledNode("unzoned", nil),
+		}
+		Expect(filter.TopologySpread(target, nodes)).To(HaveLen(1))
+	})
+
+	It("keeps all nodes for ScheduleAnyway constraints", func() {
+		anyway := filter.TargetedVpa{PodSpec: corev1.PodSpec{
+			TopologySpreadConstraints: []corev1.TopologySpreadConstraint{{
+				TopologyKey:       corev1.LabelTopologyZone,
+				WhenUnsatisfiable: corev1.ScheduleAnyway,
+			}},
+		}}
+		Expect(filter.TopologySpread(anyway, []corev1.Node{{}})).To(HaveLen(1))
+	})
+
+})
+
+var _ = Describe("Platform", func() {
+
+	nodes := []corev1.Node{
+		labeledNode("linux-amd64", map[string]string{corev1.LabelOSStable: "linux", corev1.LabelArchStable: "amd64"}),
+		labeledNode("linux-arm64", map[string]string{corev1.LabelOSStable: "linux", corev1.LabelArchStable: "arm64"}),
+		labeledNode("windows-amd64", map[string]string{corev1.LabelOSStable: "windows", corev1.LabelArchStable: "amd64"}),
+	}
+
+	It("keeps all nodes, if the platform is not specified", func() {
+		Expect(filter.Platform(filter.TargetedVpa{}, nodes)).To(HaveLen(3))
+	})
+
+	It("removes nodes of other operating systems and architectures", func() {
+		target := filter.TargetedVpa{
+			PodSpec:   corev1.PodSpec{OS: &corev1.PodOS{Name: corev1.Linux}},
+			Platforms: []platform.Platform{{Architecture: "arm64"}},
+		}
+		result, err := filter.Platform(target, nodes)
+		Expect(err).To(Succeed())
+		Expect(result).To(HaveLen(1))
+		Expect(result[0].Name).To(Equal("linux-arm64"))
+	})
+
+	It("removes nodes not matching any platform of the images", func() {
+		target := filter.TargetedVpa{Platforms: []platform.Platform{{OS: "windows", Architecture: "amd64"}}}
+		result, err := filter.Platform(target, nodes)
+		Expect(err).To(Succeed())
+		Expect(result).To(HaveLen(1))
+		Expect(result[0].Name).To(Equal("windows-amd64"))
+	})
+
+})
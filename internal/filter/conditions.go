@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package filter
+
+import (
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ToBeDeletedTaint is set by the cluster-autoscaler on nodes it is draining.
+	ToBeDeletedTaint = "ToBeDeletedByClusterAutoscaler"
+	// DeletionCandidateTaint is set by the cluster-autoscaler on nodes it considers
+	// unneeded. Its value is the unix timestamp the node became a candidate.
+	DeletionCandidateTaint = "DeletionCandidateOfClusterAutoscaler"
+	// KarpenterDisruptedTaint is set by karpenter on nodes it is disrupting.
+	KarpenterDisruptedTaint = "karpenter.sh/disrupted"
+)
+
+// unhealthyConditions maps node conditions to the status they have on unhealthy nodes.
+var unhealthyConditions = map[corev1.NodeConditionType]corev1.ConditionStatus{
+	corev1.NodeMemoryPressure:     corev1.ConditionTrue,
+	corev1.NodeDiskPressure:       corev1.ConditionTrue,
+	corev1.NodePIDPressure:        corev1.ConditionTrue,
+	corev1.NodeNetworkUnavailable: corev1.ConditionTrue,
+}
+
+// NodeConditions returns a NodeFilter dropping nodes, which are not ready, under pressure,
+// marked for deletion or being drained by an autoscaler. Nodes are only dropped, once their
+// condition or deletion candidacy persisted for the grace period, so flapping nodes do not
+// make the maximum allowed resources oscillate. Nodes being deleted or drained are dropped
+// right away. Missing conditions, e.g. on node templates, are ignored.
+func NodeConditions(gracePeriod time.Duration, now time.Time) NodeFilter {
+	return func(_ TargetedVpa, nodes []corev1.Node) ([]corev1.Node, error) {
+		healthy := make([]corev1.Node, 0, len(nodes))
+		for _, node := range nodes {
+			if !isLeaving(&node, gracePeriod, now) && !isUnhealthy(&node, gracePeriod, now) {
+				healthy = append(healthy, node)
+			}
+		}
+		return healthy, nil
+	}
+}
+
+// GracePeriodRemaining returns how long the NodeConditions filter keeps the node, which is unhealthy
+// or a deletion candidate, until the grace period passed. It returns false, if no grace period is pending.
+func GracePeriodRemaining(node *corev1.Node, gracePeriod time.Duration, now time.Time) (time.Duration, bool) {
+	since := unhealthySince(node)
+	if candidate, ok := candidateSince(node); ok {
+		since = append(since, candidate)
+	}
+	var remaining time.Duration
+	pending := false
+	for _, start := range since {
+		left := gracePeriod - now.Sub(start)
+		if left > 0 && (!pending || left < remaining) {
+			remaining, pending = left, true
+		}
+	}
+	return remaining, pending
+}
+
+func isUnhealthy(node *corev1.Node, gracePeriod time.Duration, now time.Time) bool {
+	for _, since := range unhealthySince(node) {
+		if now.Sub(since) >= gracePeriod {
+			return true
+		}
+	}
+	return false
+}
+
+// unhealthySince returns when the unhealthy conditions of the node transitioned.
+func unhealthySince(node *corev1.Node) []time.Time {
+	var since []time.Time
+	for _, condition := range node.Status.Conditions {
+		unhealthy := condition.Status == unhealthyConditions[condition.Type]
+		if condition.Type == corev1.NodeReady {
+			unhealthy = condition.Status != corev1.ConditionTrue
+		}
+		if unhealthy {
+			since = append(since, condition.LastTransitionTime.Time)
+		}
+	}
+	return since
+}
+
+func isLeaving(node *corev1.Node, gracePeriod time.Duration, now time.Time) bool {
+	if node.DeletionTimestamp != nil {
+		return true
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == ToBeDeletedTaint || taint.Key == KarpenterDisruptedTaint {
+			return true
+		}
+	}
+	since, ok := candidateSince(node)
+	return ok && now.Sub(since) >= gracePeriod
+}
+
+// candidateSince returns since when the node is a deletion candidate.
+func candidateSince(node *corev1.Node) (time.Time, bool) {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key != DeletionCandidateTaint {
+			continue
+		}
+		since, err := strconv.ParseInt(taint.Value, 10, 64)
+		if err == nil {
+			return time.Unix(since, 0), true
+		}
+		// without a timestamp the grace period starts when the taint was added
+		if taint.TimeAdded != nil {
+			return taint.TimeAdded.Time, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package filter_test
+
+import (
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/sapcc/vpa_butler/internal/filter"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("NodeConditions", func() {
+
+	const gracePeriod = 5 * time.Minute
+	now := time.Now()
+
+	withCondition := func(conditionType corev1.NodeConditionType, status corev1.ConditionStatus,
+		since time.Duration) corev1.Node {
+
+		var node corev1.Node
+		node.Status.Conditions = []corev1.NodeCondition{{
+			Type:               conditionType,
+			Status:             status,
+			LastTransitionTime: v1.NewTime(now.Add(-since)),
+		}}
+		return node
+	}
+
+	withTaint := func(key, value string) corev1.Node {
+		var node corev1.Node
+		node.Spec.Taints = []corev1.Taint{{Key: key, Value: value, Effect: corev1.TaintEffectNoSchedule}}
+		return node
+	}
+
+	evaluate := func(node corev1.Node) []corev1.Node {
+		GinkgoHelper()
+		result, err := filter.NodeConditions(gracePeriod, now)(filter.TargetedVpa{}, []corev1.Node{node})
+		Expect(err).To(Succeed())
+		return result
+	}
+
+	It("keeps nodes without conditions", func() {
+		Expect(evaluate(corev1.Node{})).To(HaveLen(1))
+	})
+
+	It("keeps ready nodes", func() {
+		Expect(evaluate(withCondition(corev1.NodeReady, corev1.ConditionTrue, time.Hour))).To(HaveLen(1))
+	})
+
+	It("removes nodes not ready for longer than the grace period", func() {
+		Expect(evaluate(withCondition(corev1.NodeReady, corev1.ConditionFalse, time.Hour))).To(BeEmpty())
+		Expect(evaluate(withCondition(corev1.NodeReady, corev1.ConditionUnknown, time.Hour))).To(BeEmpty())
+	})
+
+	It("keeps nodes not ready for less than the grace period", func() {
+		Expect(evaluate(withCondition(corev1.NodeReady, corev1.ConditionFalse, time.Minute))).To(HaveLen(1))
+	})
+
+	It("removes nodes under pressure for longer than the grace period", func() {
+		Expect(evaluate(withCondition(corev1.NodeMemoryPressure, corev1.ConditionTrue, time.Hour))).To(BeEmpty())
+		Expect(evaluate(withCondition(corev1.NodeDiskPressure, corev1.ConditionTrue, time.Hour))).To(BeEmpty())
+	})
+
+	It("keeps nodes without pressure", func() {
+		Expect(evaluate(withCondition(corev1.NodeMemoryPressure, corev1.ConditionFalse, time.Hour))).To(HaveLen(1))
+	})
+
+	It("removes nodes being deleted", func() {
+		var node corev1.Node
+		node.DeletionTimestamp = &v1.Time{Time: now}
+		Expect(evaluate(node)).To(BeEmpty())
+	})
+
+	It("removes nodes drained by an autoscaler right away", func() {
+		Expect(evaluate(withTaint(filter.ToBeDeletedTaint, strconv.FormatInt(now.Unix(), 10)))).To(BeEmpty())
+		Expect(evaluate(withTaint(filter.KarpenterDisruptedTaint, ""))).To(BeEmpty())
+	})
+
+	It("removes deletion candidates after the grace period", func() {
+		Expect(evaluate(withTaint(filter.DeletionCandidateTaint,
+			strconv.FormatInt(now.Add(-time.Minute).Unix(), 10)))).To(HaveLen(1))
+		Expect(evaluate(withTaint(filter.DeletionCandidateTaint,
+			strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)))).To(BeEmpty())
+	})
+
+	Describe("GracePeriodRemaining", func() {
+
+		remaining := func(node corev1.Node) (time.Duration, bool) {
+			return filter.GracePeriodRemaining(&node, gracePeriod, now)
+		}
+
+		It("is not pending for healthy nodes", func() {
+			_, pending := remaining(withCondition(corev1.NodeReady, corev1.ConditionTrue, time.Minute))
+			Expect(pending).To(BeFalse())
+		})
+
+		It("is not pending once the grace period passed", func() {
+			_, pending := remaining(withCondition(corev1.NodeReady, corev1.ConditionFalse, time.Hour))
+			Expect(pending).To(BeFalse())
+		})
+
+		It("returns the rest of the grace period of unhealthy nodes", func() {
+			left, pending := remaining(withCondition(corev1.NodeReady, corev1.ConditionFalse, time.Minute))
+			Expect(pending).To(BeTrue())
+			Expect(left).To(Equal(gracePeriod - time.Minute))
+		})
+
+		It("returns the rest of the grace period of deletion candidates", func() {
+			left, pending := remaining(withTaint(filter.DeletionCandidateTaint,
+				strconv.FormatInt(now.Add(-2*time.Minute).Unix(), 10)))
+			Expect(pending).To(BeTrue())
+			Expect(left).To(BeNumerically("~", gracePeriod-2*time.Minute, time.Second))
+		})
+	})
+})
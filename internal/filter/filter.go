@@ -11,6 +11,8 @@ import (
 	v1helper "k8s.io/component-helpers/scheduling/corev1"
 	"k8s.io/component-helpers/scheduling/corev1/nodeaffinity"
 	"k8s.io/klog/v2"
+
+	"github.com/sapcc/vpa_butler/internal/platform"
 )
 
 func Schedulable(nodes []corev1.Node) []corev1.Node {
@@ -29,6 +31,10 @@ const (
 	TargetDeployment TargetType = iota
 	TargetStatefulSet
 	TargetDaemonSet
+	TargetCronJob
+	TargetJob
+	// TargetCustom is a workload of a custom kind exposing a /scale subresource.
+	TargetCustom
 )
 
 type TargetedVpa struct {
@@ -37,6 +43,8 @@ type TargetedVpa struct {
 	PodSpec    corev1.PodSpec
 	Selector   metav1.LabelSelector
 	ObjectMeta metav1.ObjectMeta
+	// Platforms are the platforms all images of the pods are available for, empty if unknown.
+	Platforms []platform.Platform
 }
 
 type NodeFilter func(target TargetedVpa, nodes []corev1.Node) ([]corev1.Node, error)
@@ -90,8 +98,10 @@ func NodeAffinity(target TargetedVpa, nodes []corev1.Node) ([]corev1.Node, error
 	return matched, nil
 }
 
-func Evaluate(target TargetedVpa, nodes []corev1.Node) ([]corev1.Node, error) {
-	filters := []NodeFilter{NodeName, TaintToleration, NodeAffinity}
+// Evaluate returns the nodes pods of the target can be scheduled on.
+// The additional filters are applied after the scheduling filters.
+func Evaluate(target TargetedVpa, nodes []corev1.Node, additional ...NodeFilter) ([]corev1.Node, error) {
+	filters := append([]NodeFilter{NodeName, TaintToleration, NodeAffinity}, additional...)
 	next := nodes
 	for _, filter := range filters {
 		var err error
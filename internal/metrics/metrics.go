@@ -25,9 +25,33 @@ var (
 	}, []string{"namespace", "verticalpodautoscaler", "container", "resource", "unit"})
 )
 
+var (
+	maxAllowedChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vpa_butler_vpa_max_allowed_changes_total",
+		Help: "Number of changes to the max allowed values of served vpas by the triggering reason",
+	}, []string{"reason"})
+)
+
+var (
+	dryRunMutations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vpa_butler_dry_run_mutations_total",
+		Help: "Number of mutations sent with server-side dry-run by the verb and the kind of the mutated object",
+	}, []string{"verb", "kind"})
+)
+
 func RegisterMetrics() {
 	metrics.Registry.MustRegister(containerRecommendationExcess)
 	metrics.Registry.MustRegister(containerMaxAllowed)
+	metrics.Registry.MustRegister(maxAllowedChanges)
+	metrics.Registry.MustRegister(dryRunMutations)
+}
+
+func RecordMaxAllowedChange(reason string) {
+	maxAllowedChanges.WithLabelValues(reason).Inc()
+}
+
+func RecordDryRunMutation(verb, kind string) {
+	dryRunMutations.WithLabelValues(verb, kind).Inc()
 }
 
 func RecordContainerVpaMetrics(vpa *vpav1.VerticalPodAutoscaler) {
@@ -0,0 +1,16 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package platform
+
+// CachedImages returns the amount of images in the cache including expired ones.
+func (r *Resolver) CachedImages() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.cache)
+}
+
+// TrustedRealm returns true, if the resolver requests tokens of the realm host for the registry.
+func (r *Resolver) TrustedRealm(registry, host string) bool {
+	return r.trustedRealm(registry, host)
+}
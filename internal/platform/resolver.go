@@ -0,0 +1,447 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+// Package platform resolves the platforms container images are available for
+// from their manifests within the registry.
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mediaTypeOCIIndex          = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList        = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest       = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifest    = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerHubDomain            = "docker.io"
+	dockerHubRegistry          = "registry-1.docker.io"
+	maxResponseBytes           = 4 << 20
+	unknownPlatformAttestation = "unknown"
+	// resolveWorkers is the amount of images resolved concurrently.
+	resolveWorkers = 2
+	// resolveQueueLength bounds the images waiting for resolution.
+	resolveQueueLength = 256
+)
+
+// acceptManifests negotiates image indexes and image manifests in the OCI and the docker format.
+var acceptManifests = strings.Join([]string{
+	mediaTypeOCIIndex, mediaTypeDockerList, mediaTypeOCIManifest, mediaTypeDockerManifest,
+}, ",")
+
+// Platform is an operating system and architecture an image is available for.
+// Empty fields match any value.
+type Platform struct {
+	OS           string
+	Architecture string
+}
+
+// Matches returns true, if the platform matches the given operating system and architecture.
+// Empty values, e.g. of nodes without the well-known labels, match any platform.
+func (p Platform) Matches(os, architecture string) bool {
+	return (p.OS == "" || os == "" || p.OS == os) &&
+		(p.Architecture == "" || architecture == "" || p.Architecture == architecture)
+}
+
+// ErrPending is returned for images, whose platforms are being resolved in the background.
+var ErrPending = errors.New("platforms of the image are being resolved")
+
+// Resolver resolves the platforms of images from allowed registries in the background.
+// It fetches their manifests anonymously and caches the platforms by image and by digest.
+type Resolver struct {
+	client     *http.Client
+	ttl        time.Duration
+	registries []string
+	// OnResolved is called with every image resolved in the background. It must be set before Run.
+	OnResolved func(image string)
+	queue      chan string
+	mu         sync.Mutex
+	cache      map[string]cachedPlatforms
+	// digests holds the platforms of manifests, so tags pointing to known digests are not fetched again
+	digests map[string]cachedPlatforms
+	pending map[string]bool
+}
+
+type cachedPlatforms struct {
+	platforms []Platform
+	err       error
+	expires   time.Time
+}
+
+// NewResolver returns a Resolver for images of the registries caching their platforms,
+// or the failure to resolve them, for the ttl. Registries are given as host[:port], docker.io
+// refers to docker hub.
+func NewResolver(client *http.Client, ttl time.Duration, registries []string) *Resolver {
+	allowed := make([]string, 0, len(registries))
+	for _, registry := range registries {
+		if registry == dockerHubDomain {
+			registry = dockerHubRegistry
+		}
+		allowed = append(allowed, registry)
+	}
+	return &Resolver{
+		client:     client,
+		ttl:        ttl,
+		registries: allowed,
+		queue:      make(chan string, resolveQueueLength),
+		cache:      make(map[string]cachedPlatforms),
+		digests:    make(map[string]cachedPlatforms),
+		pending:    make(map[string]bool),
+	}
+}
+
+// Platforms returns the cached platforms the image is available for. Images not cached yet
+// are queued for resolution and ErrPending is returned, expired ones are served until refreshed.
+func (r *Resolver) Platforms(image string) ([]Platform, error) {
+	ref, err := parseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(r.registries, ref.registry) {
+		return nil, fmt.Errorf("registry %s of image %s is not allowed", ref.registry, image)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cached, ok := r.cache[image]
+	if ok && time.Now().Before(cached.expires) {
+		return cached.platforms, cached.err
+	}
+	if !r.pending[image] {
+		select {
+		case r.queue <- image:
+			r.pending[image] = true
+		default:
+			// the queue is full, the image is queued on the next lookup
+		}
+	}
+	if ok {
+		return cached.platforms, cached.err
+	}
+	return nil, ErrPending
+}
+
+// Run resolves the queued images until the context is done.
+func (r *Resolver) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range resolveWorkers {
+		wg.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case image := <-r.queue:
+					r.refresh(ctx, image)
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func (r *Resolver) refresh(ctx context.Context, image string) {
+	platforms, err := r.resolve(ctx, image)
+	now := time.Now()
+	r.mu.Lock()
+	delete(r.pending, image)
+	if ctx.Err() != nil {
+		r.mu.Unlock()
+		return
+	}
+	// expired entries are pruned, so images no longer running are not kept forever
+	expired := func(_ string, cached cachedPlatforms) bool {
+		return !now.Before(cached.expires)
+	}
+	maps.DeleteFunc(r.cache, expired)
+	maps.DeleteFunc(r.digests, expired)
+	r.cache[image] = cachedPlatforms{platforms: platforms, err: err, expires: now.Add(r.ttl)}
+	r.mu.Unlock()
+	if r.OnResolved != nil {
+		r.OnResolved(image)
+	}
+}
+
+// manifest holds the fields of image indexes and image manifests required to determine their platforms.
+type manifest struct {
+	Manifests []struct {
+		Platform *struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform"`
+	} `json:"manifests"`
+	Config *struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+}
+
+// imageConfig holds the platform fields of an image configuration.
+type imageConfig struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+}
+
+// resolve determines the digest of the image with a HEAD request, which does not count against
+// the rate limit of docker hub, and fetches its manifest only, if the digest is not known yet.
+func (r *Resolver) resolve(ctx context.Context, image string) ([]Platform, error) {
+	ref, err := parseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	repo := &repository{resolver: r, ref: ref}
+	digest := ref.reference
+	if !strings.Contains(digest, ":") {
+		digest, err = repo.digest(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine digest of image %s: %w", image, err)
+		}
+	}
+	if digest == "" {
+		platforms, err := repo.platforms(ctx, ref.reference)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve platforms of image %s: %w", image, err)
+		}
+		return platforms, nil
+	}
+	if platforms, ok := r.cachedDigest(digest); ok {
+		return platforms, nil
+	}
+	platforms, err := repo.platforms(ctx, digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve platforms of image %s: %w", image, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.digests[digest] = cachedPlatforms{platforms: platforms, expires: time.Now().Add(r.ttl)}
+	return platforms, nil
+}
+
+// cachedDigest returns the platforms of the digest and extends their expiry, as digests are immutable.
+func (r *Resolver) cachedDigest(digest string) ([]Platform, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cached, ok := r.digests[digest]
+	if !ok {
+		return nil, false
+	}
+	cached.expires = time.Now().Add(r.ttl)
+	r.digests[digest] = cached
+	return cached.platforms, true
+}
+
+// repository sends the requests for an image, reusing the anonymous bearer token of the registry.
+type repository struct {
+	resolver *Resolver
+	ref      reference
+	token    string
+}
+
+// digest returns the digest of the manifest the tag of the image points to, if the registry reports it.
+func (repo *repository) digest(ctx context.Context) (string, error) {
+	response, err := repo.request(ctx, http.MethodHead, "manifests/"+repo.ref.reference, acceptManifests)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry responded with %s", response.Status)
+	}
+	return response.Header.Get("Docker-Content-Digest"), nil
+}
+
+// platforms returns the platforms of the image index or manifest of the digest or tag.
+func (repo *repository) platforms(ctx context.Context, reference string) ([]Platform, error) {
+	var index manifest
+	if err := repo.fetch(ctx, "manifests/"+reference, acceptManifests, &index); err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	if len(index.Manifests) > 0 {
+		platforms := make([]Platform, 0, len(index.Manifests))
+		for _, m := range index.Manifests {
+			// attestations are listed with an unknown platform
+			if m.Platform == nil || m.Platform.OS == unknownPlatformAttestation {
+				continue
+			}
+			platforms = append(platforms, Platform{OS: m.Platform.OS, Architecture: m.Platform.Architecture})
+		}
+		return platforms, nil
+	}
+	if index.Config == nil || index.Config.Digest == "" {
+		return nil, errors.New("manifest has neither manifests nor config")
+	}
+	var config imageConfig
+	if err := repo.fetch(ctx, "blobs/"+index.Config.Digest, "*/*", &config); err != nil {
+		return nil, fmt.Errorf("failed to fetch config: %w", err)
+	}
+	return []Platform{{OS: config.OS, Architecture: config.Architecture}}, nil
+}
+
+// fetch decodes the response of the registry api for the path below the repository.
+func (repo *repository) fetch(ctx context.Context, path, accept string, into any) error {
+	response, err := repo.request(ctx, http.MethodGet, path, accept)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry responded with %s", response.Status)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, maxResponseBytes)).Decode(into)
+}
+
+// request sends a request for the path below the repository.
+// Registries requiring a bearer token are authenticated anonymously.
+func (repo *repository) request(ctx context.Context, method, path, accept string) (*http.Response, error) {
+	endpoint := fmt.Sprintf("https://%s/v2/%s/%s", repo.ref.registry, repo.ref.repository, path)
+	response, err := repo.resolver.send(ctx, method, endpoint, accept, repo.token)
+	if err != nil || response.StatusCode != http.StatusUnauthorized || repo.token != "" {
+		return response, err
+	}
+	challenge := response.Header.Get("WWW-Authenticate")
+	response.Body.Close()
+	repo.token, err = repo.resolver.token(ctx, repo.ref.registry, challenge)
+	if err != nil {
+		return nil, err
+	}
+	return repo.resolver.send(ctx, method, endpoint, accept, repo.token)
+}
+
+func (r *Resolver) send(ctx context.Context, method, endpoint, accept, token string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, endpoint, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", accept)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r.client.Do(request)
+}
+
+// token requests an anonymous bearer token as described by the challenge of the registry.
+// The realm must be served via https by the registry, another host of its domain or an allowed registry.
+func (r *Resolver) token(ctx context.Context, registry, challenge string) (string, error) {
+	params, ok := parseBearerChallenge(challenge)
+	if !ok || params["realm"] == "" {
+		return "", errors.New("registry requires authentication other than an anonymous bearer token")
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", fmt.Errorf("invalid realm of bearer challenge: %w", err)
+	}
+	if realm.Scheme != "https" || !r.trustedRealm(registry, realm.Host) {
+		return "", fmt.Errorf("realm %s of bearer challenge is not trusted for registry %s", realm.Redacted(), registry)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if value, ok := params[key]; ok {
+			query.Set(key, value)
+		}
+	}
+	realm.RawQuery = query.Encode()
+	response, err := r.send(ctx, http.MethodGet, realm.String(), "application/json", "")
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint responded with %s", response.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, maxResponseBytes)).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode token: %w", err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// trustedRealm returns true, if the host of the realm is the registry, an allowed registry
+// or shares the parent domain of the registry, e.g. auth.docker.io for registry-1.docker.io.
+func (r *Resolver) trustedRealm(registry, host string) bool {
+	if host == registry || slices.Contains(r.registries, host) {
+		return true
+	}
+	registryHost, realmHost := hostname(registry), hostname(host)
+	_, parent, ok := strings.Cut(registryHost, ".")
+	return ok && strings.Contains(parent, ".") && strings.HasSuffix(realmHost, "."+parent)
+}
+
+// hostname strips the port of the host.
+func hostname(host string) string {
+	return (&url.URL{Host: host}).Hostname()
+}
+
+// parseBearerChallenge returns the parameters of a WWW-Authenticate header of the bearer scheme.
+func parseBearerChallenge(challenge string) (map[string]string, bool) {
+	scheme, rest, ok := strings.Cut(challenge, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for rest != "" {
+		var key, value string
+		key, rest, ok = strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return params, true
+}
+
+// reference is an image reference split into the parts addressing its manifest.
+type reference struct {
+	registry   string
+	repository string
+	// reference is the digest or tag of the image
+	reference string
+}
+
+// parseReference splits an image reference like the container runtime does,
+// so images without registry refer to docker hub and images without tag to latest.
+func parseReference(image string) (reference, error) {
+	if image == "" {
+		return reference{}, errors.New("empty image reference")
+	}
+	name, digest, hasDigest := strings.Cut(image, "@")
+	ref := "latest"
+	// the tag is ignored, if a digest is given, as the runtime pulls by digest
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref = name[:i], name[i+1:]
+	}
+	if hasDigest {
+		ref = digest
+	}
+	registry, repository := dockerHubDomain, name
+	if domain, rest, ok := strings.Cut(name, "/"); ok &&
+		(strings.ContainsAny(domain, ".:") || domain == "localhost") {
+
+		registry, repository = domain, rest
+	}
+	if registry == dockerHubDomain {
+		registry = dockerHubRegistry
+		if !strings.Contains(repository, "/") {
+			repository = "library/" + repository
+		}
+	}
+	return reference{registry: registry, repository: repository, reference: ref}, nil
+}
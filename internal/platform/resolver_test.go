@@ -0,0 +1,226 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package platform_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/sapcc/vpa_butler/internal/platform"
+)
+
+var _ = Describe("Resolver", func() {
+
+	var registry *httptest.Server
+	var requests, fetches atomic.Int32
+	var resolver *platform.Resolver
+	var cancel context.CancelFunc
+
+	// tags maps the manifests of tags to the digests they point to
+	tags := map[string]string{
+		"/v2/multi/app/manifests/v1":      "sha256:index",
+		"/v2/multi/app/manifests/v3":      "sha256:index",
+		"/v2/single/app/manifests/latest": "sha256:single",
+		"/v2/private/app/manifests/v1":    "sha256:private",
+	}
+	manifests := map[string]string{
+		"/v2/multi/app/manifests/sha256:index": `{"manifests":[` +
+			`{"platform":{"os":"linux","architecture":"amd64"}},` +
+			`{"platform":{"os":"linux","architecture":"arm64"}},` +
+			`{"platform":{"os":"unknown","architecture":"unknown"}}]}`,
+		"/v2/single/app/manifests/sha256:single":   `{"config":{"digest":"sha256:config"}}`,
+		"/v2/single/app/blobs/sha256:config":       `{"os":"linux","architecture":"arm64"}`,
+		"/v2/private/app/manifests/sha256:private": `{"manifests":[{"platform":{"os":"linux","architecture":"s390x"}}]}`,
+		"/v2/undigested/app/manifests/v1":          `{"manifests":[{"platform":{"os":"linux","architecture":"amd64"}}]}`,
+	}
+	// realms are the bearer challenges of repositories requiring a token
+	realms := map[string]string{
+		"/v2/private/": "https://%s/token",
+		"/v2/foreign/": "https://example.com/token",
+		"/v2/plain/":   "http://%s/token",
+	}
+
+	start := func(registries []string, ttl time.Duration) {
+		resolver = platform.NewResolver(registry.Client(), ttl, registries)
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		go resolver.Run(ctx)
+	}
+
+	BeforeEach(func() {
+		requests.Store(0)
+		fetches.Store(0)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Query().Get("scope")).To(Equal("repository:private/app:pull"))
+			fmt.Fprint(w, `{"token":"anonymous"}`)
+		})
+		mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			for prefix, realm := range realms {
+				if strings.HasPrefix(r.URL.Path, prefix) && r.Header.Get("Authorization") != "Bearer anonymous" {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+						`Bearer realm="`+realm+`",service="registry",scope="repository:private/app:pull"`, r.Host))
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			}
+			if digest, ok := tags[r.URL.Path]; ok {
+				w.Header().Set("Docker-Content-Digest", digest)
+				if r.Method == http.MethodHead {
+					return
+				}
+				r.URL.Path = path.Join(path.Dir(r.URL.Path), digest)
+			}
+			body, ok := manifests[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == http.MethodGet {
+				fetches.Add(1)
+			}
+			fmt.Fprint(w, body)
+		})
+		registry = httptest.NewTLSServer(mux)
+		start([]string{host(registry)}, time.Hour)
+	})
+
+	AfterEach(func() {
+		cancel()
+		registry.Close()
+	})
+
+	image := func(name string) string {
+		return host(registry) + "/" + name
+	}
+
+	resolved := func(image string) func() error {
+		return func() error {
+			_, err := resolver.Platforms(image)
+			return err
+		}
+	}
+
+	It("resolves the platforms of an image index in the background", func() {
+		_, err := resolver.Platforms(image("multi/app:v1"))
+		Expect(err).To(MatchError(platform.ErrPending))
+		Eventually(func() ([]platform.Platform, error) {
+			return resolver.Platforms(image("multi/app:v1"))
+		}).Should(Equal([]platform.Platform{
+			{OS: "linux", Architecture: "amd64"},
+			{OS: "linux", Architecture: "arm64"},
+		}))
+	})
+
+	It("notifies about resolved images", func() {
+		cancel()
+		notified := make(chan string, 1)
+		resolver = platform.NewResolver(registry.Client(), time.Hour, []string{host(registry)})
+		resolver.OnResolved = func(image string) { notified <- image }
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		go resolver.Run(ctx)
+		_, err := resolver.Platforms(image("multi/app:v1"))
+		Expect(err).To(MatchError(platform.ErrPending))
+		Eventually(notified).Should(Receive(Equal(image("multi/app:v1"))))
+	})
+
+	It("resolves an image referenced by tag and digest by its digest", func() {
+		Eventually(func() ([]platform.Platform, error) {
+			return resolver.Platforms(image("multi/app:v2@sha256:index"))
+		}).Should(HaveLen(2))
+	})
+
+	It("resolves the platform of a single manifest from its config", func() {
+		Eventually(func() ([]platform.Platform, error) {
+			return resolver.Platforms(image("single/app"))
+		}).Should(Equal([]platform.Platform{{OS: "linux", Architecture: "arm64"}}))
+	})
+
+	It("resolves tags without digest", func() {
+		Eventually(func() ([]platform.Platform, error) {
+			return resolver.Platforms(image("undigested/app:v1"))
+		}).Should(Equal([]platform.Platform{{OS: "linux", Architecture: "amd64"}}))
+	})
+
+	It("authenticates with an anonymous bearer token", func() {
+		Eventually(func() ([]platform.Platform, error) {
+			return resolver.Platforms(image("private/app:v1"))
+		}).Should(Equal([]platform.Platform{{OS: "linux", Architecture: "s390x"}}))
+	})
+
+	It("does not request tokens from untrusted realms", func() {
+		Eventually(resolved(image("foreign/app:v1"))).Should(MatchError(ContainSubstring("not trusted")))
+		Eventually(resolved(image("plain/app:v1"))).Should(MatchError(ContainSubstring("not trusted")))
+	})
+
+	It("trusts realms on the domain of the registry", func() {
+		resolver = platform.NewResolver(nil, time.Hour, []string{"docker.io", "auth.example.com"})
+		Expect(resolver.TrustedRealm("registry-1.docker.io", "auth.docker.io")).To(BeTrue())
+		Expect(resolver.TrustedRealm("ghcr.io", "ghcr.io")).To(BeTrue())
+		Expect(resolver.TrustedRealm("ghcr.io", "auth.example.com")).To(BeTrue())
+		Expect(resolver.TrustedRealm("ghcr.io", "example.io")).To(BeFalse())
+		Expect(resolver.TrustedRealm("registry-1.docker.io", "docker.io.example.com")).To(BeFalse())
+	})
+
+	It("rejects images of registries not allowed", func() {
+		start([]string{"docker.io"}, time.Hour)
+		_, err := resolver.Platforms(image("multi/app:v1"))
+		Expect(err).To(MatchError(ContainSubstring("is not allowed")))
+		Consistently(requests.Load).Should(BeZero())
+	})
+
+	It("caches platforms and failures", func() {
+		Eventually(resolved(image("multi/app:v1"))).Should(Succeed())
+		Eventually(resolved(image("missing/app:v1"))).Should(And(
+			HaveOccurred(), Not(MatchError(platform.ErrPending))))
+		before := requests.Load()
+		Expect(resolved(image("multi/app:v1"))()).To(Succeed())
+		Expect(resolved(image("missing/app:v1"))()).To(HaveOccurred())
+		Expect(requests.Load()).To(Equal(before))
+	})
+
+	It("fetches the manifest of a digest once", func() {
+		Eventually(resolved(image("multi/app:v1"))).Should(Succeed())
+		Eventually(resolved(image("multi/app:v3"))).Should(Succeed())
+		Expect(fetches.Load()).To(BeEquivalentTo(1))
+	})
+
+	It("prunes expired images from the cache", func() {
+		cancel()
+		start([]string{host(registry)}, time.Nanosecond)
+		Eventually(resolver.CachedImages).Should(Equal(0))
+		_, err := resolver.Platforms(image("multi/app:v1"))
+		Expect(err).To(MatchError(platform.ErrPending))
+		Eventually(resolver.CachedImages).Should(Equal(1))
+		_, err = resolver.Platforms(image("single/app"))
+		Expect(err).To(MatchError(platform.ErrPending))
+		// expired platforms are served until refreshed
+		Eventually(resolved(image("single/app"))).Should(Succeed())
+		Expect(resolver.CachedImages()).To(Equal(1))
+	})
+})
+
+func host(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "https://")
+}
+
+var _ = Describe("Platform", func() {
+
+	It("matches any value of empty fields", func() {
+		Expect(platform.Platform{Architecture: "arm64"}.Matches("linux", "arm64")).To(BeTrue())
+		Expect(platform.Platform{OS: "linux", Architecture: "arm64"}.Matches("", "")).To(BeTrue())
+		Expect(platform.Platform{OS: "linux", Architecture: "arm64"}.Matches("linux", "amd64")).To(BeFalse())
+	})
+})
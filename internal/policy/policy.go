@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/sapcc/vpa_butler/api/v1alpha1"
+)
+
+// Find returns the ButlerPolicy with the highest priority matching the given workload.
+// Ties are broken by the name of the policies. If no policy matches nil is returned.
+// Policies with invalid selectors are skipped, so they do not prevent the other ones from
+// applying. They are reported in their status by the PolicyController.
+func Find(ctx context.Context, c client.Reader, kind string, workload metav1.Object) (*v1alpha1.ButlerPolicy, error) {
+	var policies v1alpha1.ButlerPolicyList
+	if err := c.List(ctx, &policies); err != nil {
+		return nil, fmt.Errorf("failed to list butler policies: %w", err)
+	}
+	if len(policies.Items) == 0 {
+		return nil, nil
+	}
+	var namespace corev1.Namespace
+	if err := c.Get(ctx, types.NamespacedName{Name: workload.GetNamespace()}, &namespace); err != nil {
+		return nil, fmt.Errorf("failed to fetch namespace %s: %w", workload.GetNamespace(), err)
+	}
+	var best *v1alpha1.ButlerPolicy
+	for i := range policies.Items {
+		current := &policies.Items[i]
+		matches, err := Matches(current, &namespace, kind, workload)
+		if err != nil {
+			log.FromContext(ctx).V(1).Info("skipping butler policy with invalid selector",
+				"policy", current.Name, "error", err.Error())
+			continue
+		}
+		if !matches {
+			continue
+		}
+		if best == nil || current.Spec.Priority > best.Spec.Priority ||
+			(current.Spec.Priority == best.Spec.Priority && current.Name < best.Name) {
+			best = current
+		}
+	}
+	return best, nil
+}
+
+// Matches checks whether the policy applies to the given workload of the given kind.
+func Matches(policy *v1alpha1.ButlerPolicy, namespace *corev1.Namespace, kind string, workload metav1.Object) (bool, error) {
+	if len(policy.Spec.Kinds) > 0 && !slices.Contains(policy.Spec.Kinds, kind) {
+		return false, nil
+	}
+	matches, err := matchesSelector(policy.Spec.NamespaceSelector, namespace.Labels)
+	if err != nil || !matches {
+		return false, err
+	}
+	return matchesSelector(policy.Spec.WorkloadSelector, workload.GetLabels())
+}
+
+// Validate returns an error, if a selector of the policy is invalid.
+func Validate(policy *v1alpha1.ButlerPolicy) error {
+	if _, err := matchesSelector(policy.Spec.NamespaceSelector, nil); err != nil {
+		return fmt.Errorf("namespace selector: %w", err)
+	}
+	if _, err := matchesSelector(policy.Spec.WorkloadSelector, nil); err != nil {
+		return fmt.Errorf("workload selector: %w", err)
+	}
+	return nil
+}
+
+func matchesSelector(selector *metav1.LabelSelector, set map[string]string) (bool, error) {
+	if selector == nil {
+		return true, nil
+	}
+	converted, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false, fmt.Errorf("invalid label selector: %w", err)
+	}
+	return converted.Matches(labels.Set(set)), nil
+}
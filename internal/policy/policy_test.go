@@ -0,0 +1,128 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package policy_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/sapcc/vpa_butler/api/v1alpha1"
+	"github.com/sapcc/vpa_butler/internal/policy"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func makePolicy(name string, priority int32) v1alpha1.ButlerPolicy {
+	var result v1alpha1.ButlerPolicy
+	result.Name = name
+	result.Spec.Priority = priority
+	return result
+}
+
+var _ = Describe("Matches", func() {
+
+	var namespace corev1.Namespace
+	var deployment appsv1.Deployment
+
+	BeforeEach(func() {
+		namespace = corev1.Namespace{}
+		namespace.Name = "tenant"
+		namespace.Labels = map[string]string{"team": "a"}
+		deployment = appsv1.Deployment{}
+		deployment.Name = "app"
+		deployment.Namespace = namespace.Name
+		deployment.Labels = map[string]string{"tier": "backend"}
+	})
+
+	It("matches everything without selectors and kinds", func() {
+		p := makePolicy("all", 0)
+		Expect(policy.Matches(&p, &namespace, "Deployment", &deployment)).To(BeTrue())
+	})
+
+	It("does not match other kinds", func() {
+		p := makePolicy("sts", 0)
+		p.Spec.Kinds = []string{"StatefulSet"}
+		Expect(policy.Matches(&p, &namespace, "Deployment", &deployment)).To(BeFalse())
+	})
+
+	It("respects the namespace selector", func() {
+		p := makePolicy("team-b", 0)
+		p.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"team": "b"}}
+		Expect(policy.Matches(&p, &namespace, "Deployment", &deployment)).To(BeFalse())
+		p.Spec.NamespaceSelector.MatchLabels["team"] = "a"
+		Expect(policy.Matches(&p, &namespace, "Deployment", &deployment)).To(BeTrue())
+	})
+
+	It("respects the workload selector", func() {
+		p := makePolicy("frontend", 0)
+		p.Spec.WorkloadSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "frontend"}}
+		Expect(policy.Matches(&p, &namespace, "Deployment", &deployment)).To(BeFalse())
+	})
+
+})
+
+var _ = Describe("Find", func() {
+
+	var scheme *runtime.Scheme
+	var namespace *corev1.Namespace
+	var deployment *appsv1.Deployment
+
+	BeforeEach(func() {
+		scheme = runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+		namespace = &corev1.Namespace{}
+		namespace.Name = "tenant"
+		deployment = &appsv1.Deployment{}
+		deployment.Name = "app"
+		deployment.Namespace = namespace.Name
+	})
+
+	It("returns nil if no policy exists", func() {
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace).Build()
+		Expect(policy.Find(context.Background(), c, "Deployment", deployment)).To(BeNil())
+	})
+
+	It("returns the matching policy with the highest priority", func() {
+		low := makePolicy("low", 1)
+		high := makePolicy("high", 10)
+		other := makePolicy("other", 100)
+		other.Spec.Kinds = []string{"DaemonSet"}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace, &low, &high, &other).Build()
+		result, err := policy.Find(context.Background(), c, "Deployment", deployment)
+		Expect(err).To(Succeed())
+		Expect(result.Name).To(Equal("high"))
+	})
+
+	It("skips policies with invalid selectors", func() {
+		invalid := makePolicy("invalid", 10)
+		invalid.Spec.WorkloadSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "tier", Operator: metav1.LabelSelectorOpIn},
+		}}
+		valid := makePolicy("valid", 1)
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace, &invalid, &valid).Build()
+		result, err := policy.Find(context.Background(), c, "Deployment", deployment)
+		Expect(err).To(Succeed())
+		Expect(result.Name).To(Equal("valid"))
+		Expect(policy.Validate(&invalid)).To(MatchError(ContainSubstring("workload selector")))
+		Expect(policy.Validate(&valid)).To(Succeed())
+	})
+
+	It("breaks ties by name", func() {
+		b := makePolicy("b", 1)
+		a := makePolicy("a", 1)
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace, &b, &a).Build()
+		result, err := policy.Find(context.Background(), c, "Deployment", deployment)
+		Expect(err).To(Succeed())
+		Expect(result.Name).To(Equal("a"))
+	})
+
+})
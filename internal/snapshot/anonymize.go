@@ -0,0 +1,229 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package snapshot
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+
+	"github.com/sapcc/vpa_butler/internal/common"
+)
+
+// keptLabelKeys are the well-known labels of nodes, whose values describe the platform and
+// topology instead of naming anything specific to the cluster.
+var keptLabelKeys = []string{
+	corev1.LabelOSStable, corev1.LabelArchStable, corev1.LabelTopologyZone, corev1.LabelTopologyRegion,
+	corev1.LabelInstanceTypeStable,
+}
+
+// Anonymizer replaces the names of namespaces, nodes and namespaced objects by pseudonyms,
+// which are consistent across all objects passed to the same Anonymizer. References between
+// objects, i.e. owner references and the targets of vpas and hpas, are kept intact. Served vpas
+// are named after the pseudonym of their target like the vpa_butler does.
+// ConfigMaps keep their name and namespace, so node templates can still be referenced. The values of labels are
+// replaced by pseudonyms as well, within metadata, label selectors, node selectors and node affinities
+// as well as the labels of node templates, so selectors keep matching. Only the values of well-known
+// labels describing the platform and topology of nodes are kept.
+type Anonymizer struct {
+	pseudonyms map[string]string
+	counts     map[string]int
+}
+
+func NewAnonymizer() *Anonymizer {
+	return &Anonymizer{
+		pseudonyms: make(map[string]string),
+		counts:     make(map[string]int),
+	}
+}
+
+// Anonymize replaces the names within the object. The images of containers are removed.
+func (a *Anonymizer) Anonymize(obj *unstructured.Unstructured) {
+	namespace := obj.GetNamespace()
+	a.replaceLabelValues(obj.Object)
+	switch obj.GetKind() {
+	case "Namespace":
+		obj.SetName(a.pseudonym("namespace", "", obj.GetName()))
+		return
+	case "Node":
+		obj.SetName(a.pseudonym("node", "", obj.GetName()))
+		return
+	}
+	if namespace == "" {
+		return
+	}
+	if obj.GetKind() == "ConfigMap" {
+		// keeps its name and namespace to be referenced as node templates
+		a.replaceTemplateLabelValues(obj)
+		return
+	}
+	obj.SetNamespace(a.pseudonym("namespace", "", namespace))
+	owners := obj.GetOwnerReferences()
+	for i := range owners {
+		owners[i].Name = a.pseudonym("workload", namespace, owners[i].Name)
+	}
+	if len(owners) > 0 {
+		obj.SetOwnerReferences(owners)
+	}
+	switch obj.GetKind() {
+	case "VerticalPodAutoscaler":
+		target := a.renameTarget(obj, namespace, "spec", "targetRef", "name")
+		kind, _, _ := unstructured.NestedString(obj.Object, "spec", "targetRef", "kind")
+		if obj.GetAnnotations()[common.AnnotationManagedBy] == common.AnnotationVpaButler && target != "" {
+			obj.SetName(target + "-" + strings.ToLower(kind))
+		} else {
+			obj.SetName(a.pseudonym("vpa", namespace, obj.GetName()))
+		}
+	case "HorizontalPodAutoscaler":
+		a.renameTarget(obj, namespace, "spec", "scaleTargetRef", "name")
+		obj.SetName(a.pseudonym("hpa", namespace, obj.GetName()))
+	default:
+		obj.SetName(a.pseudonym("workload", namespace, obj.GetName()))
+		removeImages(obj.Object)
+	}
+}
+
+// pseudonym returns the pseudonym of the name within the namespace, numbering new ones per prefix.
+func (a *Anonymizer) pseudonym(prefix, namespace, name string) string {
+	key := prefix + "/" + namespace + "/" + name
+	if pseudonym, ok := a.pseudonyms[key]; ok {
+		return pseudonym
+	}
+	a.counts[prefix]++
+	pseudonym := fmt.Sprintf("%s-%d", prefix, a.counts[prefix])
+	a.pseudonyms[key] = pseudonym
+	return pseudonym
+}
+
+// renameTarget replaces the name of the workload referenced at the path and returns its pseudonym.
+func (a *Anonymizer) renameTarget(obj *unstructured.Unstructured, namespace string, path ...string) string {
+	target, _, _ := unstructured.NestedString(obj.Object, path...)
+	if target == "" {
+		return ""
+	}
+	target = a.pseudonym("workload", namespace, target)
+	if err := unstructured.SetNestedField(obj.Object, target, path...); err != nil {
+		return ""
+	}
+	return target
+}
+
+// labelValue returns the pseudonym of the value of the label. Hostnames and namespace names
+// are replaced like the names of nodes and namespaces.
+func (a *Anonymizer) labelValue(key, value string) string {
+	switch {
+	case value == "" || slices.Contains(keptLabelKeys, key):
+		return value
+	case key == corev1.LabelHostname:
+		return a.pseudonym("node", "", value)
+	case key == corev1.LabelMetadataName:
+		return a.pseudonym("namespace", "", value)
+	}
+	return a.pseudonym("label", key, value)
+}
+
+// replaceLabelValues walks the value replacing the values of labels, of label selectors,
+// of node selectors and of the requirements of node affinities.
+func (a *Anonymizer) replaceLabelValues(value any) {
+	switch typed := value.(type) {
+	case map[string]any:
+		for key, nested := range typed {
+			switch key {
+			case "labels", "matchLabels", "nodeSelector":
+				if labels, ok := nested.(map[string]any); ok {
+					for label, labelValue := range labels {
+						if s, ok := labelValue.(string); ok {
+							labels[label] = a.labelValue(label, s)
+						}
+					}
+				}
+			case "matchExpressions":
+				a.replaceRequirementValues(nested, a.labelValue)
+			case "matchFields":
+				// the only field supported by node affinities is the name of the node
+				a.replaceRequirementValues(nested, func(_, name string) string {
+					return a.pseudonym("node", "", name)
+				})
+			default:
+				a.replaceLabelValues(nested)
+			}
+		}
+	case []any:
+		for _, nested := range typed {
+			a.replaceLabelValues(nested)
+		}
+	}
+}
+
+// replaceRequirementValues replaces the values of a list of selector requirements.
+func (a *Anonymizer) replaceRequirementValues(value any, replace func(key, value string) string) {
+	requirements, ok := value.([]any)
+	if !ok {
+		return
+	}
+	for _, requirement := range requirements {
+		fields, ok := requirement.(map[string]any)
+		if !ok {
+			continue
+		}
+		key, _ := fields["key"].(string)
+		values, _ := fields["values"].([]any)
+		for i, v := range values {
+			if s, ok := v.(string); ok {
+				values[i] = replace(key, s)
+			}
+		}
+	}
+}
+
+// replaceTemplateLabelValues replaces the values of the labels within node templates, so they
+// keep matching the node selectors of workloads. Other data of the ConfigMap is kept as is.
+func (a *Anonymizer) replaceTemplateLabelValues(obj *unstructured.Unstructured) {
+	data, _, _ := unstructured.NestedStringMap(obj.Object, "data")
+	if len(data) == 0 {
+		return
+	}
+	for name, content := range data {
+		var template map[string]any
+		if err := yaml.Unmarshal([]byte(content), &template); err != nil {
+			continue
+		}
+		if _, ok := template["labels"]; !ok {
+			continue
+		}
+		a.replaceLabelValues(template)
+		if replaced, err := yaml.Marshal(template); err == nil {
+			data[name] = string(replaced)
+		}
+	}
+	_ = unstructured.SetNestedStringMap(obj.Object, data, "data")
+}
+
+func removeImages(value any) {
+	switch typed := value.(type) {
+	case map[string]any:
+		for _, key := range containerListKeys {
+			containers, ok := typed[key].([]any)
+			if !ok {
+				continue
+			}
+			for _, container := range containers {
+				if fields, ok := container.(map[string]any); ok {
+					delete(fields, "image")
+				}
+			}
+		}
+		for _, nested := range typed {
+			removeImages(nested)
+		}
+	case []any:
+		for _, nested := range typed {
+			removeImages(nested)
+		}
+	}
+}
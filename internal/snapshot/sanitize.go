@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package snapshot
+
+import (
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/sapcc/vpa_butler/internal/common"
+)
+
+// keptAnnotationPrefixes are the prefixes of the annotations read or written by the vpa_butler.
+var keptAnnotationPrefixes = []string{"vpa-butler.cloud.sap/", "cloud.sap/vpa-butler-"}
+
+// containerListKeys are the keys of pod specs holding containers.
+var containerListKeys = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// strippedContainerKeys are the fields of containers, which may contain secrets
+// or reference them and are not read by the vpa_butler.
+var strippedContainerKeys = []string{
+	"env", "envFrom", "command", "args", "volumeMounts", "livenessProbe", "readinessProbe", "startupProbe", "lifecycle",
+}
+
+// strippedPodSpecKeys are the fields of pod specs, which may reference secrets and are not read by the vpa_butler.
+var strippedPodSpecKeys = []string{"volumes", "imagePullSecrets"}
+
+// keptNodeStatusKeys are the fields of the node status read by the vpa_butler.
+var keptNodeStatusKeys = []string{"allocatable", "capacity", "conditions"}
+
+// Sanitize removes data, which is not read by the vpa_butler and might be sensitive, from the object.
+// That is the managed fields, annotations other than the ones of the vpa_butler, the status of objects
+// other than nodes and vpas as well as the environment, commands, arguments, probes and volumes of
+// containers. Secrets must never be passed.
+func Sanitize(obj *unstructured.Unstructured) {
+	unstructured.RemoveNestedField(obj.Object, "metadata", "managedFields")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "resourceVersion")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "selfLink")
+	switch obj.GetKind() {
+	case "VerticalPodAutoscaler":
+		// the recommendations are read by the Recommendation distribution mode
+	case "Node":
+		status, _, _ := unstructured.NestedMap(obj.Object, "status")
+		for key := range status {
+			if !slices.Contains(keptNodeStatusKeys, key) {
+				delete(status, key)
+			}
+		}
+		if len(status) == 0 {
+			unstructured.RemoveNestedField(obj.Object, "status")
+		} else {
+			obj.Object["status"] = status
+		}
+	default:
+		unstructured.RemoveNestedField(obj.Object, "status")
+	}
+	sanitizeValue(obj.Object)
+}
+
+// sanitizeValue walks the value filtering annotations of any object metadata and stripping pod specs.
+func sanitizeValue(value any) {
+	switch typed := value.(type) {
+	case map[string]any:
+		if metadata, ok := typed["metadata"].(map[string]any); ok {
+			filterAnnotations(metadata)
+		}
+		isPodSpec := false
+		for _, key := range containerListKeys {
+			containers, ok := typed[key].([]any)
+			if !ok {
+				continue
+			}
+			isPodSpec = true
+			for _, container := range containers {
+				if fields, ok := container.(map[string]any); ok {
+					for _, stripped := range strippedContainerKeys {
+						delete(fields, stripped)
+					}
+				}
+			}
+		}
+		if isPodSpec {
+			for _, stripped := range strippedPodSpecKeys {
+				delete(typed, stripped)
+			}
+		}
+		for _, nested := range typed {
+			sanitizeValue(nested)
+		}
+	case []any:
+		for _, nested := range typed {
+			sanitizeValue(nested)
+		}
+	}
+}
+
+func filterAnnotations(metadata map[string]any) {
+	annotations, ok := metadata["annotations"].(map[string]any)
+	if !ok {
+		return
+	}
+	for key := range annotations {
+		if key == common.AnnotationManagedBy || hasAnyPrefix(key, keptAnnotationPrefixes) {
+			continue
+		}
+		delete(annotations, key)
+	}
+	if len(annotations) == 0 {
+		delete(metadata, "annotations")
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
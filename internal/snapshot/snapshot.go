@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const decoderBufferSize = 4096
+
+// Read decodes the objects of a snapshot, which is a multi-document YAML or JSON stream.
+// Lists, e.g. the output of kubectl get -o yaml, are flattened. Objects of kinds known
+// to the scheme are converted to their typed representation, all others are kept unstructured.
+func Read(r io.Reader, scheme *runtime.Scheme) ([]client.Object, error) {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, decoderBufferSize)
+	objects := make([]client.Object, 0)
+	for {
+		var u unstructured.Unstructured
+		err := decoder.Decode(&u.Object)
+		if errors.Is(err, io.EOF) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+		}
+		// empty documents
+		if len(u.Object) == 0 {
+			continue
+		}
+		if !u.IsList() {
+			obj, err := convert(&u, scheme)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, obj)
+			continue
+		}
+		err = u.EachListItem(func(item runtime.Object) error {
+			itemUnstructured, ok := item.(*unstructured.Unstructured)
+			if !ok {
+				return fmt.Errorf("unexpected list item of type %T", item)
+			}
+			obj, err := convert(itemUnstructured, scheme)
+			if err != nil {
+				return err
+			}
+			objects = append(objects, obj)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func convert(u *unstructured.Unstructured, scheme *runtime.Scheme) (client.Object, error) {
+	gvk := u.GroupVersionKind()
+	if gvk.Kind == "" {
+		return nil, fmt.Errorf("object %s/%s within snapshot has no kind", u.GetNamespace(), u.GetName())
+	}
+	if !scheme.Recognizes(gvk) {
+		return u, nil
+	}
+	typed, err := scheme.New(gvk)
+	if err != nil {
+		return nil, err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, typed); err != nil {
+		return nil, fmt.Errorf("failed to convert %s %s/%s: %w", gvk.Kind, u.GetNamespace(), u.GetName(), err)
+	}
+	obj, ok := typed.(client.Object)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an object", gvk)
+	}
+	return obj, nil
+}
+
+// Write encodes the objects as multi-document YAML, which can be read by Read.
+func Write(w io.Writer, objects []*unstructured.Unstructured) error {
+	for i, obj := range objects {
+		out, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s %s/%s: %w", obj.GetKind(), obj.GetNamespace(), obj.GetName(), err)
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package snapshot_test
+
+import (
+	"bytes"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/sapcc/vpa_butler/internal/snapshot"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+)
+
+const cluster = `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Node
+  metadata:
+    name: node-a
+    labels:
+      kubernetes.io/hostname: node-a
+      pool: big
+    managedFields:
+    - manager: kubelet
+  status:
+    allocatable:
+      cpu: "4"
+    images:
+    - names: [registry/app]
+- apiVersion: v1
+  kind: Namespace
+  metadata:
+    name: team
+    labels:
+      kubernetes.io/metadata.name: team
+    annotations:
+      vpa-butler.cloud.sap/update-mode: Recreate
+      owner: someone@example.com
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: team
+  annotations:
+    vpa-butler.cloud.sap/main-container: app
+    kubectl.kubernetes.io/last-applied-configuration: "{}"
+spec:
+  selector:
+    matchLabels:
+      app: app
+  template:
+    metadata:
+      labels:
+        app: app
+      annotations:
+        checksum/secret: abc
+    spec:
+      nodeSelector:
+        pool: big
+        kubernetes.io/arch: amd64
+      affinity:
+        nodeAffinity:
+          requiredDuringSchedulingIgnoredDuringExecution:
+            nodeSelectorTerms:
+            - matchExpressions:
+              - key: kubernetes.io/hostname
+                operator: In
+                values: [node-a]
+      imagePullSecrets:
+      - name: registry
+      containers:
+      - name: app
+        image: registry/app
+        command: [app]
+        args: [--password=secret]
+        env:
+        - name: PASSWORD
+          value: secret
+        resources:
+          requests:
+            cpu: 100m
+status:
+  replicas: 1
+---
+apiVersion: autoscaling.k8s.io/v1
+kind: VerticalPodAutoscaler
+metadata:
+  name: app-deployment
+  namespace: team
+  annotations:
+    managedBy: vpa_butler
+  ownerReferences:
+  - apiVersion: apps/v1
+    kind: Deployment
+    name: app
+    uid: "1"
+spec:
+  targetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: app
+status:
+  recommendation:
+    containerRecommendations:
+    - containerName: app
+      target:
+        cpu: 200m
+`
+
+func newScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	Expect(vpav1.AddToScheme(scheme)).To(Succeed())
+	return scheme
+}
+
+// readUnstructured reads the cluster as unstructured objects like they are listed for a snapshot.
+func readUnstructured() []*unstructured.Unstructured {
+	GinkgoHelper()
+	objects, err := snapshot.Read(strings.NewReader(cluster), runtime.NewScheme())
+	Expect(err).ToNot(HaveOccurred())
+	result := make([]*unstructured.Unstructured, len(objects))
+	for i, obj := range objects {
+		u, ok := obj.(*unstructured.Unstructured)
+		Expect(ok).To(BeTrue())
+		result[i] = u
+	}
+	return result
+}
+
+var _ = Describe("Read", func() {
+
+	It("flattens lists and converts known kinds", func() {
+		objects, err := snapshot.Read(strings.NewReader(cluster), newScheme())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects).To(HaveLen(4))
+		Expect(objects[0]).To(BeAssignableToTypeOf(&corev1.Node{}))
+		Expect(objects[1]).To(BeAssignableToTypeOf(&corev1.Namespace{}))
+		Expect(objects[2]).To(BeAssignableToTypeOf(&appsv1.Deployment{}))
+		Expect(objects[3]).To(BeAssignableToTypeOf(&vpav1.VerticalPodAutoscaler{}))
+	})
+
+	It("keeps unknown kinds unstructured", func() {
+		objects, err := snapshot.Read(strings.NewReader(cluster), runtime.NewScheme())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects).To(HaveLen(4))
+		Expect(objects[2]).To(BeAssignableToTypeOf(&unstructured.Unstructured{}))
+	})
+
+	It("rejects objects without kind", func() {
+		_, err := snapshot.Read(strings.NewReader("metadata:\n  name: test\n"), newScheme())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reads what was written", func() {
+		var buf bytes.Buffer
+		Expect(snapshot.Write(&buf, readUnstructured())).To(Succeed())
+		objects, err := snapshot.Read(&buf, newScheme())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects).To(HaveLen(4))
+		Expect(objects[2].GetName()).To(Equal("app"))
+	})
+})
+
+var _ = Describe("Sanitize", func() {
+
+	var node, namespace, deployment, vpa *unstructured.Unstructured
+
+	BeforeEach(func() {
+		objects := readUnstructured()
+		for _, obj := range objects {
+			snapshot.Sanitize(obj)
+		}
+		node, namespace, deployment, vpa = objects[0], objects[1], objects[2], objects[3]
+	})
+
+	It("removes managed fields", func() {
+		Expect(node.GetManagedFields()).To(BeEmpty())
+	})
+
+	It("keeps only the annotations of the vpa_butler", func() {
+		Expect(namespace.GetAnnotations()).To(Equal(map[string]string{
+			"vpa-butler.cloud.sap/update-mode": "Recreate",
+		}))
+		Expect(deployment.GetAnnotations()).To(Equal(map[string]string{
+			"vpa-butler.cloud.sap/main-container": "app",
+		}))
+		Expect(vpa.GetAnnotations()).To(HaveKeyWithValue("managedBy", "vpa_butler"))
+		_, found, err := unstructured.NestedMap(deployment.Object, "spec", "template", "metadata", "annotations")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeFalse())
+	})
+
+	It("strips the environment, commands and arguments of containers", func() {
+		containers, _, err := unstructured.NestedSlice(deployment.Object, "spec", "template", "spec", "containers")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(containers).To(HaveLen(1))
+		container, ok := containers[0].(map[string]any)
+		Expect(ok).To(BeTrue())
+		Expect(container).To(HaveKey("name"))
+		Expect(container).To(HaveKey("resources"))
+		Expect(container).ToNot(HaveKey("env"))
+		Expect(container).ToNot(HaveKey("command"))
+		Expect(container).ToNot(HaveKey("args"))
+		Expect(deployment.Object["spec"]).ToNot(HaveKey("imagePullSecrets"))
+	})
+
+	It("keeps only the status of nodes and vpas read by the vpa_butler", func() {
+		Expect(deployment.Object).ToNot(HaveKey("status"))
+		Expect(node.Object["status"]).To(HaveKey("allocatable"))
+		Expect(node.Object["status"]).ToNot(HaveKey("images"))
+		Expect(vpa.Object["status"]).To(HaveKey("recommendation"))
+	})
+})
+
+var _ = Describe("Anonymizer", func() {
+
+	var node, namespace, deployment, vpa *unstructured.Unstructured
+	var anonymizer *snapshot.Anonymizer
+
+	BeforeEach(func() {
+		objects := readUnstructured()
+		anonymizer = snapshot.NewAnonymizer()
+		for _, obj := range objects {
+			snapshot.Sanitize(obj)
+			anonymizer.Anonymize(obj)
+		}
+		node, namespace, deployment, vpa = objects[0], objects[1], objects[2], objects[3]
+	})
+
+	It("replaces the names of nodes and namespaces", func() {
+		Expect(node.GetName()).To(Equal("node-1"))
+		Expect(node.GetLabels()).To(Equal(map[string]string{
+			"kubernetes.io/hostname": "node-1",
+			"pool":                   "label-1",
+		}))
+		Expect(namespace.GetName()).To(Equal("namespace-1"))
+		Expect(namespace.GetLabels()).To(HaveKeyWithValue("kubernetes.io/metadata.name", "namespace-1"))
+	})
+
+	It("replaces the names of workloads and removes images", func() {
+		Expect(deployment.GetNamespace()).To(Equal("namespace-1"))
+		Expect(deployment.GetName()).To(Equal("workload-1"))
+		containers, _, err := unstructured.NestedSlice(deployment.Object, "spec", "template", "spec", "containers")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(containers[0]).ToNot(HaveKey("image"))
+		Expect(containers[0]).To(HaveKeyWithValue("name", "app"))
+	})
+
+	It("replaces label values consistently with the nodes", func() {
+		Expect(deployment.GetNamespace()).To(Equal("namespace-1"))
+		matchLabels, _, err := unstructured.NestedStringMap(deployment.Object, "spec", "selector", "matchLabels")
+		Expect(err).ToNot(HaveOccurred())
+		templateLabels, _, err := unstructured.NestedStringMap(deployment.Object,
+			"spec", "template", "metadata", "labels")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(matchLabels).To(Equal(map[string]string{"app": "label-2"}))
+		Expect(templateLabels).To(Equal(matchLabels))
+		nodeSelector, _, err := unstructured.NestedStringMap(deployment.Object,
+			"spec", "template", "spec", "nodeSelector")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nodeSelector).To(Equal(map[string]string{"pool": "label-1", "kubernetes.io/arch": "amd64"}))
+		terms, _, err := unstructured.NestedSlice(deployment.Object, "spec", "template", "spec", "affinity",
+			"nodeAffinity", "requiredDuringSchedulingIgnoredDuringExecution", "nodeSelectorTerms")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(terms).To(HaveLen(1))
+		expressions, _, err := unstructured.NestedSlice(terms[0].(map[string]any), "matchExpressions")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(expressions).To(HaveLen(1))
+		Expect(expressions[0]).To(HaveKeyWithValue("values", []any{"node-1"}))
+	})
+
+	It("replaces the label values of node templates keeping their reference", func() {
+		configMap := &unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]any{"name": "node-templates", "namespace": "team"},
+			"data": map[string]any{
+				"big": "labels:\n  pool: big\nallocatable:\n  cpu: \"8\"\n",
+			},
+		}}
+		anonymizer.Anonymize(configMap)
+		Expect(configMap.GetName()).To(Equal("node-templates"))
+		Expect(configMap.GetNamespace()).To(Equal("team"))
+		Expect(configMap.Object["data"]).To(HaveKeyWithValue("big", "allocatable:\n  cpu: \"8\"\nlabels:\n  pool: label-1\n"))
+	})
+
+	It("keeps the references of served vpas intact", func() {
+		Expect(vpa.GetNamespace()).To(Equal("namespace-1"))
+		Expect(vpa.GetName()).To(Equal("workload-1-deployment"))
+		Expect(vpa.GetOwnerReferences()).To(HaveLen(1))
+		Expect(vpa.GetOwnerReferences()[0].Name).To(Equal("workload-1"))
+		target, _, err := unstructured.NestedString(vpa.Object, "spec", "targetRef", "name")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal("workload-1"))
+	})
+})